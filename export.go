@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mcandeia/warp-go-server/pkg/config"
+	"github.com/mcandeia/warp-go-server/pkg/store"
+)
+
+// runStateCommand implements the export and import commands, copying the store of the
+// configuration to or from a JSON document. The store file is locked by a running server,
+// so it must be stopped first.
+func runStateCommand(command string, args []string) int {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	file := fs.String("file", "-", "JSON document to write or read, - for stdout or stdin")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: warp-go-server %s [-file path] [server flags]\n", command)
+		fs.PrintDefaults()
+	}
+	cfg, _, err := config.Load(fs, args, os.LookupEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if cfg.Store.Path == "" {
+		fmt.Fprintln(os.Stderr, "no store configured, set -store or store.path")
+		return 2
+	}
+	stateStore, err := store.Open(cfg.Store.Path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer stateStore.Close()
+
+	if command == "export" {
+		err = exportState(stateStore, *file)
+	} else {
+		err = importState(stateStore, *file)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", command, err)
+		return 1
+	}
+	return 0
+}
+
+// exportState writes the store to path
+func exportState(stateStore *store.Store, path string) error {
+	var out io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	return stateStore.Export(out)
+}
+
+// importState merges the document at path into the store
+func importState(stateStore *store.Store, path string) error {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	return stateStore.Import(in)
+}
@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,45 +17,218 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/mcandeia/warp-go-server/pkg/accesslog"
+	"github.com/mcandeia/warp-go-server/pkg/config"
 	"github.com/mcandeia/warp-go-server/pkg/server"
-)
-
-type key int
-
-const (
-	requestIDKey key = 0
+	"github.com/mcandeia/warp-go-server/pkg/store"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var (
-	listenAddr string
-	healthy    int32
+	healthy int32
 )
 
 func main() {
-	flag.StringVar(&listenAddr, "port", "8001", "server listen address")
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "export" || os.Args[1] == "import") {
+		os.Exit(runStateCommand(os.Args[1], os.Args[2:]))
+	}
+
+	checkConfig := flag.Bool("check-config", false, "validate the configuration, report the errors found and exit")
+	cfg, source, err := config.Load(flag.CommandLine, os.Args[1:], os.LookupEnv)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if *checkConfig {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+			os.Exit(1)
+		}
+		origin := "defaults, environment and flags"
+		if source.Path != "" {
+			origin = source.Path
+		}
+		fmt.Printf("configuration is valid (%s)\n", origin)
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
 
-	logger := log.New(os.Stdout, "http: ", log.LstdFlags)
+	logLevel := &slog.LevelVar{}
+	if err := logLevel.UnmarshalText([]byte(cfg.Logging.Level)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger, err := newLogger(os.Stdout, cfg.Logging.Format, logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+	errorLog := slog.NewLogLogger(logger.Handler(), slog.LevelError)
 
 	nextRequestID := func() string {
 		return fmt.Sprintf("%d", time.Now().UnixNano())
 	}
-	svc := server.New()
+	serverOptions := []server.ServerOption{}
+	if cfg.Tracing.OTLPEndpoint != "" {
+		tracerProvider, err := server.NewOTLPTracerProvider(context.Background(), cfg.Tracing.OTLPEndpoint)
+		if err != nil {
+			logger.Error("Could not create the OTLP exporter", "error", err)
+			os.Exit(1)
+		}
+		defer tracerProvider.Shutdown(context.Background())
+		serverOptions = append(serverOptions, server.WithTracerProvider(tracerProvider))
+	}
+	if cfg.TLS.ACME {
+		acmeOptions, err := newACMEOptions(cfg.TLS)
+		if err != nil {
+			logger.Error("Could not configure ACME", "error", err)
+			os.Exit(1)
+		}
+		serverOptions = append(serverOptions, server.WithACME(acmeOptions))
+	}
+	if cfg.TLS.CertStoreDir != "" {
+		key, _ := hex.DecodeString(cfg.TLS.CertStoreKey)
+		certificates, err := server.NewCertificateStore(cfg.TLS.CertStoreDir, key)
+		if err != nil {
+			logger.Error("Could not open the certificate store", "error", err)
+			os.Exit(1)
+		}
+		serverOptions = append(serverOptions, server.WithCertificateStore(certificates))
+	}
+	var state server.StateStore = server.NewMemoryStateStore()
+	if cfg.Store.Path != "" {
+		stateStore, err := store.Open(cfg.Store.Path)
+		if err != nil {
+			logger.Error("Could not open the store", "error", err)
+			os.Exit(1)
+		}
+		defer stateStore.Close()
+		state = stateStore
+	}
+	serverOptions = append(serverOptions, server.WithStateStore(state))
+	if cfg.Domains.Base != "" {
+		allocator := server.NewSubdomainAllocator(cfg.Domains.Base, cfg.Domains.ReserveSubdomains)
+		if err := allocator.Persist(state); err != nil {
+			logger.Error("Could not load the subdomain reservations", "error", err)
+			os.Exit(1)
+		}
+		serverOptions = append(serverOptions, server.WithSubdomains(allocator))
+	}
+	if cfg.Domains.Verify {
+		verifier := server.NewDomainVerifier([]byte(cfg.Domains.VerificationSecret), server.NewDNSResolver(cfg.Domains.DNSResolver))
+		if err := verifier.Persist(state); err != nil {
+			logger.Error("Could not load the verified domains", "error", err)
+			os.Exit(1)
+		}
+		serverOptions = append(serverOptions, server.WithDomainVerifier(verifier))
+	}
+	if cfg.Tunnels.TCPPorts != "" {
+		ports, _ := server.ParsePortRange(cfg.Tunnels.TCPHost, cfg.Tunnels.TCPPorts)
+		serverOptions = append(serverOptions, server.WithTCPPorts(ports))
+	}
+	if cfg.Tunnels.UDPPorts != "" {
+		ports, _ := server.ParsePortRange(cfg.Tunnels.UDPHost, cfg.Tunnels.UDPPorts)
+		serverOptions = append(serverOptions, server.WithUDPPorts(ports), server.WithUDPIdleTimeout(cfg.Tunnels.UDPIdleTimeout))
+	}
+	// validated along with the configuration
+	registry, _ := server.NewRegistry(cfg.Cluster.Registry)
+	serverOptions = append(serverOptions,
+		server.WithRouteRegistry(registry),
+		server.WithNodeID(cfg.Cluster.NodeID),
+		server.WithLeaseTTL(cfg.Cluster.LeaseTTL),
+		server.WithLogger(logger),
+		server.WithInspector(server.NewInspector(cfg.Inspector.Capacity, cfg.Inspector.BodyLimit)),
+		server.WithPolicy(cfg.Policy()),
+	)
+	if cfg.Cluster.Listen != "" {
+		serverOptions = append(serverOptions, server.WithPeers(cfg.Peers()))
+	}
+	if cfg.SSO.Issuer != "" {
+		serverOptions = append(serverOptions, server.WithSSO(cfg.SSOOptions()))
+	}
+	var svc *server.Server
+	reload := newReloader(logger, source, cfg, logLevel, func(policy server.Policy) {
+		svc.SetPolicy(policy)
+	})
+	serverOptions = append(serverOptions, server.WithReloader(reload))
+	svc = server.New(serverOptions...)
 	serverRoutes := svc.Routes()
 	serverRoutes.HandleFunc("/_healthcheck", healthHandler)
 
 	withTrace := tracing(nextRequestID)
-	withLogs := logging(logger)
-	loggedRoutes := withLogs(serverRoutes)
+	var loggedRoutes http.Handler = serverRoutes
+	if cfg.AccessLog.File != "" {
+		accessLogger, err := newAccessLogger(cfg.AccessLog)
+		if err != nil {
+			logger.Error("Could not create the access log", "error", err)
+			os.Exit(1)
+		}
+		defer accessLogger.Close()
+		loggedRoutes = accessLogger.Middleware(serverRoutes)
+	}
 	handler := withTrace(loggedRoutes)
 
 	server := &http.Server{
-		Addr:         fmt.Sprintf(":%s", listenAddr),
-		Handler:      handler,
-		ErrorLog:     logger,
-		ReadTimeout:  60 * time.Second,
-		WriteTimeout: 60 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Addr: fmt.Sprintf(":%s", cfg.Listen.HTTP),
+		// visitors can speak HTTP/2 without TLS (h2c), e.g. gRPC clients using insecure credentials
+		Handler:      h2c.NewHandler(svc.HTTPHandler(handler), &http2.Server{}),
+		ErrorLog:     errorLog,
+		ReadTimeout:  cfg.Timeouts.Read,
+		WriteTimeout: cfg.Timeouts.Write,
+		IdleTimeout:  cfg.Timeouts.Idle,
+	}
+
+	auxServers := []*http.Server{}
+	if cfg.Listen.HTTPS != "" {
+		httpsServer := &http.Server{
+			Addr:         fmt.Sprintf(":%s", cfg.Listen.HTTPS),
+			Handler:      handler,
+			TLSConfig:    svc.TLSConfig(),
+			ErrorLog:     errorLog,
+			ReadTimeout:  cfg.Timeouts.Read,
+			WriteTimeout: cfg.Timeouts.Write,
+			IdleTimeout:  cfg.Timeouts.Idle,
+		}
+		go func() {
+			if err := httpsServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				logger.Error("Could not listen", "addr", cfg.Listen.HTTPS, "error", err)
+				os.Exit(1)
+			}
+		}()
+		auxServers = append(auxServers, httpsServer)
+	}
+	if cfg.Cluster.Listen != "" {
+		// forwarded requests stream like visitor requests, they get the same timeouts
+		peerServer := &http.Server{
+			Addr:         fmt.Sprintf(":%s", cfg.Cluster.Listen),
+			Handler:      h2c.NewHandler(svc.PeerRoutes(), &http2.Server{}),
+			ErrorLog:     errorLog,
+			ReadTimeout:  cfg.Timeouts.Read,
+			WriteTimeout: cfg.Timeouts.Write,
+			IdleTimeout:  cfg.Timeouts.Idle,
+		}
+		go func() {
+			if err := peerServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("Could not listen", "addr", cfg.Cluster.Listen, "error", err)
+				os.Exit(1)
+			}
+		}()
+		auxServers = append(auxServers, peerServer)
+	}
+	if cfg.Listen.Metrics != "" {
+		metricsRoutes := http.NewServeMux()
+		metricsRoutes.Handle("/metrics", svc.MetricsHandler())
+		auxServers = append(auxServers, serveAux(logger, errorLog, cfg.Listen.Metrics, metricsRoutes))
+	}
+	if cfg.Listen.Admin != "" {
+		auxServers = append(auxServers, serveAux(logger, errorLog, cfg.Listen.Admin, svc.AdminRoutes(cfg.Auth.AdminToken)))
 	}
 
 	// Listen for CTRL+C or kill and start shutting down the app without
@@ -58,30 +236,102 @@ func main() {
 	done := make(chan bool)
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			logger.Info("Reloading the configuration on SIGHUP")
+			reload()
+		}
+	}()
 
 	go func() {
 		<-quit
-		logger.Println("Server is shutting down...")
+		logger.Info("Server is shutting down...")
 		atomic.StoreInt32(&healthy, 0)
 
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
 		defer cancel()
 
+		// tunnels are hijacked connections that server.Shutdown does not track, they are drained
+		// alongside so the visitor requests in flight can still reach their clients
+		drained := make(chan error, 1)
+		go func() {
+			drained <- svc.Drain(ctx)
+		}()
 		server.SetKeepAlivesEnabled(false)
 		if err := server.Shutdown(ctx); err != nil {
-			logger.Fatalf("Could not gracefully shutdown the server: %v\n", err)
+			logger.Error("Could not gracefully shutdown the server", "error", err)
+			os.Exit(1)
+		}
+		select {
+		case err := <-drained:
+			if err != nil {
+				logger.Warn("Tunnels were closed before their requests finished", "error", err)
+			}
+		case <-ctx.Done():
+			logger.Warn("Tunnels were not drained before the shutdown timeout")
+		}
+		for _, auxServer := range auxServers {
+			auxServer.Shutdown(ctx)
 		}
 		close(done)
 	}()
 
-	logger.Println("Server is ready to handle requests at", listenAddr)
+	logger.Info("Server is ready to handle requests", "addr", cfg.Listen.HTTP)
 	atomic.StoreInt32(&healthy, 1)
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		logger.Fatalf("Could not listen on %s: %v\n", listenAddr, err)
+		logger.Error("Could not listen", "addr", cfg.Listen.HTTP, "error", err)
+		os.Exit(1)
 	}
 
 	<-done
-	logger.Println("Server stopped")
+	logger.Info("Server stopped")
+}
+
+// newACMEOptions creates the ACME options of the TLS configuration
+func newACMEOptions(cfg config.TLS) (server.ACMEOptions, error) {
+	acmeOptions := server.ACMEOptions{
+		DirectoryURL: cfg.ACMEDirectory,
+		Email:        cfg.ACMEEmail,
+		Store:        server.DirCertStore(cfg.ACMECache),
+		Challenges:   cfg.ACMEChallenges,
+	}
+	if cfg.ACMECARoot != "" {
+		pem, err := os.ReadFile(cfg.ACMECARoot)
+		if err != nil {
+			return acmeOptions, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return acmeOptions, fmt.Errorf("no certificate found in %s", cfg.ACMECARoot)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		acmeOptions.HTTPClient = &http.Client{Transport: transport}
+	}
+	return acmeOptions, nil
+}
+
+// serveAux starts an auxiliary listener such as the metrics or admin one
+func serveAux(logger *slog.Logger, errorLog *log.Logger, port string, handler http.Handler) *http.Server {
+	auxServer := &http.Server{
+		Addr:         fmt.Sprintf(":%s", port),
+		Handler:      handler,
+		ErrorLog:     errorLog,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := auxServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("Could not listen", "addr", port, "error", err)
+			os.Exit(1)
+		}
+	}()
+	return auxServer
 }
 
 // Report server status
@@ -94,19 +344,39 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusServiceUnavailable)
 }
 
-func logging(logger *log.Logger) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			defer func() {
-				requestID, ok := r.Context().Value(requestIDKey).(string)
-				if !ok {
-					requestID = "unknown"
-				}
-				logger.Println(requestID, r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
-			}()
-			next.ServeHTTP(w, r)
-		})
+// newLogger creates a slog logger writing to w in the given format, the level can change
+// while the logger is in use
+func newLogger(w io.Writer, format string, level *slog.LevelVar) (*slog.Logger, error) {
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q: expected text or json", format)
+	}
+}
+
+// newAccessLogger creates the access logger of the access log configuration
+func newAccessLogger(cfg config.AccessLog) (*accesslog.Logger, error) {
+	format, err := accesslog.ParseFormat(cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+	var out io.Writer = os.Stdout
+	if cfg.File != "-" {
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		out = f
 	}
+	return accesslog.New(out,
+		accesslog.WithFormat(format),
+		accesslog.WithDomainDir(cfg.Dir),
+		accesslog.WithSampleRate(cfg.Sample),
+	), nil
 }
 
 func tracing(nextRequestID func() string) func(http.Handler) http.Handler {
@@ -116,7 +386,7 @@ func tracing(nextRequestID func() string) func(http.Handler) http.Handler {
 			if requestID == "" {
 				requestID = nextRequestID()
 			}
-			ctx := context.WithValue(r.Context(), requestIDKey, requestID)
+			ctx := server.WithRequestID(r.Context(), requestID)
 			w.Header().Set("X-Request-Id", requestID)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
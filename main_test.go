@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	level := &slog.LevelVar{}
+	if err := level.UnmarshalText([]byte("warn")); err != nil {
+		t.Fatal(err)
+	}
+	logger, err := newLogger(&buf, "json", level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown", "domain", "example.test")
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON record, got %q", buf.String())
+	}
+	if record["msg"] != "shown" || record["domain"] != "example.test" {
+		t.Errorf("unexpected record %v", record)
+	}
+
+	// the level changes while the logger is in use
+	buf.Reset()
+	level.Set(slog.LevelDebug)
+	logger.Debug("now shown")
+	if !strings.Contains(buf.String(), "now shown") {
+		t.Errorf("expected the new level to apply, got %q", buf.String())
+	}
+
+	buf.Reset()
+	logger, err = newLogger(&buf, "text", level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("plain", "client_id", "c1")
+	if got := buf.String(); !strings.Contains(got, "msg=plain") || !strings.Contains(got, "client_id=c1") {
+		t.Errorf("unexpected text record %q", got)
+	}
+
+	if _, err := newLogger(&buf, "xml", level); err == nil {
+		t.Error("expected an unknown format to be rejected")
+	}
+	if err := level.UnmarshalText([]byte("verbose")); err == nil {
+		t.Error("expected an unknown level to be rejected")
+	}
+}
@@ -0,0 +1,237 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mcandeia/warp-go-server/pkg/server"
+)
+
+// Format is the layout of an access log line
+type Format string
+
+const (
+	// FormatCommon is the NCSA Common Log Format
+	FormatCommon Format = "common"
+	// FormatCombined is the Common Log Format plus referer and user agent
+	FormatCombined Format = "combined"
+	// FormatJSON writes one JSON object per request
+	FormatJSON Format = "json"
+)
+
+// ParseFormat validates a format name
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(name); format {
+	case FormatCommon, FormatCombined, FormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("invalid access log format %q: expected common, combined or json", name)
+	}
+}
+
+// Entry is a struct to hold the fields of an access log line
+type Entry struct {
+	Time       time.Time     `json:"time"`
+	RemoteAddr string        `json:"remote_addr"`
+	Host       string        `json:"host"`
+	Method     string        `json:"method"`
+	URI        string        `json:"uri"`
+	Proto      string        `json:"proto"`
+	Status     int           `json:"status"`
+	Bytes      int64         `json:"bytes"`
+	Duration   time.Duration `json:"duration_ns"`
+	Referer    string        `json:"referer,omitempty"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+	RequestID  string        `json:"request_id,omitempty"`
+	ClientID   string        `json:"client_id,omitempty"`
+	MessageID  string        `json:"message_id,omitempty"`
+}
+
+// Options is a struct to hold access log options
+type Options struct {
+	// format is the layout of each line
+	format Format
+	// domainDir is the directory of the per-domain log files, empty to disable them
+	domainDir string
+	// sampleRate is the fraction of successful requests that are logged
+	sampleRate float64
+	// now returns the current time
+	now func() time.Time
+}
+
+// Option is a type for options
+type Option func(*Options)
+
+// WithFormat is an option to set the line format
+func WithFormat(format Format) Option {
+	return func(o *Options) {
+		o.format = format
+	}
+}
+
+// WithDomainDir is an option to also write the requests served by a tunnel to dir/<domain>.log
+func WithDomainDir(dir string) Option {
+	return func(o *Options) {
+		o.domainDir = dir
+	}
+}
+
+// WithSampleRate is an option to log only a fraction of the successful requests,
+// requests answered with a 4xx or 5xx status are always logged
+func WithSampleRate(rate float64) Option {
+	return func(o *Options) {
+		o.sampleRate = rate
+	}
+}
+
+// Logger is a struct to write access logs
+type Logger struct {
+	opts    Options
+	mu      sync.Mutex
+	out     io.Writer
+	domains map[string]*os.File
+}
+
+// New creates a Logger writing to out
+func New(out io.Writer, options ...Option) *Logger {
+	opts := Options{
+		format:     FormatCombined,
+		sampleRate: 1,
+		now:        time.Now,
+	}
+	for _, option := range options {
+		option(&opts)
+	}
+	return &Logger{opts: opts, out: out, domains: map[string]*os.File{}}
+}
+
+// Middleware is a method to log every request served by next
+func (l *Logger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := l.opts.now()
+		ctx, tunnel := server.WithTunnelInfo(r.Context())
+		rec := server.NewResponseRecorder(w)
+		defer func() {
+			requestID, _ := server.RequestIDFromContext(r.Context())
+			status := rec.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			l.Log(Entry{
+				Time:       start,
+				RemoteAddr: r.RemoteAddr,
+				Host:       r.Host,
+				Method:     r.Method,
+				URI:        r.RequestURI,
+				Proto:      r.Proto,
+				Status:     status,
+				Bytes:      rec.Written(),
+				Duration:   l.opts.now().Sub(start),
+				Referer:    r.Referer(),
+				UserAgent:  r.UserAgent(),
+				RequestID:  requestID,
+				ClientID:   tunnel.ClientID,
+				MessageID:  tunnel.MessageID,
+			})
+		}()
+		next.ServeHTTP(rec, r.WithContext(ctx))
+	})
+}
+
+// Log is a method to write an entry, subject to sampling
+func (l *Logger) Log(entry Entry) {
+	if entry.Status < http.StatusBadRequest && l.opts.sampleRate < 1 && rand.Float64() >= l.opts.sampleRate {
+		return
+	}
+	line := l.format(entry)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+	// only tunneled requests get a domain file, otherwise any Host header would open a new file
+	if l.opts.domainDir != "" && entry.ClientID != "" {
+		if f, err := l.domainFile(entry.Host); err == nil {
+			f.Write(line)
+		}
+	}
+}
+
+// Close is a method to close the per-domain log files
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var firstErr error
+	for domain, f := range l.domains {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(l.domains, domain)
+	}
+	return firstErr
+}
+
+// domainFile returns the log file of a domain, opening it on first use
+func (l *Logger) domainFile(host string) (*os.File, error) {
+	domain := sanitizeDomain(host)
+	if f, ok := l.domains[domain]; ok {
+		return f, nil
+	}
+	f, err := os.OpenFile(filepath.Join(l.opts.domainDir, domain+".log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	l.domains[domain] = f
+	return f, nil
+}
+
+// sanitizeDomain turns a host into a safe file name
+func sanitizeDomain(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(host))
+}
+
+// format renders an entry in the configured format, including the trailing newline
+func (l *Logger) format(e Entry) []byte {
+	if l.opts.format == FormatJSON {
+		line, _ := json.Marshal(e)
+		return append(line, '\n')
+	}
+	remoteHost := e.RemoteAddr
+	if h, _, err := net.SplitHostPort(remoteHost); err == nil {
+		remoteHost = h
+	}
+	line := fmt.Sprintf("%s - - [%s] %q %d %s",
+		remoteHost,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method+" "+e.URI+" "+e.Proto,
+		e.Status,
+		clfBytes(e.Bytes),
+	)
+	if l.opts.format == FormatCombined {
+		line += fmt.Sprintf(" %q %q", e.Referer, e.UserAgent)
+	}
+	return []byte(line + "\n")
+}
+
+// clfBytes renders the response size as the Common Log Format expects it
+func clfBytes(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return fmt.Sprint(n)
+}
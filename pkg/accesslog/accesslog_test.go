@@ -0,0 +1,101 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2024, time.June, 1, 10, 30, 0, 0, time.UTC)
+
+func testEntry(status int) Entry {
+	return Entry{
+		Time:       testTime,
+		RemoteAddr: "10.0.0.1:5555",
+		Host:       "example.test",
+		Method:     "GET",
+		URI:        "/hello?x=1",
+		Proto:      "HTTP/1.1",
+		Status:     status,
+		Bytes:      42,
+		Duration:   3 * time.Millisecond,
+		Referer:    "https://ref.test/",
+		UserAgent:  "curl/8",
+		ClientID:   "client-1",
+	}
+}
+
+func TestFormats(t *testing.T) {
+	tests := []struct {
+		format   Format
+		expected string
+	}{
+		{FormatCommon, `10.0.0.1 - - [01/Jun/2024:10:30:00 +0000] "GET /hello?x=1 HTTP/1.1" 200 42` + "\n"},
+		{FormatCombined, `10.0.0.1 - - [01/Jun/2024:10:30:00 +0000] "GET /hello?x=1 HTTP/1.1" 200 42 "https://ref.test/" "curl/8"` + "\n"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		New(&out, WithFormat(tt.format)).Log(testEntry(http.StatusOK))
+		if out.String() != tt.expected {
+			t.Errorf("%s format: got %q want %q", tt.format, out.String(), tt.expected)
+		}
+	}
+
+	var out bytes.Buffer
+	New(&out, WithFormat(FormatJSON)).Log(testEntry(http.StatusOK))
+	var entry Entry
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.ClientID != "client-1" || entry.Duration != 3*time.Millisecond || entry.Status != http.StatusOK {
+		t.Errorf("json format: unexpected entry %+v", entry)
+	}
+}
+
+func TestSamplingKeepsErrors(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, WithFormat(FormatCommon), WithSampleRate(0))
+	logger.Log(testEntry(http.StatusOK))
+	if out.Len() != 0 {
+		t.Errorf("expected successful request to be sampled out, got %q", out.String())
+	}
+	logger.Log(testEntry(http.StatusBadGateway))
+	if out.Len() == 0 {
+		t.Error("expected failed request to be logged")
+	}
+}
+
+func TestMiddlewareWritesDomainFile(t *testing.T) {
+	dir := t.TempDir()
+	var out bytes.Buffer
+	logger := New(&out, WithFormat(FormatCommon), WithDomainDir(dir))
+	defer logger.Close()
+
+	handler := logger.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	}))
+	req := httptest.NewRequest("GET", "/pot", nil)
+	req.Host = "../evil.test"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !bytes.Contains(out.Bytes(), []byte(`"GET /pot HTTP/1.1" 418 15`)) {
+		t.Errorf("unexpected access log line %q", out.String())
+	}
+	// the request was not served by a tunnel so no domain file is created
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected no domain files, got %d", len(entries))
+	}
+
+	entry := testEntry(http.StatusOK)
+	entry.Host = "../evil.test:8080"
+	logger.Log(entry)
+	if _, err := os.Stat(filepath.Join(dir, ".._evil.test.log")); err != nil {
+		t.Errorf("expected sanitized domain file: %v", err)
+	}
+}
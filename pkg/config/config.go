@@ -0,0 +1,513 @@
+package config
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mcandeia/warp-go-server/pkg/accesslog"
+	"github.com/mcandeia/warp-go-server/pkg/server"
+	"golang.org/x/crypto/acme/autocert"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a struct to hold the server configuration, the fields tagged reload can change
+// while the server runs and the ones tagged secret are never printed
+type Config struct {
+	Listen    Listen    `yaml:"listen"`
+	Timeouts  Timeouts  `yaml:"timeouts"`
+	Logging   Logging   `yaml:"logging"`
+	AccessLog AccessLog `yaml:"accessLog"`
+	Tracing   Tracing   `yaml:"tracing"`
+	Auth      Auth      `yaml:"auth"`
+	Limits    Limits    `yaml:"limits"`
+	Inspector Inspector `yaml:"inspector"`
+	TLS       TLS       `yaml:"tls"`
+	Domains   Domains   `yaml:"domains"`
+	Tunnels   Tunnels   `yaml:"tunnels"`
+	Cluster   Cluster   `yaml:"cluster"`
+	Store     Store     `yaml:"store"`
+	SSO       SSO       `yaml:"sso"`
+}
+
+// Listen holds the ports of the listeners, empty disables the optional ones
+type Listen struct {
+	HTTP    string `yaml:"http" env:"WARP_LISTEN_HTTP"`
+	HTTPS   string `yaml:"https" env:"WARP_LISTEN_HTTPS"`
+	Metrics string `yaml:"metrics" env:"WARP_LISTEN_METRICS"`
+	Admin   string `yaml:"admin" env:"WARP_LISTEN_ADMIN"`
+}
+
+// Timeouts holds the timeouts of the tunnel listeners and of the shutdown
+type Timeouts struct {
+	Read     time.Duration `yaml:"read" env:"WARP_TIMEOUTS_READ"`
+	Write    time.Duration `yaml:"write" env:"WARP_TIMEOUTS_WRITE"`
+	Idle     time.Duration `yaml:"idle" env:"WARP_TIMEOUTS_IDLE"`
+	Shutdown time.Duration `yaml:"shutdown" env:"WARP_TIMEOUTS_SHUTDOWN"`
+}
+
+// Logging holds the server log settings
+type Logging struct {
+	Format string `yaml:"format" env:"WARP_LOGGING_FORMAT"`
+	Level  string `yaml:"level" env:"WARP_LOGGING_LEVEL" reload:"true"`
+}
+
+// AccessLog holds the access log settings
+type AccessLog struct {
+	// File is the access log file, - for stdout and empty to disable
+	File   string  `yaml:"file" env:"WARP_ACCESS_LOG_FILE"`
+	Format string  `yaml:"format" env:"WARP_ACCESS_LOG_FORMAT"`
+	Dir    string  `yaml:"dir" env:"WARP_ACCESS_LOG_DIR"`
+	Sample float64 `yaml:"sample" env:"WARP_ACCESS_LOG_SAMPLE"`
+}
+
+// Tracing holds the OpenTelemetry settings
+type Tracing struct {
+	OTLPEndpoint string `yaml:"otlpEndpoint" env:"WARP_TRACING_OTLP_ENDPOINT"`
+}
+
+// Auth holds the credentials of the admin API and of the tunnel clients
+type Auth struct {
+	AdminToken string `yaml:"adminToken" env:"WARP_ADMIN_TOKEN" secret:"true"`
+	// APIKeys are the keys tunnel clients must register with, any key is accepted when empty
+	// unless RequireAPIKey is set
+	APIKeys []string `yaml:"apiKeys" env:"WARP_API_KEYS" reload:"true" secret:"true"`
+	// RequireAPIKey only accepts APIKeys and the keys issued through the admin API
+	RequireAPIKey bool `yaml:"requireApiKey" env:"WARP_REQUIRE_API_KEY" reload:"true"`
+}
+
+// Limits holds the limits applied to tunnel clients and visitors
+type Limits struct {
+	MaxDomainsPerClient int     `yaml:"maxDomainsPerClient" env:"WARP_LIMITS_MAX_DOMAINS_PER_CLIENT" reload:"true"`
+	RateLimit           float64 `yaml:"rateLimit" env:"WARP_LIMITS_RATE_LIMIT" reload:"true"`
+	RateBurst           int     `yaml:"rateBurst" env:"WARP_LIMITS_RATE_BURST" reload:"true"`
+}
+
+// Inspector holds the traffic inspector settings
+type Inspector struct {
+	Capacity  int `yaml:"capacity" env:"WARP_INSPECTOR_CAPACITY"`
+	BodyLimit int `yaml:"bodyLimit" env:"WARP_INSPECTOR_BODY_LIMIT"`
+}
+
+// TLS holds the ACME and uploaded certificates settings
+type TLS struct {
+	ACME           bool     `yaml:"acme" env:"WARP_TLS_ACME"`
+	ACMEDirectory  string   `yaml:"acmeDirectory" env:"WARP_TLS_ACME_DIRECTORY"`
+	ACMEEmail      string   `yaml:"acmeEmail" env:"WARP_TLS_ACME_EMAIL"`
+	ACMECache      string   `yaml:"acmeCache" env:"WARP_TLS_ACME_CACHE"`
+	ACMECARoot     string   `yaml:"acmeCARoot" env:"WARP_TLS_ACME_CA_ROOT"`
+	ACMEChallenges []string `yaml:"acmeChallenges" env:"WARP_TLS_ACME_CHALLENGES"`
+	CertStoreDir   string   `yaml:"certStoreDir" env:"WARP_TLS_CERT_STORE_DIR"`
+	CertStoreKey   string   `yaml:"certStoreKey" env:"WARP_CERT_STORE_KEY" secret:"true"`
+}
+
+// Domains holds the domain policies
+type Domains struct {
+	Base               string   `yaml:"base" env:"WARP_DOMAINS_BASE"`
+	ReserveSubdomains  bool     `yaml:"reserveSubdomains" env:"WARP_DOMAINS_RESERVE_SUBDOMAINS"`
+	Verify             bool     `yaml:"verify" env:"WARP_DOMAINS_VERIFY"`
+	VerificationSecret string   `yaml:"verificationSecret" env:"WARP_VERIFICATION_SECRET" secret:"true"`
+	DNSResolver        string   `yaml:"dnsResolver" env:"WARP_DOMAINS_DNS_RESOLVER"`
+	Allowed            []string `yaml:"allowed" env:"WARP_DOMAINS_ALLOWED" reload:"true"`
+	Denied             []string `yaml:"denied" env:"WARP_DOMAINS_DENIED" reload:"true"`
+}
+
+// Tunnels holds the raw TCP and UDP tunnels settings
+type Tunnels struct {
+	TCPPorts       string        `yaml:"tcpPorts" env:"WARP_TUNNELS_TCP_PORTS"`
+	TCPHost        string        `yaml:"tcpHost" env:"WARP_TUNNELS_TCP_HOST"`
+	UDPPorts       string        `yaml:"udpPorts" env:"WARP_TUNNELS_UDP_PORTS"`
+	UDPHost        string        `yaml:"udpHost" env:"WARP_TUNNELS_UDP_HOST"`
+	UDPIdleTimeout time.Duration `yaml:"udpIdleTimeout" env:"WARP_TUNNELS_UDP_IDLE_TIMEOUT"`
+}
+
+// Cluster holds the settings shared by the nodes serving the same domains
+type Cluster struct {
+	// NodeID names this node in the registry, the host name when empty
+	NodeID string `yaml:"nodeId" env:"WARP_CLUSTER_NODE_ID"`
+	// Registry is memory for a single node or redis://[:password@]host:port[/db]
+	Registry string        `yaml:"registry" env:"WARP_CLUSTER_REGISTRY" secret:"true"`
+	LeaseTTL time.Duration `yaml:"leaseTTL" env:"WARP_CLUSTER_LEASE_TTL"`
+	// Listen is the port of the requests forwarded by the other nodes, empty disables forwarding
+	Listen string `yaml:"listen" env:"WARP_CLUSTER_LISTEN"`
+	// AdvertiseURL is where the other nodes reach Listen, e.g. http://10.0.0.2:8002
+	AdvertiseURL string `yaml:"advertiseURL" env:"WARP_CLUSTER_ADVERTISE_URL"`
+	PeerSecret   string `yaml:"peerSecret" env:"WARP_CLUSTER_PEER_SECRET" secret:"true"`
+}
+
+// Store holds the settings of the registration state kept across restarts
+type Store struct {
+	// Path is the bbolt file of the reservations, API keys, verified domains and domain settings,
+	// the state is lost on restart when empty
+	Path string `yaml:"path" env:"WARP_STORE_PATH"`
+}
+
+// SSO holds the OpenID Connect provider the visitors of the domains with single sign-on log in with
+type SSO struct {
+	// Issuer is the provider URL, empty disables single sign-on
+	Issuer       string `yaml:"issuer" env:"WARP_SSO_ISSUER"`
+	ClientID     string `yaml:"clientId" env:"WARP_SSO_CLIENT_ID"`
+	ClientSecret string `yaml:"clientSecret" env:"WARP_SSO_CLIENT_SECRET" secret:"true"`
+	// LoginURL is the base URL of this server the provider redirects to, <LoginURL>/_warp/sso/callback
+	// must be registered at the provider
+	LoginURL string `yaml:"loginURL" env:"WARP_SSO_LOGIN_URL"`
+	// Secret signs the visitor sessions and the forwarded identities, shared by the nodes of a cluster
+	Secret     string        `yaml:"secret" env:"WARP_SSO_SECRET" secret:"true"`
+	SessionTTL time.Duration `yaml:"sessionTTL" env:"WARP_SSO_SESSION_TTL"`
+	Scopes     []string      `yaml:"scopes" env:"WARP_SSO_SCOPES"`
+}
+
+// Default is a function to return the configuration used when nothing is set
+func Default() Config {
+	return Config{
+		Listen: Listen{
+			HTTP:    "8001",
+			Metrics: "9090",
+		},
+		Timeouts: Timeouts{
+			Read:     60 * time.Second,
+			Write:    60 * time.Second,
+			Idle:     60 * time.Second,
+			Shutdown: 30 * time.Second,
+		},
+		Logging: Logging{
+			Format: "text",
+			Level:  "info",
+		},
+		AccessLog: AccessLog{
+			File:   "-",
+			Format: string(accesslog.FormatCombined),
+			Sample: 1,
+		},
+		Inspector: Inspector{
+			Capacity:  server.DefaultInspectorCapacity,
+			BodyLimit: server.DefaultInspectorBodyLimit,
+		},
+		TLS: TLS{
+			ACMEDirectory:  autocert.DefaultACMEDirectory,
+			ACMECache:      "certs",
+			ACMEChallenges: []string{server.ChallengeHTTP01, server.ChallengeTLSALPN01},
+		},
+		Tunnels: Tunnels{
+			UDPIdleTimeout: server.DefaultUDPIdleTimeout,
+		},
+		Cluster: Cluster{
+			Registry: "memory",
+			LeaseTTL: server.DefaultLeaseTTL,
+		},
+		SSO: SSO{
+			SessionTTL: server.DefaultSSOSessionTTL,
+			Scopes:     []string{"openid", "email", "profile"},
+		},
+	}
+}
+
+// RegisterFlags is a method to bind the command line flags to the configuration fields
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen.HTTP, "port", c.Listen.HTTP, "server listen address")
+	fs.StringVar(&c.Listen.Metrics, "metrics-port", c.Listen.Metrics, "prometheus metrics listen address, empty to disable")
+	fs.StringVar(&c.Listen.Admin, "admin-port", c.Listen.Admin, "admin API listen address, empty to disable")
+	fs.StringVar(&c.Listen.HTTPS, "https-port", c.Listen.HTTPS, "HTTPS listen address, empty to disable")
+	fs.DurationVar(&c.Timeouts.Read, "read-timeout", c.Timeouts.Read, "maximum duration for reading a visitor request")
+	fs.DurationVar(&c.Timeouts.Write, "write-timeout", c.Timeouts.Write, "maximum duration for writing a response, streaming responses are exempt")
+	fs.DurationVar(&c.Timeouts.Idle, "idle-timeout", c.Timeouts.Idle, "maximum duration of an idle keep-alive connection")
+	fs.DurationVar(&c.Timeouts.Shutdown, "shutdown-timeout", c.Timeouts.Shutdown, "grace period of the shutdown")
+	fs.StringVar(&c.Tracing.OTLPEndpoint, "otlp-endpoint", c.Tracing.OTLPEndpoint, "OTLP/HTTP traces endpoint URL (e.g. http://localhost:4318), empty to disable")
+	fs.StringVar(&c.Logging.Format, "log-format", c.Logging.Format, "log output format: text or json")
+	fs.StringVar(&c.Logging.Level, "log-level", c.Logging.Level, "minimum log level: debug, info, warn or error")
+	fs.StringVar(&c.AccessLog.File, "access-log", c.AccessLog.File, "access log file, - for stdout, empty to disable")
+	fs.StringVar(&c.AccessLog.Format, "access-log-format", c.AccessLog.Format, "access log format: common, combined or json")
+	fs.StringVar(&c.AccessLog.Dir, "access-log-dir", c.AccessLog.Dir, "directory for additional per-domain access log files")
+	fs.Float64Var(&c.AccessLog.Sample, "access-log-sample", c.AccessLog.Sample, "fraction of successful requests written to the access log")
+	fs.StringVar(&c.Auth.AdminToken, "admin-token", c.Auth.AdminToken, "bearer token required by the admin API ($WARP_ADMIN_TOKEN)")
+	fs.Var((*stringList)(&c.Auth.APIKeys), "api-keys", "comma separated API keys tunnel clients must register with, any key when empty ($WARP_API_KEYS)")
+	fs.BoolVar(&c.Auth.RequireAPIKey, "require-api-key", c.Auth.RequireAPIKey, "only accept the configured API keys and the keys issued through the admin API")
+	fs.IntVar(&c.Limits.MaxDomainsPerClient, "max-domains-per-client", c.Limits.MaxDomainsPerClient, "maximum number of domains and tcp and udp ports opened by a client, 0 for no limit")
+	fs.Float64Var(&c.Limits.RateLimit, "rate-limit", c.Limits.RateLimit, "requests per second accepted per domain, 0 for no limit")
+	fs.IntVar(&c.Limits.RateBurst, "rate-burst", c.Limits.RateBurst, "requests accepted at once above the rate limit")
+	fs.IntVar(&c.Inspector.Capacity, "inspect-capacity", c.Inspector.Capacity, "number of requests kept by the traffic inspector")
+	fs.IntVar(&c.Inspector.BodyLimit, "inspect-body-limit", c.Inspector.BodyLimit, "maximum body bytes captured per request and response")
+	fs.BoolVar(&c.TLS.ACME, "acme", c.TLS.ACME, "obtain certificates for registered domains via ACME")
+	fs.StringVar(&c.TLS.ACMEDirectory, "acme-directory", c.TLS.ACMEDirectory, "ACME directory URL")
+	fs.StringVar(&c.TLS.ACMEEmail, "acme-email", c.TLS.ACMEEmail, "ACME account contact email")
+	fs.StringVar(&c.TLS.ACMECache, "acme-cache", c.TLS.ACMECache, "directory where ACME account keys and certificates are stored")
+	fs.StringVar(&c.TLS.ACMECARoot, "acme-ca-root", c.TLS.ACMECARoot, "PEM file of an extra CA trusted when talking to the ACME directory (e.g. Pebble)")
+	fs.Var((*stringList)(&c.TLS.ACMEChallenges), "acme-challenges", "comma separated ACME challenge types to answer")
+	fs.StringVar(&c.TLS.CertStoreDir, "cert-store-dir", c.TLS.CertStoreDir, "directory of the encrypted uploaded certificates, empty to disable uploads")
+	fs.StringVar(&c.TLS.CertStoreKey, "cert-store-key", c.TLS.CertStoreKey, "hex encoded 32 bytes key encrypting the uploaded certificates ($WARP_CERT_STORE_KEY)")
+	fs.StringVar(&c.Domains.Base, "base-domain", c.Domains.Base, "base domain of the subdomains assigned to clients registering without a domain")
+	fs.BoolVar(&c.Domains.ReserveSubdomains, "reserve-subdomains", c.Domains.ReserveSubdomains, "keep the first assigned subdomain reserved for the client API key")
+	fs.BoolVar(&c.Domains.Verify, "verify-domains", c.Domains.Verify, "require a DNS TXT challenge before a client claims a custom domain")
+	fs.StringVar(&c.Domains.VerificationSecret, "verification-secret", c.Domains.VerificationSecret, "secret deriving the DNS challenge tokens ($WARP_VERIFICATION_SECRET)")
+	fs.StringVar(&c.Domains.DNSResolver, "dns-resolver", c.Domains.DNSResolver, "DNS server (host:port) used to check challenges, the system resolver when empty")
+	fs.Var((*stringList)(&c.Domains.Allowed), "allowed-domains", "comma separated patterns (e.g. *.example.com) of the domains clients can claim, any when empty")
+	fs.Var((*stringList)(&c.Domains.Denied), "denied-domains", "comma separated patterns of the domains no client can claim")
+	fs.StringVar(&c.Tunnels.TCPPorts, "tcp-ports", c.Tunnels.TCPPorts, "range of public ports of TCP tunnels (e.g. 20000-20100), empty to disable")
+	fs.StringVar(&c.Tunnels.TCPHost, "tcp-host", c.Tunnels.TCPHost, "address the TCP tunnel ports listen on, empty for all interfaces")
+	fs.StringVar(&c.Tunnels.UDPPorts, "udp-ports", c.Tunnels.UDPPorts, "range of public ports of UDP tunnels (e.g. 21000-21100), empty to disable")
+	fs.StringVar(&c.Tunnels.UDPHost, "udp-host", c.Tunnels.UDPHost, "address the UDP tunnel ports listen on, empty for all interfaces")
+	fs.DurationVar(&c.Tunnels.UDPIdleTimeout, "udp-idle-timeout", c.Tunnels.UDPIdleTimeout, "how long a UDP session lives without datagrams")
+	fs.StringVar(&c.Cluster.NodeID, "node-id", c.Cluster.NodeID, "name of this node in the route registry, the host name when empty")
+	fs.StringVar(&c.Cluster.Registry, "registry", c.Cluster.Registry, "route registry shared by the nodes: memory or redis://[:password@]host:port[/db] ($WARP_CLUSTER_REGISTRY)")
+	fs.DurationVar(&c.Cluster.LeaseTTL, "lease-ttl", c.Cluster.LeaseTTL, "how long the routes of a node stay claimed after it stops renewing them")
+	fs.StringVar(&c.Cluster.Listen, "cluster-port", c.Cluster.Listen, "listen address of the requests forwarded by the other nodes, empty to disable forwarding")
+	fs.StringVar(&c.Cluster.AdvertiseURL, "cluster-advertise-url", c.Cluster.AdvertiseURL, "URL the other nodes reach the cluster port at (e.g. http://10.0.0.2:8002)")
+	fs.StringVar(&c.Cluster.PeerSecret, "cluster-secret", c.Cluster.PeerSecret, "secret shared by the nodes to authenticate forwarded requests ($WARP_CLUSTER_PEER_SECRET)")
+	fs.StringVar(&c.SSO.Issuer, "sso-issuer", c.SSO.Issuer, "OpenID Connect provider URL visitors sign in with, empty to disable single sign-on")
+	fs.StringVar(&c.SSO.ClientID, "sso-client-id", c.SSO.ClientID, "client id of the server at the OpenID Connect provider")
+	fs.StringVar(&c.SSO.ClientSecret, "sso-client-secret", c.SSO.ClientSecret, "client secret of the server at the OpenID Connect provider ($WARP_SSO_CLIENT_SECRET)")
+	fs.StringVar(&c.SSO.LoginURL, "sso-login-url", c.SSO.LoginURL, "base URL of this server the provider redirects to (e.g. https://login.tunnel.example.com)")
+	fs.StringVar(&c.SSO.Secret, "sso-secret", c.SSO.Secret, "secret of at least 32 characters signing the visitor sessions ($WARP_SSO_SECRET)")
+	fs.DurationVar(&c.SSO.SessionTTL, "sso-session-ttl", c.SSO.SessionTTL, "how long visitors stay signed in")
+	fs.Var((*stringList)(&c.SSO.Scopes), "sso-scopes", "comma separated scopes requested at the OpenID Connect provider")
+	fs.StringVar(&c.Store.Path, "store", c.Store.Path, "file keeping the reservations, API keys, verified domains and domain settings across restarts, empty to keep them in memory")
+}
+
+// Source is a struct to remember where a configuration comes from so that it can be read again
+type Source struct {
+	// Path is the YAML configuration file, empty when there is none
+	Path      string
+	lookupEnv func(string) (string, bool)
+	// flags holds the flags set on the command line
+	flags map[string]string
+}
+
+// Load is a function to build the configuration from, by increasing precedence, the defaults,
+// the YAML file given by -config or $WARP_CONFIG, the WARP_* environment variables and the
+// flags set on the command line
+func Load(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) (*Config, *Source, error) {
+	cfg := Default()
+	cfg.RegisterFlags(fs)
+	path, _ := lookupEnv("WARP_CONFIG")
+	fs.StringVar(&path, "config", path, "YAML configuration file ($WARP_CONFIG)")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	source := &Source{Path: path, lookupEnv: lookupEnv, flags: map[string]string{}}
+	fs.Visit(func(f *flag.Flag) {
+		source.flags[f.Name] = f.Value.String()
+	})
+	loaded, err := source.Load()
+	return loaded, source, err
+}
+
+// Load is a method to read the configuration again, the file and the environment may have changed
+func (s *Source) Load() (*Config, error) {
+	cfg := Default()
+	if s.Path != "" {
+		if err := cfg.readFile(s.Path); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyEnv(&cfg, s.lookupEnv); err != nil {
+		return nil, err
+	}
+	// the command line flags are set on top of the file and the environment
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+	for name, value := range s.flags {
+		if fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, err
+		}
+	}
+	return &cfg, nil
+}
+
+// readFile decodes a YAML file into the configuration, unknown keys are errors
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	// an empty file keeps the defaults
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate is a method to check the whole configuration, reporting every problem found
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	check(validPort("listen.http", c.Listen.HTTP, true))
+	check(validPort("listen.https", c.Listen.HTTPS, false))
+	check(validPort("listen.metrics", c.Listen.Metrics, false))
+	check(validPort("listen.admin", c.Listen.Admin, false))
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"timeouts.read", c.Timeouts.Read},
+		{"timeouts.write", c.Timeouts.Write},
+		{"timeouts.idle", c.Timeouts.Idle},
+		{"timeouts.shutdown", c.Timeouts.Shutdown},
+	} {
+		if timeout.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s: must be positive, got %s", timeout.name, timeout.value))
+		}
+	}
+	if c.Logging.Format != "text" && c.Logging.Format != "json" {
+		errs = append(errs, fmt.Errorf("logging.format: expected text or json, got %q", c.Logging.Format))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Logging.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("logging.level: %v", err))
+	}
+	if _, err := accesslog.ParseFormat(c.AccessLog.Format); err != nil {
+		errs = append(errs, fmt.Errorf("accessLog.format: %v", err))
+	}
+	if c.AccessLog.Sample < 0 || c.AccessLog.Sample > 1 {
+		errs = append(errs, fmt.Errorf("accessLog.sample: expected a value between 0 and 1, got %v", c.AccessLog.Sample))
+	}
+	if c.Listen.Admin != "" && c.Auth.AdminToken == "" {
+		errs = append(errs, fmt.Errorf("auth.adminToken: required to serve the admin API"))
+	}
+	if c.Inspector.Capacity <= 0 || c.Inspector.BodyLimit < 0 {
+		errs = append(errs, fmt.Errorf("inspector: invalid capacity %d or body limit %d", c.Inspector.Capacity, c.Inspector.BodyLimit))
+	}
+	for _, challenge := range c.TLS.ACMEChallenges {
+		if challenge != server.ChallengeHTTP01 && challenge != server.ChallengeTLSALPN01 {
+			errs = append(errs, fmt.Errorf("tls.acmeChallenges: unknown ACME challenge %q", challenge))
+		}
+	}
+	if c.TLS.CertStoreDir != "" {
+		if key, err := hex.DecodeString(c.TLS.CertStoreKey); err != nil || len(key) != 32 {
+			errs = append(errs, fmt.Errorf("tls.certStoreKey: expected 32 hex encoded bytes"))
+		}
+	}
+	if c.Domains.Verify && c.Domains.VerificationSecret == "" {
+		errs = append(errs, fmt.Errorf("domains.verificationSecret: required to verify domains"))
+	}
+	if strings.HasPrefix(c.Domains.Base, ".") {
+		errs = append(errs, fmt.Errorf("domains.base: must not start with a dot"))
+	}
+	if err := c.Policy().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("policy: %w", err))
+	}
+	if c.Tunnels.TCPPorts != "" {
+		if _, err := server.ParsePortRange(c.Tunnels.TCPHost, c.Tunnels.TCPPorts); err != nil {
+			errs = append(errs, fmt.Errorf("tunnels.tcpPorts: %v", err))
+		}
+	}
+	if c.Tunnels.UDPPorts != "" {
+		if _, err := server.ParsePortRange(c.Tunnels.UDPHost, c.Tunnels.UDPPorts); err != nil {
+			errs = append(errs, fmt.Errorf("tunnels.udpPorts: %v", err))
+		}
+	}
+	if c.Tunnels.UDPIdleTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("tunnels.udpIdleTimeout: must be positive, got %s", c.Tunnels.UDPIdleTimeout))
+	}
+	if _, err := server.NewRegistry(c.Cluster.Registry); err != nil {
+		errs = append(errs, fmt.Errorf("cluster.registry: %v", err))
+	}
+	if c.Cluster.LeaseTTL < time.Second {
+		errs = append(errs, fmt.Errorf("cluster.leaseTTL: must be at least 1s, got %s", c.Cluster.LeaseTTL))
+	}
+	if c.SSO.Issuer != "" {
+		if err := c.SSOOptions().Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("sso: %v", err))
+		}
+		if c.SSO.SessionTTL < time.Minute {
+			errs = append(errs, fmt.Errorf("sso.sessionTTL: must be at least 1m, got %s", c.SSO.SessionTTL))
+		}
+	}
+	check(validPort("cluster.listen", c.Cluster.Listen, false))
+	if c.Cluster.Listen != "" {
+		if err := c.Peers().Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("cluster: %v", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Policy is a method to return the server policy described by the configuration
+func (c *Config) Policy() server.Policy {
+	return server.Policy{
+		APIKeys:             c.Auth.APIKeys,
+		RequireAPIKey:       c.Auth.RequireAPIKey,
+		AllowedDomains:      c.Domains.Allowed,
+		DeniedDomains:       c.Domains.Denied,
+		MaxDomainsPerClient: c.Limits.MaxDomainsPerClient,
+		RateLimit:           c.Limits.RateLimit,
+		RateBurst:           c.Limits.RateBurst,
+	}
+}
+
+// Peers is a method to return the settings of the link between the nodes of the cluster
+func (c *Config) Peers() server.PeerOptions {
+	return server.PeerOptions{
+		AdvertiseURL: c.Cluster.AdvertiseURL,
+		Secret:       c.Cluster.PeerSecret,
+	}
+}
+
+// SSOOptions is a method to return the OpenID Connect provider of the single sign-on
+func (c *Config) SSOOptions() server.SSOOptions {
+	return server.SSOOptions{
+		Issuer:       c.SSO.Issuer,
+		ClientID:     c.SSO.ClientID,
+		ClientSecret: c.SSO.ClientSecret,
+		LoginURL:     c.SSO.LoginURL,
+		Secret:       c.SSO.Secret,
+		SessionTTL:   c.SSO.SessionTTL,
+		Scopes:       c.SSO.Scopes,
+	}
+}
+
+// validPort checks a listener port
+func validPort(name, port string, required bool) error {
+	if port == "" {
+		if required {
+			return fmt.Errorf("%s: required", name)
+		}
+		return nil
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("%s: invalid port %q", name, port)
+	}
+	return nil
+}
+
+// stringList is a comma separated list flag
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = splitList(value)
+	return nil
+}
+
+// splitList splits a comma separated list, ignoring empty items
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
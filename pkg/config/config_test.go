@@ -0,0 +1,177 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// env is a lookup function over a fixed environment
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+}
+
+// writeConfig writes a configuration file into a temporary directory
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "warp.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newFlagSet returns a flag set that reports errors instead of exiting
+func newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("warp", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+listen:
+  http: "8080"
+  metrics: ""
+timeouts:
+  write: 5s
+logging:
+  level: debug
+auth:
+  apiKeys: [from-file]
+domains:
+  denied: ["*.internal"]
+`)
+	cfg, _, err := Load(newFlagSet(), []string{"-config", path, "-log-level", "warn"}, env(map[string]string{
+		"WARP_TIMEOUTS_WRITE": "10s",
+		"WARP_API_KEYS":       "one, two",
+		"WARP_LOGGING_LEVEL":  "error",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen.HTTP != "8080" || cfg.Listen.Metrics != "" {
+		t.Errorf("expected the file to override the defaults, got %+v", cfg.Listen)
+	}
+	if cfg.Timeouts.Write != 10*time.Second || cfg.Timeouts.Read != 60*time.Second {
+		t.Errorf("expected the environment to override the file, got %+v", cfg.Timeouts)
+	}
+	if !reflect.DeepEqual(cfg.Auth.APIKeys, []string{"one", "two"}) {
+		t.Errorf("expected the api keys of the environment, got %v", cfg.Auth.APIKeys)
+	}
+	if cfg.Logging.Level != "warn" {
+		t.Errorf("expected the flags to override the environment, got %s", cfg.Logging.Level)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("expected a valid configuration, got %v", err)
+	}
+}
+
+func TestLoadConfigFromEnvironment(t *testing.T) {
+	path := writeConfig(t, "limits:\n  rateLimit: 2.5\n")
+	cfg, source, err := Load(newFlagSet(), nil, env(map[string]string{"WARP_CONFIG": path}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.Path != path || cfg.Limits.RateLimit != 2.5 {
+		t.Errorf("expected $WARP_CONFIG to be read, got %s and %v", source.Path, cfg.Limits.RateLimit)
+	}
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	path := writeConfig(t, "listen:\n  htp: \"8080\"\n")
+	if _, _, err := Load(newFlagSet(), []string{"-config", path}, env(nil)); err == nil || !strings.Contains(err.Error(), "htp") {
+		t.Errorf("expected the unknown key to be reported, got %v", err)
+	}
+}
+
+func TestValidateReportsEveryError(t *testing.T) {
+	cfg := Default()
+	cfg.Listen.HTTP = ""
+	cfg.Listen.Admin = "9091"
+	cfg.Timeouts.Idle = 0
+	cfg.Logging.Format = "xml"
+	cfg.TLS.ACMEChallenges = []string{"dns-01"}
+	cfg.Domains.Verify = true
+	cfg.Domains.Denied = []string{"[bad"}
+	cfg.Tunnels.TCPPorts = "20-10"
+	cfg.Cluster.Registry = "etcd://localhost"
+	cfg.SSO.Issuer = "https://accounts.example.com"
+	cfg.SSO.Secret = "short"
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected the configuration to be invalid")
+	}
+	for _, expected := range []string{
+		"listen.http",
+		"timeouts.idle",
+		"logging.format",
+		"auth.adminToken",
+		"tls.acmeChallenges",
+		"domains.verificationSecret",
+		"invalid domain pattern",
+		"tunnels.tcpPorts",
+		"cluster.registry",
+		"sso:",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q to be reported in %v", expected, err)
+		}
+	}
+}
+
+func TestInvalidEnvironmentValue(t *testing.T) {
+	_, _, err := Load(newFlagSet(), nil, env(map[string]string{"WARP_TIMEOUTS_READ": "soon"}))
+	if err == nil || !strings.Contains(err.Error(), "WARP_TIMEOUTS_READ") {
+		t.Errorf("expected the invalid variable to be reported, got %v", err)
+	}
+}
+
+func TestSourceReload(t *testing.T) {
+	path := writeConfig(t, "limits:\n  rateLimit: 1\nauth:\n  apiKeys: [old]\n")
+	cfg, source, err := Load(newFlagSet(), []string{"-config", path, "-log-level", "warn"}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("limits:\n  rateLimit: 5\nauth:\n  apiKeys: [new]\nlisten:\n  http: \"8080\"\nlogging:\n  level: debug\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	next, err := source.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Logging.Level != "warn" {
+		t.Errorf("expected the flags to keep precedence over the file, got %s", next.Logging.Level)
+	}
+
+	changes := map[string]Change{}
+	for _, change := range Diff(cfg, next) {
+		changes[change.Key] = change
+	}
+	if len(changes) != 3 {
+		t.Errorf("expected three changes, got %v", changes)
+	}
+	if change := changes["limits.rateLimit"]; !change.Reloadable || change.String() != "limits.rateLimit: 1 -> 5" {
+		t.Errorf("expected the rate limit to be reloadable, got %+v", change)
+	}
+	if change := changes["listen.http"]; change.Reloadable {
+		t.Errorf("expected the listen address to require a restart, got %+v", change)
+	}
+	if change := changes["auth.apiKeys"]; strings.Contains(change.String(), "new") {
+		t.Errorf("expected the api keys to be masked, got %s", change.String())
+	}
+
+	cfg.ApplyReloadable(next)
+	if cfg.Limits.RateLimit != 5 || cfg.Auth.APIKeys[0] != "new" || cfg.Listen.HTTP == "8080" {
+		t.Errorf("expected only the reloadable keys to be applied, got %+v %+v %+v", cfg.Limits, cfg.Auth, cfg.Listen)
+	}
+}
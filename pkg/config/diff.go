@@ -0,0 +1,77 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Change is a struct to describe a configuration key whose value changed
+type Change struct {
+	Key string
+	Old string
+	New string
+	// Reloadable tells whether the change applies without restarting the server
+	Reloadable bool
+	secret     bool
+}
+
+// String is a method to describe the change, the values of secrets are left out
+func (c Change) String() string {
+	if c.secret {
+		return c.Key + " changed"
+	}
+	return fmt.Sprintf("%s: %s -> %s", c.Key, c.Old, c.New)
+}
+
+// Diff is a function to return the keys whose value differs between two configurations
+func Diff(old, next *Config) []Change {
+	changes := []Change{}
+	oldSections, nextSections := reflect.ValueOf(old).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < oldSections.NumField(); i++ {
+		sectionName := oldSections.Type().Field(i).Tag.Get("yaml")
+		oldSection, nextSection := oldSections.Field(i), nextSections.Field(i)
+		for j := 0; j < oldSection.NumField(); j++ {
+			field := oldSection.Type().Field(j)
+			oldValue, nextValue := oldSection.Field(j).Interface(), nextSection.Field(j).Interface()
+			if reflect.DeepEqual(oldValue, nextValue) || (isEmptyList(oldValue) && isEmptyList(nextValue)) {
+				continue
+			}
+			changes = append(changes, Change{
+				Key:        sectionName + "." + field.Tag.Get("yaml"),
+				Old:        format(oldValue),
+				New:        format(nextValue),
+				Reloadable: field.Tag.Get("reload") == "true",
+				secret:     field.Tag.Get("secret") == "true",
+			})
+		}
+	}
+	return changes
+}
+
+// ApplyReloadable is a method to copy the keys that can change while the server runs from next
+func (c *Config) ApplyReloadable(next *Config) {
+	sections, nextSections := reflect.ValueOf(c).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		for j := 0; j < section.NumField(); j++ {
+			if section.Type().Field(j).Tag.Get("reload") == "true" {
+				section.Field(j).Set(nextSections.Field(i).Field(j))
+			}
+		}
+	}
+}
+
+// isEmptyList returns whether a value is a nil or empty list, both mean no items
+func isEmptyList(value any) bool {
+	list, ok := value.([]string)
+	return ok && len(list) == 0
+}
+
+// format prints a configuration value
+func format(value any) string {
+	if list, ok := value.([]string); ok {
+		return "[" + strings.Join(list, ",") + "]"
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// AccessPolicy is a struct to describe who may reach a tunneled domain, it is enforced by the
+// server before requests are forwarded into the tunnel. Denied addresses get 403 Forbidden and
+// missing or wrong credentials 401 Unauthorized.
+type AccessPolicy struct {
+	// AllowCIDRs are the visitor networks accepted, any network when empty
+	AllowCIDRs []string `json:"allowCidrs,omitempty"`
+	// DenyCIDRs are the visitor networks refused, they win over AllowCIDRs
+	DenyCIDRs []string `json:"denyCidrs,omitempty"`
+	// BasicAuth maps the user names accepted through HTTP basic auth to their passwords
+	BasicAuth map[string]string `json:"basicAuth,omitempty"`
+	// BearerTokens are the tokens accepted in an Authorization: Bearer header
+	BearerTokens []string `json:"bearerTokens,omitempty"`
+	// SSO requires visitors to sign in with the OpenID Connect provider of the server
+	SSO *SSOPolicy `json:"sso,omitempty"`
+}
+
+// IsZero is a method to return whether the policy lets every visitor in
+func (p AccessPolicy) IsZero() bool {
+	return len(p.AllowCIDRs) == 0 && len(p.DenyCIDRs) == 0 && len(p.BasicAuth) == 0 && len(p.BearerTokens) == 0 && p.SSO == nil
+}
+
+// Validate is a method to check the networks and the credentials of the policy
+func (p AccessPolicy) Validate() error {
+	_, err := p.compile()
+	return err
+}
+
+// accessRules is a compiled AccessPolicy
+type accessRules struct {
+	allow  []netip.Prefix
+	deny   []netip.Prefix
+	users  map[string]string
+	tokens []string
+	sso    *SSOPolicy
+}
+
+// compile parses the networks of the policy
+func (p AccessPolicy) compile() (*accessRules, error) {
+	rules := &accessRules{users: p.BasicAuth, tokens: p.BearerTokens, sso: p.SSO}
+	var err error
+	if rules.allow, err = parsePrefixes(p.AllowCIDRs); err != nil {
+		return nil, err
+	}
+	if rules.deny, err = parsePrefixes(p.DenyCIDRs); err != nil {
+		return nil, err
+	}
+	for user := range p.BasicAuth {
+		if user == "" || strings.Contains(user, ":") {
+			return nil, fmt.Errorf("invalid basic auth user %q", user)
+		}
+	}
+	for _, token := range p.BearerTokens {
+		if token == "" {
+			return nil, fmt.Errorf("bearer tokens must not be empty")
+		}
+	}
+	if p.SSO != nil {
+		// every account of the provider could sign in otherwise
+		if len(p.SSO.Emails) == 0 && len(p.SSO.Groups) == 0 {
+			return nil, fmt.Errorf("single sign-on needs allowed emails or groups")
+		}
+		// both would ask for the Authorization header of the visitor
+		if len(p.BasicAuth) > 0 || len(p.BearerTokens) > 0 {
+			return nil, fmt.Errorf("single sign-on cannot be combined with basic auth or bearer tokens")
+		}
+	}
+	return rules, nil
+}
+
+// parsePrefixes parses CIDRs, a single address is a network of its own
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", cidr)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// enforce checks a visitor request against the rules, writing the 401 or 403 response and
+// returning false when it is refused. The credentials are meant for the server, so the
+// Authorization header is removed before the request reaches the tunnel.
+func (a *accessRules) enforce(w http.ResponseWriter, r *http.Request, realm string) bool {
+	if len(a.allow) > 0 || len(a.deny) > 0 {
+		// r.RemoteAddr is the visitor, the peer link restores it on forwarded requests
+		addr, ok := remoteAddr(r.RemoteAddr)
+		if !ok || containsAddr(a.deny, addr) || (len(a.allow) > 0 && !containsAddr(a.allow, addr)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return false
+		}
+	}
+	if len(a.users) == 0 && len(a.tokens) == 0 {
+		return true
+	}
+	if a.authenticated(r) {
+		r.Header.Del("Authorization")
+		return true
+	}
+	if len(a.users) > 0 {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm))
+	}
+	if len(a.tokens) > 0 {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", realm))
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// authenticated returns whether the request carries accepted basic auth credentials or bearer token
+func (a *accessRules) authenticated(r *http.Request) bool {
+	if user, password, ok := r.BasicAuth(); ok {
+		expected, known := a.users[user]
+		return known && subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	accepted := false
+	// every token is compared so the time taken does not tell which one matched
+	for _, expected := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+			accepted = true
+		}
+	}
+	return accepted
+}
+
+// remoteAddr returns the address of a request remote address
+func remoteAddr(hostport string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	// IPv4 visitors of dual stack listeners show up as ::ffff:a.b.c.d
+	return addr.Unmap(), true
+}
+
+// containsAddr returns whether one of the networks contains addr
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAccess compiles an access policy of a registration or of the domain settings
+func (s *Server) checkAccess(policy *AccessPolicy) (*accessRules, error) {
+	if policy == nil || policy.IsZero() {
+		return nil, nil
+	}
+	if policy.SSO != nil && s.sso == nil {
+		return nil, fmt.Errorf("single sign-on is not configured on this server")
+	}
+	return policy.compile()
+}
+
+// setAccess records the access policy a client declared for a route
+func (c *ServerConnState) setAccess(route string, rules *accessRules) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.access == nil {
+		c.access = map[string]*accessRules{}
+	}
+	if rules == nil {
+		delete(c.access, route)
+		return
+	}
+	c.access[route] = rules
+}
+
+// accessOf returns the access policy a client declared for a route, nil when there is none
+func (c *ServerConnState) accessOf(route string) *accessRules {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.access[route]
+}
+
+// setDomainAccess records the access policy admins set for a domain, nil removes it
+func (s *Server) setDomainAccess(domain string, policy *AccessPolicy) error {
+	if policy == nil || policy.IsZero() {
+		s.domainAccess.Delete(domain)
+		return nil
+	}
+	rules, err := policy.compile()
+	if err != nil {
+		return err
+	}
+	s.domainAccess.Store(domain, rules)
+	return nil
+}
+
+// loadDomainAccess reads the access policies of the stored domain settings
+func (s *Server) loadDomainAccess() {
+	all, err := s.AllDomainSettings()
+	if err != nil {
+		s.opts.logger.Warn("could not load the access policies of the domain settings", "error", err)
+		return
+	}
+	for domain, settings := range all {
+		if err := s.setDomainAccess(domain, settings.Access); err != nil {
+			// a policy that cannot be enforced keeps every visitor out rather than none
+			s.opts.logger.Error("invalid access policy in the domain settings, refusing every visitor", slog.String(LogKeyDomain, domain), "error", err)
+			s.domainAccess.Store(domain, &accessRules{deny: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}})
+		}
+	}
+}
+
+// accessRulesOf returns the access policy of a request route, the one admins set for the domain
+// replaces the one the client declared
+func (s *Server) accessRulesOf(conn *ServerConnState, route Route) *accessRules {
+	if rules, ok := s.domainAccess.Load(strings.ToLower(route.Domain)); ok {
+		return rules.(*accessRules)
+	}
+	return conn.accessOf(route.String())
+}
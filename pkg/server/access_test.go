@@ -0,0 +1,147 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// accessRequest sends a visitor request with an optional Authorization header
+func accessRequest(t *testing.T, srv *httptest.Server, domain string, setAuth func(*http.Request)) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/admin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = domain
+	if setAuth != nil {
+		setAuth(req)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestAccessPolicyCredentials(t *testing.T) {
+	srv := httptest.NewServer(New().Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	frame := registerFrame(client, RegisterMessage{Domain: "app.example.com", Access: &AccessPolicy{
+		BasicAuth:    map[string]string{"dev": "s3cret"},
+		BearerTokens: []string{"token-1"},
+	}})
+	if frame.Type != "registered" {
+		t.Fatalf("expected the registration to succeed, got %+v", frame)
+	}
+	invalid := registerFrame(client, RegisterMessage{Domain: "other.example.com", Access: &AccessPolicy{AllowCIDRs: []string{"10.0.0.0/33"}}})
+	if invalid.Type != "error" {
+		t.Errorf("expected an invalid network to be rejected, got %q", invalid.Type)
+	}
+	seen := make(chan testFrame, 4)
+	client.serve(func(req testFrame, body []byte) testResponse {
+		seen <- req
+		return testResponse{status: http.StatusOK}
+	})
+
+	resp := accessRequest(t, srv, "app.example.com", nil)
+	if resp.StatusCode != http.StatusUnauthorized || len(resp.Header.Values("WWW-Authenticate")) != 2 {
+		t.Errorf("expected a basic and a bearer challenge, got %d %v", resp.StatusCode, resp.Header)
+	}
+	for name, setAuth := range map[string]func(*http.Request){
+		"wrong password": func(r *http.Request) { r.SetBasicAuth("dev", "wrong") },
+		"unknown user":   func(r *http.Request) { r.SetBasicAuth("ops", "s3cret") },
+		"wrong token":    func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-2") },
+	} {
+		if resp := accessRequest(t, srv, "app.example.com", setAuth); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: got status %v want %v", name, resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+	for name, setAuth := range map[string]func(*http.Request){
+		"basic auth": func(r *http.Request) { r.SetBasicAuth("dev", "s3cret") },
+		"bearer":     func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-1") },
+	} {
+		if resp := accessRequest(t, srv, "app.example.com", setAuth); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: got status %v want %v", name, resp.StatusCode, http.StatusOK)
+			continue
+		}
+		if req := <-seen; req.Headers["Authorization"] != "" {
+			t.Errorf("%s: expected the credentials to stay at the edge, got %v", name, req.Headers)
+		}
+	}
+}
+
+func TestAccessPolicyNetworks(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy AccessPolicy
+		status int
+	}{
+		{"allowed", AccessPolicy{AllowCIDRs: []string{"127.0.0.0/8"}}, http.StatusOK},
+		{"single address", AccessPolicy{AllowCIDRs: []string{"127.0.0.1"}}, http.StatusOK},
+		{"not allowed", AccessPolicy{AllowCIDRs: []string{"10.0.0.0/8", "::1/128"}}, http.StatusForbidden},
+		{"denied", AccessPolicy{DenyCIDRs: []string{"127.0.0.1/32"}}, http.StatusForbidden},
+		{"deny wins", AccessPolicy{AllowCIDRs: []string{"0.0.0.0/0"}, DenyCIDRs: []string{"127.0.0.0/8"}}, http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(New().Routes())
+			t.Cleanup(srv.Close)
+			client := dialTestClient(t, srv)
+			policy := tc.policy
+			if frame := registerFrame(client, RegisterMessage{Domain: "app.example.com", Access: &policy}); frame.Type != "registered" {
+				t.Fatalf("expected the registration to succeed, got %+v", frame)
+			}
+			client.serve(func(req testFrame, body []byte) testResponse {
+				return testResponse{status: http.StatusOK}
+			})
+			if resp := accessRequest(t, srv, "app.example.com", nil); resp.StatusCode != tc.status {
+				t.Errorf("got status %v want %v", resp.StatusCode, tc.status)
+			}
+		})
+	}
+}
+
+func TestDomainSettingsAccessReplacesClientPolicy(t *testing.T) {
+	s := New()
+	srv := newTunnel(t, s, "app.example.com", func(req testFrame, body []byte) testResponse {
+		return testResponse{status: http.StatusOK}
+	})
+	admin := s.AdminRoutes("secret")
+
+	if resp := accessRequest(t, srv, "app.example.com", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v want %v", resp.StatusCode, http.StatusOK)
+	}
+	if rr := adminJSONRequest(t, admin, "PUT", "/settings/app.example.com", `{"access":{"denyCidrs":["nope"]}}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid access policy: got status %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if rr := adminJSONRequest(t, admin, "PUT", "/settings/App.Example.com", `{"access":{"bearerTokens":["admin-token"]}}`); rr.Code != http.StatusOK {
+		t.Fatalf("got status %v want %v", rr.Code, http.StatusOK)
+	}
+	if resp := accessRequest(t, srv, "app.example.com", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the admin policy to apply right away, got %v", resp.StatusCode)
+	}
+	bearer := func(r *http.Request) { r.Header.Set("Authorization", "Bearer admin-token") }
+	if resp := accessRequest(t, srv, "app.example.com", bearer); resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %v want %v", resp.StatusCode, http.StatusOK)
+	}
+
+	if rr := adminJSONRequest(t, admin, "DELETE", "/settings/app.example.com", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("got status %v want %v", rr.Code, http.StatusNoContent)
+	}
+	if resp := accessRequest(t, srv, "app.example.com", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the domain to be open again, got %v", resp.StatusCode)
+	}
+
+	// the settings kept in the store apply after a restart
+	state := NewMemoryStateStore()
+	putJSON(state, BucketDomainSettings, "app.example.com", DomainSettings{Access: &AccessPolicy{DenyCIDRs: []string{"127.0.0.1"}}})
+	restarted := New(WithStateStore(state))
+	srv = newTunnel(t, restarted, "app.example.com", func(req testFrame, body []byte) testResponse {
+		return testResponse{status: http.StatusOK}
+	})
+	if resp := accessRequest(t, srv, "app.example.com", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the stored policy to apply, got %v", resp.StatusCode)
+	}
+}
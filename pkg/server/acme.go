@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACME challenge types
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+// ErrCertStoreMiss is returned by a CertStore when a key is not stored
+var ErrCertStoreMiss = autocert.ErrCacheMiss
+
+// CertStore persists the ACME account key and the obtained certificates
+type CertStore interface {
+	// Get returns the data stored under key or ErrCertStoreMiss
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put stores data under key
+	Put(ctx context.Context, key string, data []byte) error
+	// Delete removes key
+	Delete(ctx context.Context, key string) error
+}
+
+// DirCertStore returns a CertStore keeping its data in a local directory
+func DirCertStore(dir string) CertStore {
+	return autocert.DirCache(dir)
+}
+
+// ACMEOptions is a struct to hold the options of the ACME certificate manager
+type ACMEOptions struct {
+	// DirectoryURL is the ACME directory, Let's Encrypt production when empty
+	DirectoryURL string
+	// Email is the contact of the ACME account
+	Email string
+	// Store persists account keys and certificates
+	Store CertStore
+	// HTTPClient talks to the ACME directory, e.g. trusting a local Pebble CA
+	HTTPClient *http.Client
+	// Challenges are the enabled challenge types, all of them when empty
+	Challenges []string
+}
+
+// WithACME is an option to obtain certificates for registered domains via ACME
+func WithACME(acmeOpts ACMEOptions) ServerOption {
+	return func(o *ServerOpts) {
+		o.acme = &acmeOpts
+	}
+}
+
+// acmeManager obtains and renews certificates for the domains linked to a tunnel
+type acmeManager struct {
+	manager    *autocert.Manager
+	logger     *slog.Logger
+	challenges map[string]bool
+}
+
+// newACMEManager creates the manager, only accepting domains linked to a tunnel client
+func newACMEManager(s *Server, acmeOpts ACMEOptions) *acmeManager {
+	challenges := map[string]bool{}
+	for _, challenge := range acmeOpts.Challenges {
+		challenges[challenge] = true
+	}
+	if len(challenges) == 0 {
+		challenges[ChallengeHTTP01] = true
+		challenges[ChallengeTLSALPN01] = true
+	}
+	directoryURL := acmeOpts.DirectoryURL
+	if directoryURL == "" {
+		directoryURL = autocert.DefaultACMEDirectory
+	}
+	return &acmeManager{
+		logger:     s.opts.logger,
+		challenges: challenges,
+		manager: &autocert.Manager{
+			Prompt: autocert.AcceptTOS,
+			Cache:  acmeOpts.Store,
+			Email:  acmeOpts.Email,
+			HostPolicy: func(ctx context.Context, host string) error {
+				// in a cluster the visitors of a domain linked on another node can land on this one
+				if s.sso != nil && strings.EqualFold(host, s.sso.login.Hostname()) {
+					return nil
+				}
+				if _, linked, _ := s.opts.routeRegistry.Lookup(ctx, host); !linked && !s.hasHost(host) {
+					return fmt.Errorf("acme: domain %q is not registered", host)
+				}
+				return nil
+			},
+			Client: &acme.Client{
+				DirectoryURL: directoryURL,
+				HTTPClient:   acmeOpts.HTTPClient,
+			},
+		},
+	}
+}
+
+// getCertificate returns the certificate of the requested domain, answering tls-alpn-01 challenges
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.manager.GetCertificate(hello)
+}
+
+// nextProtos returns the ALPN protocols the TLS listener must announce
+func (m *acmeManager) nextProtos() []string {
+	if m.challenges[ChallengeTLSALPN01] {
+		return []string{acme.ALPNProto}
+	}
+	return nil
+}
+
+// httpHandler answers http-01 challenges, passing every other request to fallback
+func (m *acmeManager) httpHandler(fallback http.Handler) http.Handler {
+	if !m.challenges[ChallengeHTTP01] {
+		return fallback
+	}
+	return m.manager.HTTPHandler(fallback)
+}
+
+// obtain requests the certificate of a newly registered domain ahead of the first visitor
+func (m *acmeManager) obtain(domain string) {
+	if !acmeEligible(domain) {
+		return
+	}
+	go func() {
+		_, err := m.manager.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:       domain,
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		})
+		if err != nil {
+			m.logger.Error("could not obtain certificate", slog.String(LogKeyDomain, domain), "error", err)
+			return
+		}
+		m.logger.Info("certificate ready", slog.String(LogKeyDomain, domain))
+	}()
+}
+
+// acmeEligible returns whether a public CA could issue a certificate for domain
+func acmeEligible(domain string) bool {
+	if domain == "" || strings.Contains(domain, ":") || net.ParseIP(domain) != nil {
+		return false
+	}
+	return strings.Contains(domain, ".") && !strings.HasSuffix(domain, ".localhost")
+}
+
+// TLSConfig is a method to return the TLS configuration of the HTTPS listener
+func (s *Server) TLSConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: s.getCertificate,
+	}
+	if s.acme != nil {
+		config.NextProtos = append(config.NextProtos, s.acme.nextProtos()...)
+	}
+	return config
+}
+
+// HTTPHandler is a method to wrap the plain HTTP handler so it answers ACME http-01 challenges
+func (s *Server) HTTPHandler(next http.Handler) http.Handler {
+	if s.acme == nil {
+		return next
+	}
+	return s.acme.httpHandler(next)
+}
+
+// getCertificate selects the certificate of a TLS handshake by SNI, preferring uploaded ones
+func (s *Server) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if s.opts.certificates != nil {
+		if cert, ok := s.opts.certificates.Get(hello.ServerName); ok {
+			return cert, nil
+		}
+	}
+	if s.acme != nil {
+		return s.acme.getCertificate(hello)
+	}
+	return nil, fmt.Errorf("no certificate available for %q", hello.ServerName)
+}
+
+// domainLinked is called whenever a domain is linked to a tunnel client
+func (s *Server) domainLinked(domain string) {
+	// a certificate left by a previous holder, e.g. before a restart, is not served for the new one
+	s.recheckCertificate(domain)
+	if s.acme != nil {
+		s.acme.obtain(domain)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestACMEEligible(t *testing.T) {
+	tests := map[string]bool{
+		"app.example.com":   true,
+		"localhost:8001":    false,
+		"127.0.0.1":         false,
+		"localhost":         false,
+		"app.dev.localhost": false,
+		"":                  false,
+	}
+	for domain, expected := range tests {
+		if got := acmeEligible(domain); got != expected {
+			t.Errorf("acmeEligible(%q) = %v want %v", domain, got, expected)
+		}
+	}
+}
+
+func TestACMEHostPolicyOnlyAllowsRegisteredDomains(t *testing.T) {
+	s := New(WithACME(ACMEOptions{}))
+	policy := s.acme.manager.HostPolicy
+	if err := policy(context.Background(), "app.example.com"); err == nil {
+		t.Error("expected unregistered domain to be rejected")
+	}
+	s.hostToClientID.Store("app.example.com", "client")
+	if err := policy(context.Background(), "app.example.com"); err != nil {
+		t.Errorf("expected registered domain to be accepted, got %v", err)
+	}
+}
+
+// TestACMEPebble obtains a certificate from a local Pebble started with PEBBLE_VA_ALWAYS_VALID=1,
+// e.g. PEBBLE_DIRECTORY_URL=https://localhost:14000/dir PEBBLE_CA_ROOT=pebble.minica.pem
+func TestACMEPebble(t *testing.T) {
+	directoryURL := os.Getenv("PEBBLE_DIRECTORY_URL")
+	if directoryURL == "" {
+		t.Skip("PEBBLE_DIRECTORY_URL not set")
+	}
+	roots := x509.NewCertPool()
+	if caRoot := os.Getenv("PEBBLE_CA_ROOT"); caRoot != "" {
+		pem, err := os.ReadFile(caRoot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots.AppendCertsFromPEM(pem)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+
+	s := New(WithACME(ACMEOptions{
+		DirectoryURL: directoryURL,
+		Store:        DirCertStore(t.TempDir()),
+		HTTPClient:   &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}))
+	s.hostToClientID.Store("pebble.example.com", "client")
+	cert, err := s.TLSConfig().GetCertificate(&tls.ClientHelloInfo{ServerName: "pebble.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil || cert.Leaf.VerifyHostname("pebble.example.com") != nil {
+		t.Errorf("unexpected certificate %+v", cert.Leaf)
+	}
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ClientInfo is a struct to describe a connected tunnel client
+type ClientInfo struct {
+	ID          string    `json:"id"`
+	Domains     []string  `json:"domains"`
+	TCPPorts    []int     `json:"tcpPorts,omitempty"`
+	UDPPorts    []int     `json:"udpPorts,omitempty"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	InFlight    int       `json:"inFlight"`
+	Requests    int64     `json:"requests"`
+	Errors      int64     `json:"errors"`
+	BytesIn     int64     `json:"bytesIn"`
+	BytesOut    int64     `json:"bytesOut"`
+}
+
+// ReloadReport is a struct to describe the outcome of a configuration reload
+type ReloadReport struct {
+	// Applied lists the changes in effect
+	Applied []string `json:"applied"`
+	// RequiresRestart lists the changes that are ignored until the server restarts
+	RequiresRestart []string `json:"requiresRestart"`
+}
+
+// WithReloader is an option to reload the configuration through POST /reload on the admin API
+func WithReloader(reload func() (ReloadReport, error)) ServerOption {
+	return func(o *ServerOpts) {
+		o.reload = reload
+	}
+}
+
+// Clients returns the connected tunnel clients sorted by connect time
+func (s *Server) Clients() []ClientInfo {
+	clients := []ClientInfo{}
+	s.serverStates.Range(func(_, value any) bool {
+		clients = append(clients, value.(*ServerConnState).info())
+		return true
+	})
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ConnectedAt.Before(clients[j].ConnectedAt)
+	})
+	return clients
+}
+
+// DomainClients returns the route to client id map, routes with a path prefix look like api.example.com/v2
+func (s *Server) DomainClients() map[string]string {
+	domains := map[string]string{}
+	s.hostToClientID.Range(func(key, value any) bool {
+		domains[key.(string)] = value.(string)
+		return true
+	})
+	return domains
+}
+
+// DisconnectClient closes the tunnel of a client, returning whether it was connected
+func (s *Server) DisconnectClient(clientID string) bool {
+	stateAny, ok := s.serverStates.Load(clientID)
+	if !ok {
+		return false
+	}
+	state := stateAny.(*ServerConnState)
+	state.Logger.Info("disconnecting tunnel client on admin request")
+	state.Ch.Close()
+	return true
+}
+
+// UnlinkDomain stops routing a domain, or a domain and path prefix like api.example.com/v2,
+// to its client, returning whether it was linked
+func (s *Server) UnlinkDomain(domain string) bool {
+	clientID, ok := s.hostToClientID.LoadAndDelete(domain)
+	if !ok {
+		return false
+	}
+	if stateAny, ok := s.serverStates.Load(clientID); ok {
+		state := stateAny.(*ServerConnState)
+		state.removeHost(domain)
+		s.routeReleased(domain)
+		if err := s.opts.routeRegistry.Release(context.Background(), domain, state.owner()); err != nil {
+			state.Logger.Warn("could not release the route", slog.String(LogKeyDomain, domain), "error", err)
+		}
+		state.Logger.Info("domain unlinked on admin request", slog.String(LogKeyDomain, domain))
+	}
+	return true
+}
+
+// info returns the ClientInfo of a connection
+func (c *ServerConnState) info() ClientInfo {
+	return ClientInfo{
+		ID:          c.ClientID,
+		Domains:     c.Domains(),
+		TCPPorts:    c.TCPPorts(),
+		UDPPorts:    c.UDPPorts(),
+		RemoteAddr:  c.RemoteAddr,
+		ConnectedAt: c.ConnectedAt,
+		InFlight:    countMap(&c.OngoingRequests),
+		Requests:    c.requests.Load(),
+		Errors:      c.errors.Load(),
+		BytesIn:     c.bytesIn.Load(),
+		BytesOut:    c.bytesOut.Load(),
+	}
+}
+
+// AdminRoutes is a method to return the admin API ServeMux, every route requires
+// the given token as a bearer token or as the basic auth password
+func (s *Server) AdminRoutes(token string) http.Handler {
+	mux := http.NewServeMux()
+	s.dashboardRoutes(mux)
+	s.inspectorRoutes(mux)
+	s.certificateRoutes(mux)
+	mux.HandleFunc("GET /clients", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Clients())
+	})
+	mux.HandleFunc("GET /clients/{id}", func(w http.ResponseWriter, r *http.Request) {
+		stateAny, ok := s.serverStates.Load(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "client not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, stateAny.(*ServerConnState).info())
+	})
+	mux.HandleFunc("DELETE /clients/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !s.DisconnectClient(r.PathValue("id")) {
+			http.Error(w, "client not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /verifications", func(w http.ResponseWriter, r *http.Request) {
+		if s.opts.verifier == nil {
+			writeJSON(w, http.StatusOK, map[string][]string{})
+			return
+		}
+		writeJSON(w, http.StatusOK, s.opts.verifier.VerifiedDomains())
+	})
+	mux.HandleFunc("DELETE /verifications/{account}/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		if s.opts.verifier != nil {
+			if err := s.opts.verifier.Forget(r.PathValue("account"), r.PathValue("domain")); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /apikeys", func(w http.ResponseWriter, r *http.Request) {
+		keys, err := s.APIKeys()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, keys)
+	})
+	mux.HandleFunc("POST /apikeys", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			http.Error(w, "expected a JSON body with a name", http.StatusBadRequest)
+			return
+		}
+		key, issued, err := s.IssueAPIKey(req.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, struct {
+			APIKey
+			Key string `json:"key"`
+		}{issued, key})
+	})
+	mux.HandleFunc("DELETE /apikeys/{account}", func(w http.ResponseWriter, r *http.Request) {
+		revoked, err := s.RevokeAPIKey(r.PathValue("account"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !revoked {
+			http.Error(w, "api key not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /settings", func(w http.ResponseWriter, r *http.Request) {
+		all, err := s.AllDomainSettings()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, all)
+	})
+	mux.HandleFunc("GET /settings/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		settings, err := s.DomainSettings(r.PathValue("domain"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, settings)
+	})
+	mux.HandleFunc("PUT /settings/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		var settings DomainSettings
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&settings)
+		if err == nil {
+			err = settings.Validate()
+		}
+		if err == nil {
+			_, err = s.checkAccess(settings.Access)
+		}
+		if err != nil {
+			http.Error(w, "invalid settings: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.SetDomainSettings(r.PathValue("domain"), settings); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, settings)
+	})
+	mux.HandleFunc("DELETE /settings/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		deleted, err := s.DeleteDomainSettings(r.PathValue("domain"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, "domain settings not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		if s.opts.reload == nil {
+			http.Error(w, "configuration reload is not enabled", http.StatusNotImplemented)
+			return
+		}
+		report, err := s.opts.reload()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	})
+	mux.HandleFunc("GET /domains", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.DomainClients())
+	})
+	mux.HandleFunc("DELETE /domains/{route...}", func(w http.ResponseWriter, r *http.Request) {
+		if !s.UnlinkDomain(r.PathValue("route")) {
+			http.Error(w, "domain not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return requireToken(token, mux)
+}
+
+// requireToken rejects requests that do not carry the given token, either as a bearer
+// token or as the basic auth password so that browsers can reach the dashboard
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, given, ok = r.BasicAuth()
+		}
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="warp-admin"`)
+			w.Header().Add("WWW-Authenticate", `Basic realm="warp-admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, handler http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	admin := New().AdminRoutes("secret")
+	for _, token := range []string{"", "wrong"} {
+		if rr := adminRequest(t, admin, "GET", "/clients", token); rr.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: got status %v want %v", token, rr.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestAdminClientsAndDomains(t *testing.T) {
+	s := New()
+	srv := newTunnel(t, s, "example.test", func(req testFrame, body []byte) testResponse {
+		return testResponse{status: http.StatusOK}
+	})
+	admin := s.AdminRoutes("secret")
+
+	rr := adminRequest(t, admin, "GET", "/clients", "secret")
+	var clients []ClientInfo
+	if err := json.NewDecoder(rr.Body).Decode(&clients); err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 || len(clients[0].Domains) != 1 || clients[0].Domains[0] != "example.test" {
+		t.Fatalf("unexpected clients %+v", clients)
+	}
+
+	if rr := adminRequest(t, admin, "DELETE", "/domains/example.test", "secret"); rr.Code != http.StatusNoContent {
+		t.Errorf("unlink domain: got status %v want %v", rr.Code, http.StatusNoContent)
+	}
+	if resp := tunnelRequest(t, srv, "example.test", "GET", "/", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("request to unlinked domain: got status %v want %v", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	if rr := adminRequest(t, admin, "DELETE", "/clients/"+clients[0].ID, "secret"); rr.Code != http.StatusNoContent {
+		t.Errorf("disconnect client: got status %v want %v", rr.Code, http.StatusNoContent)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Clients()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rr := adminRequest(t, admin, "GET", "/clients/"+clients[0].ID, "secret"); rr.Code != http.StatusNotFound {
+		t.Errorf("disconnected client: got status %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	s := New()
+	newTunnel(t, s, "example.test", func(req testFrame, body []byte) testResponse {
+		return testResponse{status: http.StatusOK}
+	})
+	admin := httptest.NewServer(s.AdminRoutes("secret"))
+	defer admin.Close()
+
+	req, _ := http.NewRequest("GET", admin.URL+"/dashboard/", nil)
+	req.SetBasicAuth("operator", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("dashboard page: got status %v and content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	req, _ = http.NewRequest("GET", admin.URL+"/dashboard/events", nil)
+	req.SetBasicAuth("operator", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var snapshot DashboardSnapshot
+		if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+			t.Fatal(err)
+		}
+		if len(snapshot.Clients) != 1 || snapshot.Domains["example.test"] != snapshot.Clients[0].ID {
+			t.Errorf("unexpected snapshot %+v", snapshot)
+		}
+		return
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	if rr := adminRequest(t, New().AdminRoutes("secret"), "POST", "/reload", "secret"); rr.Code != http.StatusNotImplemented {
+		t.Errorf("expected reload to be disabled without a reloader, got %v", rr.Code)
+	}
+
+	var reloadErr error
+	admin := New(WithReloader(func() (ReloadReport, error) {
+		if reloadErr != nil {
+			return ReloadReport{}, reloadErr
+		}
+		return ReloadReport{Applied: []string{"limits.rateLimit: 0 -> 5"}, RequiresRestart: []string{"listen.http: 80 -> 8080"}}, nil
+	})).AdminRoutes("secret")
+	rr := adminRequest(t, admin, "POST", "/reload", "secret")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %v want %v", rr.Code, http.StatusOK)
+	}
+	var report ReloadReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Applied) != 1 || len(report.RequiresRestart) != 1 {
+		t.Errorf("expected the report of the reloader, got %+v", report)
+	}
+
+	reloadErr = errors.New("invalid configuration")
+	if rr := adminRequest(t, admin, "POST", "/reload", "secret"); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected a failed reload to be reported, got %v", rr.Code)
+	}
+}
@@ -9,9 +9,15 @@ import (
 
 // parseMessage parses the received message into metadata and binary data
 func parseMessage(data []byte) ([]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, fmt.Errorf("message too short: %d bytes", len(data))
+	}
 
 	// Read metadata length (4 bytes, little-endian)
 	metadataLength := binary.LittleEndian.Uint32(data[:4])
+	if uint64(len(data)-4) < uint64(metadataLength) {
+		return nil, nil, fmt.Errorf("metadata length %d exceeds message size %d", metadataLength, len(data))
+	}
 
 	// Read metadata
 	metadataBytes := data[4 : 4+metadataLength]
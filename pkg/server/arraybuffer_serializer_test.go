@@ -0,0 +1,28 @@
+package server
+
+import "testing"
+
+func TestParseMessage(t *testing.T) {
+	data, err := createMessage(map[string]string{"type": "data"}, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, payload, err := parseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(metadata) != `{"type":"data"}` || string(payload) != "payload" {
+		t.Errorf("unexpected message %q %q", metadata, payload)
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":           nil,
+		"short length":    {1, 0},
+		"long metadata":   {16, 0, 0, 0, '{', '}'},
+		"overflow length": {0xff, 0xff, 0xff, 0xff},
+	} {
+		if _, _, err := parseMessage(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certificateFileExt is the extension of the encrypted certificate files
+const certificateFileExt = ".cert.enc"
+
+// CertificateInfo is a struct to describe an uploaded certificate
+type CertificateInfo struct {
+	Domain   string    `json:"domain"`
+	DNSNames []string  `json:"dnsNames"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"notAfter"`
+}
+
+// storedCertificate is the plaintext of an encrypted certificate file
+type storedCertificate struct {
+	Domain string `json:"domain"`
+	Cert   string `json:"cert"`
+	Key    string `json:"key"`
+	// Uploader is the tunnel client that uploaded the certificate, empty for admin uploads
+	Uploader string `json:"uploader,omitempty"`
+}
+
+// CertificateStore is a struct to hold the certificates uploaded for custom domains, encrypted at rest
+type CertificateStore struct {
+	dir  string
+	aead cipher.AEAD
+
+	mu    sync.RWMutex
+	certs map[string]*tls.Certificate
+	// uploaders maps the domains of the certificates uploaded by tunnel clients to their client id
+	uploaders map[string]string
+}
+
+// NewCertificateStore opens the store kept in dir, encrypting files with the 32 bytes AES key
+func NewCertificateStore(dir string, key []byte) (*CertificateStore, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("certificate store key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	store := &CertificateStore{dir: dir, aead: aead, certs: map[string]*tls.Certificate{}, uploaders: map[string]string{}}
+	return store, store.load()
+}
+
+// Put validates a PEM certificate and key for domain and stores them
+func (c *CertificateStore) Put(domain string, certPEM, keyPEM []byte) (CertificateInfo, error) {
+	return c.put(domain, "", certPEM, keyPEM)
+}
+
+// put stores a certificate uploaded by a tunnel client, or by admins when uploader is empty
+func (c *CertificateStore) put(domain, uploader string, certPEM, keyPEM []byte) (CertificateInfo, error) {
+	domain = strings.ToLower(domain)
+	cert, err := parseKeyPair(certPEM, keyPEM)
+	if err != nil {
+		return CertificateInfo{}, fmt.Errorf("invalid certificate or key: %v", err)
+	}
+	// a wildcard domain must be covered by a wildcard certificate, checked with a sample label
+	if err := cert.Leaf.VerifyHostname(strings.Replace(domain, "*", "sample", 1)); err != nil {
+		return CertificateInfo{}, fmt.Errorf("certificate does not cover %s: %v", domain, err)
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return CertificateInfo{}, fmt.Errorf("certificate expired at %s", cert.Leaf.NotAfter)
+	}
+	plaintext, err := json.Marshal(storedCertificate{Domain: domain, Cert: string(certPEM), Key: string(keyPEM), Uploader: uploader})
+	if err != nil {
+		return CertificateInfo{}, err
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return CertificateInfo{}, err
+	}
+	sealed := c.aead.Seal(nonce, nonce, plaintext, nil)
+	if err := os.WriteFile(c.path(domain), sealed, 0o600); err != nil {
+		return CertificateInfo{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.certs[domain] = &cert
+	if uploader != "" {
+		c.uploaders[domain] = uploader
+	} else {
+		delete(c.uploaders, domain)
+	}
+	return certificateInfo(domain, &cert), nil
+}
+
+// Delete removes the certificate of domain, returning whether it existed
+func (c *CertificateStore) Delete(domain string) (bool, error) {
+	domain = strings.ToLower(domain)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.certs[domain]; !ok {
+		return false, nil
+	}
+	delete(c.certs, domain)
+	delete(c.uploaders, domain)
+	if err := os.Remove(c.path(domain)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return true, err
+	}
+	return true, nil
+}
+
+// uploader returns the tunnel client that uploaded the certificate of domain, empty when there
+// is none or admins uploaded it
+func (c *CertificateStore) uploader(domain string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.uploaders[strings.ToLower(domain)]
+}
+
+// Get returns the certificate serving serverName, trying an exact match then a wildcard
+func (c *CertificateStore) Get(serverName string) (*tls.Certificate, bool) {
+	serverName = strings.ToLower(serverName)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if cert, ok := c.certs[serverName]; ok {
+		return cert, true
+	}
+	if _, parent, ok := strings.Cut(serverName, "."); ok {
+		cert, ok := c.certs["*."+parent]
+		return cert, ok
+	}
+	return nil, false
+}
+
+// List returns the stored certificates sorted by domain
+func (c *CertificateStore) List() []CertificateInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	infos := make([]CertificateInfo, 0, len(c.certs))
+	for domain, cert := range c.certs {
+		infos = append(infos, certificateInfo(domain, cert))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Domain < infos[j].Domain
+	})
+	return infos
+}
+
+// load decrypts every certificate file of the store directory
+func (c *CertificateStore) load() error {
+	files, err := filepath.Glob(filepath.Join(c.dir, "*"+certificateFileExt))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		sealed, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		stored, err := c.open(sealed)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		cert, err := parseKeyPair([]byte(stored.Cert), []byte(stored.Key))
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		c.certs[stored.Domain] = &cert
+		if stored.Uploader != "" {
+			c.uploaders[stored.Domain] = stored.Uploader
+		}
+	}
+	return nil
+}
+
+// open decrypts and decodes a certificate file
+func (c *CertificateStore) open(sealed []byte) (storedCertificate, error) {
+	var stored storedCertificate
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return stored, errors.New("encrypted certificate is too short")
+	}
+	plaintext, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return stored, fmt.Errorf("could not decrypt certificate: %v", err)
+	}
+	return stored, json.Unmarshal(plaintext, &stored)
+}
+
+// parseKeyPair parses a PEM certificate and key, filling the certificate leaf
+func parseKeyPair(certPEM, keyPEM []byte) (tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return cert, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	return cert, err
+}
+
+// path returns the file of a domain certificate
+func (c *CertificateStore) path(domain string) string {
+	sum := sha256.Sum256([]byte(domain))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+certificateFileExt)
+}
+
+// certificateInfo describes a certificate
+func certificateInfo(domain string, cert *tls.Certificate) CertificateInfo {
+	return CertificateInfo{
+		Domain:   domain,
+		DNSNames: cert.Leaf.DNSNames,
+		Issuer:   cert.Leaf.Issuer.String(),
+		NotAfter: cert.Leaf.NotAfter,
+	}
+}
+
+// recheckCertificate drops the certificate a tunnel client uploaded for domain once that client
+// no longer holds a route of the domain, so it is not served for the next client taking it
+func (s *Server) recheckCertificate(domain string) {
+	certificates := s.opts.certificates
+	if certificates == nil {
+		return
+	}
+	uploader := certificates.uploader(domain)
+	if uploader == "" {
+		return
+	}
+	if stateAny, ok := s.serverStates.Load(uploader); ok && stateAny.(*ServerConnState).holdsDomain(domain) {
+		return
+	}
+	if _, err := certificates.Delete(domain); err != nil {
+		s.opts.logger.Warn("could not remove the uploaded certificate", slog.String(LogKeyDomain, domain), "error", err)
+		return
+	}
+	s.opts.logger.Info("uploaded certificate removed, its client no longer holds the domain", slog.String(LogKeyDomain, domain))
+}
+
+// certificateRoutes registers the certificate admin API into mux
+func (s *Server) certificateRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /certificates", func(w http.ResponseWriter, r *http.Request) {
+		if s.opts.certificates == nil {
+			writeJSON(w, http.StatusOK, []CertificateInfo{})
+			return
+		}
+		writeJSON(w, http.StatusOK, s.opts.certificates.List())
+	})
+	mux.HandleFunc("PUT /certificates/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		if s.opts.certificates == nil {
+			http.Error(w, "certificate store is not configured", http.StatusNotImplemented)
+			return
+		}
+		var upload struct {
+			Cert string `json:"cert"`
+			Key  string `json:"key"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&upload); err != nil {
+			http.Error(w, fmt.Sprintf("invalid certificate upload: %v", err), http.StatusBadRequest)
+			return
+		}
+		info, err := s.opts.certificates.Put(r.PathValue("domain"), []byte(upload.Cert), []byte(upload.Key))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	})
+	mux.HandleFunc("DELETE /certificates/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		if s.opts.certificates == nil {
+			http.Error(w, "certificate not found", http.StatusNotFound)
+			return
+		}
+		ok, err := s.opts.certificates.Delete(r.PathValue("domain"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "certificate not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// selfSigned returns a PEM certificate and key valid for the given names
+func selfSigned(t *testing.T, names ...string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestCertificateStore(t *testing.T) {
+	dir := t.TempDir()
+	key := make([]byte, 32)
+	store, err := NewCertificateStore(dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM, keyPEM := selfSigned(t, "other.example.com")
+	if _, err := store.Put("custom.example.com", certPEM, keyPEM); err == nil {
+		t.Error("expected a certificate not covering the domain to be rejected")
+	}
+	certPEM, keyPEM = selfSigned(t, "custom.example.com")
+	if _, err := store.Put("custom.example.com", certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	wildPEM, wildKeyPEM := selfSigned(t, "*.wild.example.com")
+	if _, err := store.Put("*.wild.example.com", wildPEM, wildKeyPEM); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewCertificateStore(dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(WithCertificateStore(reopened))
+	for _, serverName := range []string{"custom.example.com", "api.wild.example.com"} {
+		cert, err := s.TLSConfig().GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatalf("%s: %v", serverName, err)
+		}
+		if err := cert.Leaf.VerifyHostname(serverName); err != nil {
+			t.Errorf("%s: %v", serverName, err)
+		}
+	}
+	if _, err := s.TLSConfig().GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.example.com"}); err == nil {
+		t.Error("expected no certificate for an unknown domain")
+	}
+
+	wrongKey := make([]byte, 32)
+	wrongKey[0] = 1
+	if _, err := NewCertificateStore(dir, wrongKey); err == nil {
+		t.Error("expected the store to fail opening with the wrong key")
+	}
+}
+
+func TestUploadedCertificateFollowsRoute(t *testing.T) {
+	certificates, err := NewCertificateStore(t.TempDir(), make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(WithCertificateStore(certificates))
+	srv := httptest.NewServer(s.Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	register := func(domain string) {
+		client.send(RegisterMessage{Type: "register", ID: uuid.NewString(), APIKey: "test", Domain: domain}, nil)
+		if frame := client.next(); frame.Type != "registered" {
+			t.Fatalf("expected the registration to succeed, got %+v", frame)
+		}
+	}
+	register("api.example.com/v2")
+
+	certPEM, keyPEM := selfSigned(t, "api.example.com")
+	upload := func() testFrame {
+		client.send(CertificateMessage{Type: "certificate", ID: uuid.NewString(), Domain: "api.example.com", Cert: string(certPEM), Key: string(keyPEM)}, nil)
+		return client.next()
+	}
+	if frame := upload(); frame.Type != "certificate-accepted" {
+		t.Fatalf("expected the route host to accept a certificate, got %+v", frame)
+	}
+	s.UnlinkDomain("api.example.com/v2")
+	if _, ok := certificates.Get("api.example.com"); ok {
+		t.Error("expected the uploaded certificate to go with the route")
+	}
+	if frame := upload(); frame.Type != "error" {
+		t.Errorf("expected an upload for a released domain to be refused, got %q", frame.Type)
+	}
+
+	// admin uploads stay, uploads of clients gone before a restart do not
+	if _, err := certificates.Put("api.example.com", certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := certificates.put("other.example.com", "previous-client", certPEM, keyPEM); err == nil {
+		t.Fatal("expected the certificate to be checked against the domain")
+	}
+	otherPEM, otherKeyPEM := selfSigned(t, "other.example.com")
+	if _, err := certificates.put("other.example.com", "previous-client", otherPEM, otherKeyPEM); err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range []string{"api.example.com", "other.example.com"} {
+		register(domain)
+	}
+	s.UnlinkDomain("api.example.com")
+	if _, ok := certificates.Get("api.example.com"); !ok {
+		t.Error("expected the admin certificate to stay")
+	}
+	if _, ok := certificates.Get("other.example.com"); ok {
+		t.Error("expected the certificate of the previous client not to be served to the new one")
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardInterval is the time between two dashboard updates
+const dashboardInterval = 2 * time.Second
+
+// DashboardSnapshot is a struct to hold the tunnel state pushed to the dashboard
+type DashboardSnapshot struct {
+	Time    time.Time         `json:"time"`
+	Clients []ClientInfo      `json:"clients"`
+	Domains map[string]string `json:"domains"`
+}
+
+// Snapshot returns the current tunnel state
+func (s *Server) Snapshot() DashboardSnapshot {
+	return DashboardSnapshot{
+		Time:    time.Now(),
+		Clients: s.Clients(),
+		Domains: s.DomainClients(),
+	}
+}
+
+// dashboardRoutes registers the embedded dashboard and its event stream into mux
+func (s *Server) dashboardRoutes(mux *http.ServeMux) {
+	static, _ := fs.Sub(dashboardFiles, "dashboard")
+	mux.Handle("GET /dashboard/", http.StripPrefix("/dashboard/", http.FileServerFS(static)))
+	mux.HandleFunc("GET /dashboard/events", s.onDashboardEvents)
+	mux.Handle("GET /{$}", http.RedirectHandler("/dashboard/", http.StatusFound))
+}
+
+// onDashboardEvents streams a snapshot of the tunnel state as server-sent events
+func (s *Server) onDashboardEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// the stream outlives the admin listener write timeout
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(dashboardInterval)
+	defer ticker.Stop()
+	for {
+		data, err := json.Marshal(s.Snapshot())
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: snapshot\ndata: %s\n\n", data); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
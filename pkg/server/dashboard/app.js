@@ -0,0 +1,100 @@
+"use strict";
+
+// previous holds the last snapshot so rates can be computed from counter deltas
+let previous = null;
+
+const $ = (id) => document.getElementById(id);
+
+function formatBytes(n) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return `${n.toFixed(i === 0 ? 0 : 1)} ${units[i]}`;
+}
+
+function rate(current, before, field, seconds) {
+  if (!before || seconds <= 0) {
+    return 0;
+  }
+  return Math.max(0, current[field] - before[field]) / seconds;
+}
+
+function cell(text, className) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function render(snapshot) {
+  const seconds = previous ? (new Date(snapshot.time) - new Date(previous.time)) / 1000 : 0;
+  const before = new Map((previous ? previous.clients : []).map((c) => [c.id, c]));
+
+  let inFlight = 0;
+  let rps = 0;
+  let eps = 0;
+  const rows = snapshot.clients.map((client) => {
+    const old = before.get(client.id);
+    const clientRps = rate(client, old, "requests", seconds);
+    const clientEps = rate(client, old, "errors", seconds);
+    const bytesIn = rate(client, old, "bytesIn", seconds);
+    const bytesOut = rate(client, old, "bytesOut", seconds);
+    inFlight += client.inFlight;
+    rps += clientRps;
+    eps += clientEps;
+
+    const tr = document.createElement("tr");
+    if (clientEps > 0) {
+      tr.className = "errors";
+    }
+    tr.append(
+      cell(client.id),
+      cell(client.domains.join(", ")),
+      cell(client.remoteAddr),
+      cell(new Date(client.connectedAt).toLocaleString()),
+      cell(client.inFlight, "num"),
+      cell(clientRps.toFixed(1), "num"),
+      cell(clientEps.toFixed(1), "num"),
+      cell(`${formatBytes(bytesIn)}/s`, "num"),
+      cell(`${formatBytes(bytesOut)}/s`, "num"),
+    );
+    return tr;
+  });
+  $("tunnels").replaceChildren(...rows);
+
+  const domains = Object.entries(snapshot.domains).sort(([a], [b]) => a.localeCompare(b));
+  $("domains").replaceChildren(
+    ...domains.map(([domain, clientID]) => {
+      const tr = document.createElement("tr");
+      tr.append(cell(domain), cell(clientID));
+      return tr;
+    }),
+  );
+
+  $("total-tunnels").textContent = snapshot.clients.length;
+  $("total-domains").textContent = domains.length;
+  $("total-inflight").textContent = inFlight;
+  $("total-rps").textContent = rps.toFixed(1);
+  $("total-eps").textContent = eps.toFixed(1);
+  previous = snapshot;
+}
+
+function connect() {
+  const events = new EventSource("events");
+  events.addEventListener("snapshot", (event) => {
+    $("status").textContent = "live";
+    $("status").className = "status live";
+    render(JSON.parse(event.data));
+  });
+  events.onerror = () => {
+    $("status").textContent = "reconnecting…";
+    $("status").className = "status down";
+  };
+}
+
+connect();
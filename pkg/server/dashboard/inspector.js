@@ -0,0 +1,159 @@
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+
+async function api(method, path, body) {
+  const init = { method };
+  if (body !== undefined) {
+    init.body = JSON.stringify(body);
+    init.headers = { "Content-Type": "application/json" };
+  }
+  const resp = await fetch(path, init);
+  if (!resp.ok) {
+    throw new Error(`${method} ${path}: ${resp.status}`);
+  }
+  return resp.status === 204 ? null : resp.json();
+}
+
+function decodeBody(body, truncated) {
+  if (!body) {
+    return "";
+  }
+  const bytes = Uint8Array.from(atob(body), (c) => c.charCodeAt(0));
+  const text = new TextDecoder().decode(bytes);
+  return truncated ? `${text}\n… (truncated)` : text;
+}
+
+function formatHeaders(headers) {
+  return Object.entries(headers || {})
+    .sort(([a], [b]) => a.localeCompare(b))
+    .map(([key, value]) => `${key}: ${value}`)
+    .join("\n");
+}
+
+function cell(text) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  return td;
+}
+
+async function loadDomains() {
+  const domains = await api("GET", "../inspector/domains");
+  $("capture-domains").replaceChildren(
+    ...domains.map((domain) => {
+      const li = document.createElement("li");
+      const button = document.createElement("button");
+      button.textContent = "×";
+      button.title = "disable capture mode";
+      button.onclick = async () => {
+        await api("DELETE", `../inspector/domains/${encodeURIComponent(domain)}`);
+        loadDomains();
+      };
+      li.append(domain, button);
+      return li;
+    }),
+  );
+}
+
+async function loadCaptures() {
+  const params = new URLSearchParams();
+  for (const [key, value] of new FormData($("filter-form"))) {
+    if (!value) {
+      continue;
+    }
+    params.set(key, key === "since" || key === "until" ? new Date(value).toISOString() : value);
+  }
+  const captures = await api("GET", `../inspector/captures?${params}`);
+  $("captures").replaceChildren(
+    ...captures.map((capture) => {
+      const tr = document.createElement("tr");
+      tr.className = "clickable";
+      tr.onclick = () => showCapture(capture);
+      tr.append(
+        cell(new Date(capture.startedAt).toLocaleTimeString()),
+        cell(capture.domain),
+        cell(capture.method),
+        cell(capture.url),
+        cell(capture.status || "-"),
+        cell(`${(capture.durationNs / 1e6).toFixed(1)} ms`),
+      );
+      return tr;
+    }),
+  );
+}
+
+function formatResponse(capture) {
+  return [
+    `${capture.status || "no response"}`,
+    formatHeaders(capture.responseHeaders),
+    "",
+    decodeBody(capture.responseBody, capture.responseTruncated),
+  ].join("\n");
+}
+
+function encodeBody(text) {
+  const bytes = new TextEncoder().encode(text);
+  return btoa(Array.from(bytes, (b) => String.fromCharCode(b)).join(""));
+}
+
+// current is the capture shown in the detail pane
+let current = null;
+
+function showCapture(capture) {
+  current = capture;
+  $("detail").hidden = false;
+  $("replay-result").hidden = true;
+  $("replay-headers").value = formatHeaders(capture.requestHeaders);
+  // the captured body is replayed as is unless it is edited, a truncated one must be given in full
+  $("replay-body").value = capture.requestTruncated ? "" : decodeBody(capture.requestBody, false);
+  $("replay-body").placeholder = capture.requestTruncated ? "the captured body was truncated, enter the full body to replay it" : "";
+  $("replay-body").dataset.original = $("replay-body").value;
+  $("detail-title").textContent = `${capture.method} ${capture.domain}${capture.url}`;
+  $("detail-request").textContent = [
+    `${capture.method} ${capture.url}`,
+    formatHeaders(capture.requestHeaders),
+    "",
+    decodeBody(capture.requestBody, capture.requestTruncated),
+  ].join("\n");
+  $("detail-response").textContent = formatResponse(capture);
+}
+
+$("replay-form").onsubmit = async (event) => {
+  event.preventDefault();
+  const headers = {};
+  for (const key of Object.keys(current.requestHeaders || {})) {
+    headers[key] = "";
+  }
+  for (const line of $("replay-headers").value.split("\n")) {
+    const idx = line.indexOf(":");
+    if (idx > 0) {
+      headers[line.slice(0, idx).trim()] = line.slice(idx + 1).trim();
+    }
+  }
+  const edits = { headers };
+  // text areas only hold text, sending back an unedited body would corrupt binary ones
+  if ($("replay-body").value !== $("replay-body").dataset.original) {
+    edits.body = encodeBody($("replay-body").value);
+  }
+  const result = await api("POST", `../inspector/captures/${current.id}/replay`, edits);
+  $("replay-original").textContent = formatResponse(result.original);
+  $("replay-replayed").textContent = formatResponse(result.replay);
+  $("replay-result").hidden = false;
+  loadCaptures();
+};
+
+$("capture-form").onsubmit = async (event) => {
+  event.preventDefault();
+  await api("PUT", `../inspector/domains/${encodeURIComponent($("capture-domain").value)}`);
+  $("capture-domain").value = "";
+  loadDomains();
+};
+
+$("filter-form").onsubmit = (event) => {
+  event.preventDefault();
+  loadCaptures();
+};
+
+loadDomains();
+loadCaptures();
+setInterval(loadCaptures, 5000);
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// drainPollInterval is how often the requests in flight are counted while draining
+const drainPollInterval = 50 * time.Millisecond
+
+// Drain is a method to shut the tunnels down gracefully: the clients are told the server is
+// draining, new tunnels and registrations are refused, the requests in flight are given until
+// the context is done to finish and the tunnels are closed with the service restart code.
+// Visitor requests are still forwarded while draining so the HTTP server can be shut down
+// at the same time.
+func (s *Server) Drain(ctx context.Context) error {
+	if !s.draining.CompareAndSwap(false, true) {
+		return fmt.Errorf("server is already draining")
+	}
+	draining := &ServerDrainingMessage{Type: "server-draining"}
+	if deadline, ok := ctx.Deadline(); ok {
+		draining.Deadline = deadline.UTC().Format(time.RFC3339)
+	}
+	states := s.connStates()
+	for _, state := range states {
+		// a client that stopped reading holds its send until the write deadline, not the drain
+		go func(state *ServerConnState) {
+			if err := state.Ch.Send(draining); err != nil {
+				state.Logger.Debug("could not notify tunnel client of the drain", "error", err)
+			}
+		}(state)
+	}
+	s.opts.logger.Info("draining tunnels", "clients", len(states))
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	var err error
+wait:
+	for inFlight := s.inFlightRequests(); inFlight > 0; inFlight = s.inFlightRequests() {
+		select {
+		case <-ctx.Done():
+			s.opts.logger.Warn("drain deadline reached with requests in flight", "requests", inFlight)
+			err = ctx.Err()
+			break wait
+		case <-ticker.C:
+		}
+	}
+	// clients connected before the flag was set may have been missed by the first listing,
+	// the close frames get a short time of their own as the context may be done already and
+	// the tunnels of clients that stopped reading are closed without them
+	closeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), closeFrameTimeout)
+	defer cancel()
+	closing := sync.WaitGroup{}
+	for _, state := range s.connStates() {
+		closing.Add(1)
+		go func(state *ServerConnState) {
+			defer closing.Done()
+			state.Ch.CloseWithCode(closeCtx, websocket.CloseServiceRestart, "server draining")
+		}(state)
+	}
+	closing.Wait()
+	return err
+}
+
+// Draining is a method to return whether the server stopped accepting tunnels
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+// connStates returns the state of every connected client
+func (s *Server) connStates() []*ServerConnState {
+	states := []*ServerConnState{}
+	s.serverStates.Range(func(_, value any) bool {
+		states = append(states, value.(*ServerConnState))
+		return true
+	})
+	return states
+}
+
+// inFlightRequests counts the requests waiting on a tunnel client
+func (s *Server) inFlightRequests() int {
+	count := 0
+	for _, state := range s.connStates() {
+		state.OngoingRequests.Range(func(_, _ any) bool {
+			count++
+			return true
+		})
+	}
+	return count
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// expectServiceRestart waits for the server to close the tunnel of client with the service restart code
+func expectServiceRestart(t *testing.T, client *testClient) {
+	t.Helper()
+	for range client.frames {
+	}
+	if !websocket.IsCloseError(client.closeErr, websocket.CloseServiceRestart) {
+		t.Errorf("expected the tunnel to be closed with the service restart code, got %v", client.closeErr)
+	}
+}
+
+func TestDrainWaitsForRequests(t *testing.T) {
+	s := New()
+	srv := httptest.NewServer(s.Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	client.register("drain.example.com")
+
+	responses := visitorRequest(srv, "drain.example.com")
+	start := waitRequest(client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	drained := make(chan error, 1)
+	go func() {
+		drained <- s.Drain(ctx)
+	}()
+	if frame := client.next(); frame.Type != "server-draining" {
+		t.Fatalf("expected the client to be told about the drain, got %q", frame.Type)
+	}
+	if frame := registerFrame(client, RegisterMessage{Domain: "late.example.com"}); frame.Type != "error" {
+		t.Errorf("expected registrations to be refused while draining, got %q", frame.Type)
+	}
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/_connect"
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected new tunnels to be refused while draining, got %v", err)
+	}
+	select {
+	case err := <-drained:
+		t.Fatalf("expected the drain to wait for the request in flight, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	client.send(ResponseStartMessage{Type: "response-start", ID: start.ID, StatusCode: http.StatusOK}, nil)
+	client.send(DataMessage{Type: "data", ID: start.ID}, []byte("done"))
+	client.send(DataEndMessage{Type: "data-end", ID: start.ID}, nil)
+	resp := <-responses
+	if resp == nil {
+		t.Fatal("expected the request in flight to be answered")
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "done" {
+		t.Errorf("expected the request in flight to finish, got %d %q", resp.StatusCode, body)
+	}
+	if err := <-drained; err != nil {
+		t.Errorf("expected the drain to finish before its deadline, got %v", err)
+	}
+	expectServiceRestart(t, client)
+}
+
+func TestDrainDeadline(t *testing.T) {
+	s := New()
+	srv := httptest.NewServer(s.Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	client.register("stuck.example.com")
+
+	responses := visitorRequest(srv, "stuck.example.com")
+	waitRequest(client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := s.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the drain to give up at the deadline, got %v", err)
+	}
+	expectServiceRestart(t, client)
+	resp := <-responses
+	if resp == nil {
+		t.Fatal("expected the abandoned request to be answered")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected the abandoned request to fail with %d, got %d", http.StatusBadGateway, resp.StatusCode)
+	}
+}
+
+func TestDrainClientNotReading(t *testing.T) {
+	s := New()
+	srv := httptest.NewServer(s.Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	client.register("stalled.example.com")
+
+	// the frames of a large upload pile up in front of a client that does not read them
+	go func() {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/", strings.NewReader(strings.Repeat("x", 64<<20)))
+		if err != nil {
+			return
+		}
+		req.Host = "stalled.example.com"
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	drained := make(chan error, 1)
+	go func() {
+		drained <- s.Drain(ctx)
+	}()
+	select {
+	case err := <-drained:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the drain to give up at the deadline, got %v", err)
+		}
+	case <-time.After(writeTimeout):
+		t.Fatal("expected a client that stopped reading not to hold the drain")
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// h2cTransport speaks HTTP/2 without TLS
+var h2cTransport = &http2.Transport{
+	AllowHTTP: true,
+	DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	},
+}
+
+// newH2CServer serves the server routes to HTTP/1.1 and h2c visitors
+func newH2CServer(t *testing.T, s *Server) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(h2c.NewHandler(s.Routes(), &http2.Server{}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHTTP2Trailers(t *testing.T) {
+	srv := newH2CServer(t, New())
+	client := dialTestClient(t, srv)
+	client.register("h2.example.com")
+	client.serve(func(req testFrame, body []byte) testResponse {
+		return testResponse{
+			status:   http.StatusOK,
+			headers:  map[string]string{"X-Proto": req.Proto},
+			chunks:   [][]byte{body},
+			trailers: map[string]string{"X-Checksum": req.Trailers["X-Checksum"], "X-Result": "done"},
+		}
+	})
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/upload", io.NopCloser(strings.NewReader("payload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "h2.example.com"
+	req.Trailer = http.Header{"X-Checksum": {"abc"}}
+	resp, err := h2cTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != 2 || resp.Header.Get("X-Proto") != "HTTP/2.0" {
+		t.Fatalf("expected HTTP/2 end to end, got %s and %q", resp.Proto, resp.Header.Get("X-Proto"))
+	}
+	if string(body) != "payload" {
+		t.Errorf("expected the body to be echoed, got %q", body)
+	}
+	if resp.Trailer.Get("X-Result") != "done" || resp.Trailer.Get("X-Checksum") != "abc" {
+		t.Errorf("expected the trailers to cross the tunnel, got %v", resp.Trailer)
+	}
+}
+
+// grpcUpstream forwards tunneled requests to a gRPC server the way a tunnel client would
+func grpcUpstream(t *testing.T) func(req testFrame, body []byte) testResponse {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(upstream, health.NewServer())
+	go upstream.Serve(listener)
+	t.Cleanup(upstream.Stop)
+
+	return func(req testFrame, body []byte) testResponse {
+		upstreamReq, err := http.NewRequest(req.Method, "http://"+listener.Addr().String()+req.URL, bytes.NewReader(body))
+		if err != nil {
+			return testResponse{status: http.StatusBadGateway}
+		}
+		for key, value := range req.Headers {
+			upstreamReq.Header.Set(key, value)
+		}
+		resp, err := h2cTransport.RoundTrip(upstreamReq)
+		if err != nil {
+			return testResponse{status: http.StatusBadGateway}
+		}
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		return testResponse{
+			status:   resp.StatusCode,
+			headers:  headerToMap(resp.Header),
+			chunks:   [][]byte{respBody},
+			trailers: headerToMap(resp.Trailer),
+		}
+	}
+}
+
+func TestGRPCTunnel(t *testing.T) {
+	srv := newH2CServer(t, New())
+	client := dialTestClient(t, srv)
+	client.register("grpc.example.com")
+	client.serve(grpcUpstream(t))
+
+	conn, err := grpc.NewClient(strings.TrimPrefix(srv.URL, "http://"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithAuthority("grpc.example.com"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		t.Errorf("expected the upstream to be serving, got %s", resp.Status)
+	}
+}
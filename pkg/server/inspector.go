@@ -0,0 +1,300 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Inspector defaults
+const (
+	DefaultInspectorCapacity  = 200
+	DefaultInspectorBodyLimit = 64 * 1024
+)
+
+// Capture is a struct to hold a tunneled request and its response as seen by the server
+type Capture struct {
+	ID       string `json:"id"`
+	ReplayOf string `json:"replayOf,omitempty"`
+	// Identity is the signed in visitor of domains behind single sign on
+	Identity          *Identity         `json:"identity,omitempty"`
+	Domain            string            `json:"domain"`
+	ClientID          string            `json:"clientId"`
+	StartedAt         time.Time         `json:"startedAt"`
+	Duration          time.Duration     `json:"durationNs"`
+	Method            string            `json:"method"`
+	URL               string            `json:"url"`
+	RequestHeaders    map[string]string `json:"requestHeaders"`
+	RequestBody       []byte            `json:"requestBody"`
+	RequestTruncated  bool              `json:"requestTruncated"`
+	Status            int               `json:"status"`
+	ResponseHeaders   map[string]string `json:"responseHeaders"`
+	ResponseBody      []byte            `json:"responseBody"`
+	ResponseTruncated bool              `json:"responseTruncated"`
+}
+
+// CaptureFilter is a struct to select captures, zero fields match everything
+type CaptureFilter struct {
+	Domain string
+	// Path matches captures whose URL contains it
+	Path string
+	// Status matches an exact status code ("404") or a class ("5xx")
+	Status string
+	Since  time.Time
+	Until  time.Time
+}
+
+// match returns whether a capture is selected by the filter
+func (f CaptureFilter) match(c *Capture) bool {
+	if f.Domain != "" && c.Domain != f.Domain {
+		return false
+	}
+	if f.Path != "" && !strings.Contains(c.URL, f.Path) {
+		return false
+	}
+	if f.Status != "" {
+		status := strconv.Itoa(c.Status)
+		if class, ok := strings.CutSuffix(strings.ToLower(f.Status), "xx"); ok {
+			if !strings.HasPrefix(status, class) || len(status) != 3 {
+				return false
+			}
+		} else if status != f.Status {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && c.StartedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && c.StartedAt.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Inspector is a struct to record the traffic of the domains in capture mode into a ring buffer
+type Inspector struct {
+	bodyLimit int
+
+	mu       sync.Mutex
+	domains  map[string]bool
+	captures []*Capture
+	next     int
+}
+
+// NewInspector creates an inspector keeping the last capacity captures with bodies up to bodyLimit bytes
+func NewInspector(capacity, bodyLimit int) *Inspector {
+	if capacity <= 0 {
+		capacity = DefaultInspectorCapacity
+	}
+	return &Inspector{
+		bodyLimit: bodyLimit,
+		domains:   map[string]bool{},
+		captures:  make([]*Capture, 0, capacity),
+	}
+}
+
+// Enable turns capture mode on for a domain
+func (i *Inspector) Enable(domain string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.domains[domain] = true
+}
+
+// Disable turns capture mode off for a domain
+func (i *Inspector) Disable(domain string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.domains, domain)
+}
+
+// Enabled returns whether a domain is in capture mode
+func (i *Inspector) Enabled(domain string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.domains[domain]
+}
+
+// Domains returns the domains in capture mode
+func (i *Inspector) Domains() []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	domains := make([]string, 0, len(i.domains))
+	for domain := range i.domains {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// Captures returns copies of the captures matching filter, newest first
+func (i *Inspector) Captures(filter CaptureFilter) []Capture {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	result := []Capture{}
+	for n := 0; n < len(i.captures); n++ {
+		idx := (i.next - 1 - n + len(i.captures)) % len(i.captures)
+		if c := i.captures[idx]; filter.match(c) {
+			result = append(result, *c)
+		}
+	}
+	return result
+}
+
+// Capture returns a copy of the capture with the given id
+func (i *Inspector) Capture(id string) (Capture, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, c := range i.captures {
+		if c.ID == id {
+			return *c, true
+		}
+	}
+	return Capture{}, false
+}
+
+// add stores a finished capture, overwriting the oldest one when the buffer is full
+func (i *Inspector) add(c *Capture) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if len(i.captures) < cap(i.captures) {
+		i.captures = append(i.captures, c)
+		i.next = len(i.captures) % cap(i.captures)
+		return
+	}
+	i.captures[i.next] = c
+	i.next = (i.next + 1) % len(i.captures)
+}
+
+// start begins recording a request when its domain is in capture mode, returning nil otherwise
+func (i *Inspector) start(r *http.Request, domain, clientID string, identity *Identity) *capture {
+	if i == nil || !i.Enabled(domain) {
+		return nil
+	}
+	if identity != nil {
+		copied := *identity
+		identity = &copied
+	}
+	return &capture{
+		inspector: i,
+		c: Capture{
+			ID:             uuid.NewString(),
+			ReplayOf:       replayOfFromContext(r.Context()),
+			Identity:       identity,
+			Domain:         domain,
+			ClientID:       clientID,
+			StartedAt:      time.Now(),
+			Method:         r.Method,
+			URL:            r.URL.RequestURI(),
+			RequestHeaders: headerToMap(r.Header),
+		},
+	}
+}
+
+// capture is a struct to hold a capture while its request is in flight
+type capture struct {
+	inspector *Inspector
+	mu        sync.Mutex
+	c         Capture
+}
+
+// requestChunk records a chunk of the request body
+func (c *capture) requestChunk(chunk []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.c.RequestBody, c.c.RequestTruncated = appendLimited(c.c.RequestBody, chunk, c.inspector.bodyLimit, c.c.RequestTruncated)
+}
+
+// responseStarted records the response status and headers
+func (c *capture) responseStarted(status int, headers map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.c.Status = status
+	c.c.ResponseHeaders = headers
+}
+
+// responseChunk records a chunk of the response body
+func (c *capture) responseChunk(chunk []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.c.ResponseBody, c.c.ResponseTruncated = appendLimited(c.c.ResponseBody, chunk, c.inspector.bodyLimit, c.c.ResponseTruncated)
+}
+
+// finish stores the capture into the inspector ring buffer
+func (c *capture) finish() {
+	c.mu.Lock()
+	c.c.Duration = time.Since(c.c.StartedAt)
+	finished := c.c
+	c.mu.Unlock()
+	c.inspector.add(&finished)
+}
+
+// appendLimited appends chunk to body without growing it past limit, reporting truncation
+func appendLimited(body, chunk []byte, limit int, truncated bool) ([]byte, bool) {
+	room := limit - len(body)
+	if room <= 0 {
+		return body, truncated || len(chunk) > 0
+	}
+	if len(chunk) > room {
+		return append(body, chunk[:room]...), true
+	}
+	return append(body, chunk...), truncated
+}
+
+// inspectorRoutes registers the inspector admin API into mux
+func (s *Server) inspectorRoutes(mux *http.ServeMux) {
+	inspector := s.opts.inspector
+	mux.HandleFunc("GET /inspector/domains", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, inspector.Domains())
+	})
+	mux.HandleFunc("PUT /inspector/domains/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		inspector.Enable(r.PathValue("domain"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /inspector/domains/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		inspector.Disable(r.PathValue("domain"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /inspector/captures", func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseCaptureFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, inspector.Captures(filter))
+	})
+	mux.HandleFunc("POST /inspector/captures/{id}/replay", s.onReplay)
+	mux.HandleFunc("GET /inspector/captures/{id}", func(w http.ResponseWriter, r *http.Request) {
+		c, ok := inspector.Capture(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "capture not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, c)
+	})
+}
+
+// parseCaptureFilter reads a CaptureFilter from the query string
+func parseCaptureFilter(r *http.Request) (CaptureFilter, error) {
+	query := r.URL.Query()
+	filter := CaptureFilter{
+		Domain: query.Get("domain"),
+		Path:   query.Get("path"),
+		Status: query.Get("status"),
+	}
+	for name, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s: %v", name, err)
+			}
+			*dst = t
+		}
+	}
+	return filter, nil
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInspectorCapturesExchange(t *testing.T) {
+	s := New(WithInspector(NewInspector(10, 4)))
+	srv := newTunnel(t, s, "example.test", func(req testFrame, body []byte) testResponse {
+		status := http.StatusOK
+		if strings.HasPrefix(req.URL, "/missing") {
+			status = http.StatusNotFound
+		}
+		return testResponse{status: status, headers: map[string]string{"X-Upstream": "yes"}, chunks: [][]byte{[]byte("ok")}}
+	})
+
+	resp := tunnelRequest(t, srv, "example.test", "POST", "/hook", strings.NewReader("payload"))
+	io.ReadAll(resp.Body)
+	if got := s.Inspector().Captures(CaptureFilter{}); len(got) != 0 {
+		t.Fatalf("expected no captures before capture mode is enabled, got %d", len(got))
+	}
+
+	s.Inspector().Enable("example.test")
+	resp = tunnelRequest(t, srv, "example.test", "POST", "/hook?attempt=2", strings.NewReader("payload"))
+	io.ReadAll(resp.Body)
+	resp = tunnelRequest(t, srv, "example.test", "GET", "/missing", nil)
+	io.ReadAll(resp.Body)
+
+	captures := s.Inspector().Captures(CaptureFilter{Path: "/hook"})
+	if len(captures) != 1 {
+		t.Fatalf("expected 1 capture for /hook, got %d", len(captures))
+	}
+	c := captures[0]
+	if c.URL != "/hook?attempt=2" || c.Method != "POST" || c.Status != http.StatusOK {
+		t.Errorf("unexpected capture %+v", c)
+	}
+	if string(c.RequestBody) != "payl" || !c.RequestTruncated {
+		t.Errorf("expected truncated request body, got %q truncated=%v", c.RequestBody, c.RequestTruncated)
+	}
+	if string(c.ResponseBody) != "ok" || c.ResponseHeaders["X-Upstream"] != "yes" {
+		t.Errorf("unexpected response body %q and headers %v", c.ResponseBody, c.ResponseHeaders)
+	}
+	if got := s.Inspector().Captures(CaptureFilter{Status: "4xx"}); len(got) != 1 || got[0].URL != "/missing" {
+		t.Errorf("unexpected 4xx captures %+v", got)
+	}
+}
+
+func TestInspectorRingBuffer(t *testing.T) {
+	inspector := NewInspector(3, 0)
+	for _, url := range []string{"/1", "/2", "/3", "/4", "/5"} {
+		inspector.add(&Capture{ID: url, URL: url})
+	}
+	captures := inspector.Captures(CaptureFilter{})
+	got := []string{}
+	for _, c := range captures {
+		got = append(got, c.URL)
+	}
+	if strings.Join(got, ",") != "/5,/4,/3" {
+		t.Errorf("expected newest captures first, got %v", got)
+	}
+}
+
+func TestReplayCapture(t *testing.T) {
+	s := New()
+	s.Inspector().Enable("example.test")
+	srv := newTunnel(t, s, "example.test", func(req testFrame, body []byte) testResponse {
+		return testResponse{status: http.StatusAccepted, chunks: [][]byte{[]byte(req.Headers["X-Signature"] + ":"), body}}
+	})
+
+	req, _ := http.NewRequest("POST", srv.URL+"/hook", strings.NewReader("original"))
+	req.Host = "example.test"
+	req.Header.Set("X-Signature", "abc")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	captures := s.Inspector().Captures(CaptureFilter{})
+	if len(captures) != 1 {
+		t.Fatalf("expected 1 capture, got %d", len(captures))
+	}
+	result, err := s.Replay(context.Background(), captures[0].ID, ReplayEdits{
+		Headers: map[string]string{"x-signature": "def"},
+		Body:    []byte("edited"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Original.ResponseBody) != "abc:original" {
+		t.Errorf("unexpected original response %q", result.Original.ResponseBody)
+	}
+	if result.Replay.Status != http.StatusAccepted || string(result.Replay.ResponseBody) != "def:edited" {
+		t.Errorf("unexpected replay response %d %q", result.Replay.Status, result.Replay.ResponseBody)
+	}
+	if latest := s.Inspector().Captures(CaptureFilter{})[0]; latest.ReplayOf != captures[0].ID {
+		t.Errorf("expected the replay to be captured as a replay of %s, got %q", captures[0].ID, latest.ReplayOf)
+	}
+
+	if _, err := s.Replay(context.Background(), "missing", ReplayEdits{}); !errors.Is(err, ErrCaptureNotFound) {
+		t.Errorf("expected ErrCaptureNotFound, got %v", err)
+	}
+}
+
+func TestReplayProtectedDomain(t *testing.T) {
+	s := New(WithPolicy(Policy{RateLimit: 0.001, RateBurst: 1}))
+	s.Inspector().Enable("app.example.com")
+	srv := httptest.NewServer(s.Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	frame := registerFrame(client, RegisterMessage{Domain: "app.example.com", Access: &AccessPolicy{
+		BearerTokens: []string{"token-1"},
+		AllowCIDRs:   []string{"127.0.0.0/8"},
+	}})
+	if frame.Type != "registered" {
+		t.Fatalf("expected the registration to succeed, got %+v", frame)
+	}
+	client.serve(func(req testFrame, body []byte) testResponse {
+		return testResponse{status: http.StatusOK, chunks: [][]byte{[]byte("ok")}}
+	})
+
+	resp := accessRequest(t, srv, "app.example.com", func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-1") })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the visitor request to pass the policy, got %d", resp.StatusCode)
+	}
+	captures := s.Inspector().Captures(CaptureFilter{})
+	if len(captures) != 1 {
+		t.Fatalf("expected 1 capture, got %d", len(captures))
+	}
+	// the capture holds no credentials, comes from no network and the burst is spent
+	result, err := s.Replay(context.Background(), captures[0].ID, ReplayEdits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Replay.Status != http.StatusOK || string(result.Replay.ResponseBody) != "ok" {
+		t.Errorf("expected the replay to reach the client, got %d %q", result.Replay.Status, result.Replay.ResponseBody)
+	}
+	if resp := accessRequest(t, srv, "app.example.com", func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-1") }); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected visitors to stay rate limited, got %d", resp.StatusCode)
+	}
+}
+
+func TestInspectorStopsWhenRouteReleased(t *testing.T) {
+	s := New()
+	srv := httptest.NewServer(s.Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	for _, domain := range []string{"first.example.com", "second.example.com"} {
+		client.send(RegisterMessage{Type: "register", ID: domain, APIKey: "test", Domain: domain, Inspect: true}, nil)
+		if frame := client.next(); frame.Type != "registered" {
+			t.Fatalf("expected the registration to succeed, got %+v", frame)
+		}
+	}
+	if !s.Inspector().Enabled("first.example.com") || !s.Inspector().Enabled("second.example.com") {
+		t.Fatal("expected the registrations to turn capture mode on")
+	}
+
+	s.UnlinkDomain("first.example.com")
+	if s.Inspector().Enabled("first.example.com") {
+		t.Error("expected capture mode to stop when the domain is unlinked")
+	}
+	client.ws.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Inspector().Enabled("second.example.com") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.Inspector().Enabled("second.example.com") {
+		t.Error("expected capture mode to stop when the client disconnects")
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	tunnelInfoKey
+	replayOfKey
+)
+
+// Log attribute keys shared by every server log line
+const (
+	LogKeyRequestID = "request_id"
+	LogKeyClientID  = "client_id"
+	LogKeyDomain    = "domain"
+	LogKeyMessageID = "message_id"
+)
+
+// WithRequestID returns a copy of ctx carrying the given request id
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// RequestIDFromContext returns the request id stored in ctx, if any
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	requestID, ok := ctx.Value(requestIDKey).(string)
+	return requestID, ok
+}
+
+// TunnelInfo describes the tunnel that served a request
+type TunnelInfo struct {
+	// ClientID is the id of the tunnel client that served the request
+	ClientID string
+	// MessageID is the id of the request inside the tunnel
+	MessageID string
+}
+
+// WithTunnelInfo returns a copy of ctx carrying an empty TunnelInfo that the server fills when
+// the request is forwarded into a tunnel, so that outer middlewares can report it
+func WithTunnelInfo(ctx context.Context) (context.Context, *TunnelInfo) {
+	info := &TunnelInfo{}
+	return context.WithValue(ctx, tunnelInfoKey, info), info
+}
+
+// setTunnelInfo fills the TunnelInfo stored in ctx, if any
+func setTunnelInfo(ctx context.Context, clientID, messageID string) {
+	if info, ok := ctx.Value(tunnelInfoKey).(*TunnelInfo); ok {
+		info.ClientID = clientID
+		info.MessageID = messageID
+	}
+}
+
+// withReplayOf returns a copy of ctx marking the request as a replay of a capture
+func withReplayOf(ctx context.Context, captureID string) context.Context {
+	return context.WithValue(ctx, replayOfKey, captureID)
+}
+
+// replayOfFromContext returns the capture replayed by the request, if any
+func replayOfFromContext(ctx context.Context) string {
+	captureID, _ := ctx.Value(replayOfKey).(string)
+	return captureID
+}
+
+// requestLogger returns a logger annotated with the request id stored in ctx
+func requestLogger(ctx context.Context, logger *slog.Logger) *slog.Logger {
+	if requestID, ok := RequestIDFromContext(ctx); ok {
+		return logger.With(slog.String(LogKeyRequestID, requestID))
+	}
+	return logger
+}
+
+// messageLogger returns the logger of the ongoing request a frame belongs to, so that frames
+// handled in the tunnel loop log with the attributes of their request
+func (c *ServerConnState) messageLogger(messageID string) *slog.Logger {
+	if val, ok := c.OngoingRequests.Load(messageID); ok {
+		return val.(*RequestObject).logger
+	}
+	return c.Logger.With(slog.String(LogKeyMessageID, messageID))
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// lockedBuffer is a bytes.Buffer safe to write from the tunnel goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records returns the JSON log records written so far
+func (b *lockedBuffer) records(t *testing.T) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]any
+	scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for scanner.Scan() {
+		record := map[string]any{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestResponseFramesLogRequestAttributes(t *testing.T) {
+	logs := &lockedBuffer{}
+	s := New(WithLogger(slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+	routes := s.Routes()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), "req-1")))
+	}))
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	client.register("example.test")
+	client.serve(func(req testFrame, body []byte) testResponse {
+		return testResponse{status: http.StatusOK, chunks: [][]byte{[]byte("hello")}}
+	})
+
+	resp := tunnelRequest(t, srv, "example.test", "GET", "/", nil)
+	io.ReadAll(resp.Body)
+
+	seen := map[string]bool{}
+	for _, record := range logs.records(t) {
+		msg, _ := record["msg"].(string)
+		switch msg {
+		case "response started", "response data received", "response ended":
+		default:
+			continue
+		}
+		seen[msg] = true
+		if record[LogKeyRequestID] != "req-1" || record[LogKeyDomain] != "example.test" || record[LogKeyClientID] == nil || record[LogKeyMessageID] == nil {
+			t.Errorf("%q is missing the request attributes: %v", msg, record)
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("expected the response frames to be logged, got %v", seen)
+	}
+}
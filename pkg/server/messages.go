@@ -1,9 +1,15 @@
 package server
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
 )
 
 type noopData struct{}
@@ -14,12 +20,56 @@ func (noopData) Payload() []byte {
 
 func (noopData) WithPayload([]byte) {}
 
+// Tunnel protocols a client can register
+const (
+	ProtocolHTTP = "http"
+	ProtocolTCP  = "tcp"
+	ProtocolUDP  = "udp"
+)
+
+// responseQueueSize bounds the response bytes of a request waiting for its visitor to read them
+const responseQueueSize = 4 * 1024 * 1024
+
 type RequestObject struct {
-	ID               string
-	RequestObject    *http.Request
-	ResponseObject   http.ResponseWriter
+	ID             string
+	RequestObject  *http.Request
+	ResponseObject http.ResponseWriter
+	// ResponseBodyChan queues the response chunks, they are written to the visitor from a
+	// goroutine of the request so a visitor that stops reading does not hold the tunnel
 	ResponseBodyChan chan []byte
 	WebSocketChan    chan []byte
+	trace            *requestTrace
+	capture          *capture
+	// logger carries the request id, domain, client id and message id of the request
+	logger *slog.Logger
+	// trailers are the response trailers sent by the client along with data-end
+	trailers map[string]string
+	// queued counts the bytes of ResponseBodyChan
+	queued atomic.Int64
+	// ended is set once the client ended the response and ResponseBodyChan is closed
+	ended atomic.Bool
+}
+
+// queueResponse queues a response chunk for the visitor, returning false when the queue is full
+func (r *RequestObject) queueResponse(chunk []byte) bool {
+	if r.queued.Add(int64(len(chunk))) > responseQueueSize {
+		return false
+	}
+	select {
+	case r.ResponseBodyChan <- chunk:
+		return true
+	default:
+		return false
+	}
+}
+
+// endResponse closes ResponseBodyChan, returning false when the response was ended already
+func (r *RequestObject) endResponse() bool {
+	if !r.ended.CompareAndSwap(false, true) {
+		return false
+	}
+	close(r.ResponseBodyChan)
+	return true
 }
 
 type RegisterMessage struct {
@@ -28,6 +78,31 @@ type RegisterMessage struct {
 	Type   string `json:"type"` // should always be "register"
 	APIKey string `json:"apiKey"`
 	Domain string `json:"domain"`
+	// Subdomain requests a label under the server base domain when Domain is empty
+	Subdomain string `json:"subdomain,omitempty"`
+	// Inspect turns on the traffic inspector capture mode for the domain
+	Inspect bool `json:"inspect,omitempty"`
+	// PathPrefix limits the registration to the paths under it, it can also be given
+	// as part of Domain, e.g. api.example.com/v2
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	// StripPrefix removes the path prefix from the URL before it is forwarded
+	StripPrefix bool `json:"stripPrefix,omitempty"`
+	// Protocol is the kind of tunnel requested, http when empty
+	Protocol string `json:"protocol,omitempty"`
+	// Port requests a specific public port for tcp and udp tunnels, any free port of the range when zero
+	Port int `json:"port,omitempty"`
+	// Access restricts the visitors of an http tunnel, admins can replace it in the domain settings
+	Access *AccessPolicy `json:"access,omitempty"`
+}
+
+// CertificateMessage uploads a certificate for a domain linked to the client
+type CertificateMessage struct {
+	noopData
+	ID     string `json:"id"`
+	Type   string `json:"type"` // should always be "certificate"
+	Domain string `json:"domain"`
+	Cert   string `json:"cert"` // PEM encoded certificate chain
+	Key    string `json:"key"`  // PEM encoded private key
 }
 
 type ResponseStartMessage struct {
@@ -50,6 +125,41 @@ type DataEndMessage struct {
 	Type  string `json:"type"` // should always be "data-end"
 	ID    string `json:"id"`
 	Error any    `json:"error"`
+	// Trailers are written after the response body, e.g. grpc-status
+	Trailers map[string]string `json:"trailers,omitempty"`
+}
+
+// TCPDataMessage carries bytes of a TCP stream, it is sent by both sides
+type TCPDataMessage struct {
+	serverMessage
+	Type string `json:"type"` // should always be "tcp-data"
+	ID   string `json:"id"`
+	Data []byte `json:"-"`
+}
+
+// TCPCloseMessage closes a TCP stream, it is sent by both sides
+type TCPCloseMessage struct {
+	serverMessage
+	noopData
+	Type  string `json:"type"` // should always be "tcp-close"
+	ID    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// UDPDataMessage carries a datagram of a UDP session, it is sent by both sides
+type UDPDataMessage struct {
+	serverMessage
+	Type string `json:"type"` // should always be "udp-data"
+	ID   string `json:"id"`
+	Data []byte `json:"-"`
+}
+
+// UDPCloseMessage ends a UDP session, it is sent by both sides
+type UDPCloseMessage struct {
+	serverMessage
+	noopData
+	Type string `json:"type"` // should always be "udp-close"
+	ID   string `json:"id"`
 }
 
 type WSConnectionOpened struct {
@@ -92,6 +202,56 @@ func (c *DataMessage) WithPayload(data []byte) {
 	c.Chunk = data
 }
 
+func (c *TCPDataMessage) Payload() []byte {
+	return c.Data
+}
+
+func (c *TCPDataMessage) WithPayload(data []byte) {
+	c.Data = data
+}
+
+func (s TCPDataMessage) Handle(conn *ServerConnState) error {
+	stream, ok := conn.tcpStreams.Load(s.ID)
+	if !ok {
+		return fmt.Errorf("no tcp stream found for id %s", s.ID)
+	}
+	// writing here would stall every frame of the tunnel behind a visitor that stopped reading
+	if !stream.(*tcpStream).write(s.Data) && conn.closeTCPStream(s.ID) {
+		conn.Ch.Send(&TCPCloseMessage{Type: "tcp-close", ID: s.ID, Error: "visitor is not reading"})
+	}
+	return nil
+}
+
+func (s TCPCloseMessage) Handle(conn *ServerConnState) error {
+	conn.endTCPStream(s.ID)
+	return nil
+}
+
+func (c *UDPDataMessage) Payload() []byte {
+	return c.Data
+}
+
+func (c *UDPDataMessage) WithPayload(data []byte) {
+	c.Data = data
+}
+
+func (s UDPDataMessage) Handle(conn *ServerConnState) error {
+	val, ok := conn.udpSessions.Load(s.ID)
+	if !ok {
+		return fmt.Errorf("no udp session found for id %s", s.ID)
+	}
+	session := val.(*udpSession)
+	session.touch()
+	n, err := session.tunnel.pc.WriteTo(s.Data, session.peer)
+	conn.bytesOut.Add(int64(n))
+	return err
+}
+
+func (s UDPCloseMessage) Handle(conn *ServerConnState) error {
+	conn.closeUDPSession(s.ID)
+	return nil
+}
+
 func (WSMessage) Handle(conn *ServerConnState) error {
 	return nil
 }
@@ -102,14 +262,130 @@ func (WSConnectionOpened) Handle(conn *ServerConnState) error {
 	return nil
 }
 func (s RegisterMessage) Handle(conn *ServerConnState) error {
-	fmt.Printf("received register message %s %s %s\n", s.APIKey, s.Domain, s.ID)
-	conn.LinkHost(s.Domain)
-	return conn.Ch.Send(RegisteredMessage{
-		Type:   "registered",
-		Domain: s.Domain,
+	conn.Logger.Info("received register message",
+		slog.String(LogKeyDomain, s.Domain),
+		slog.String(LogKeyMessageID, s.ID),
+	)
+	if conn.server.draining.Load() {
+		err := fmt.Errorf("server is draining, connect to another instance")
+		conn.Ch.Send(&ErrorMessage{Type: "error", ID: s.ID, Message: err.Error()})
+		return err
+	}
+	policy := conn.server.policy.Load()
+	if err := conn.server.authorize(s.APIKey); err != nil {
+		conn.Ch.Send(&ErrorMessage{Type: "error", ID: s.ID, Message: err.Error()})
+		return err
+	}
+	access, err := conn.server.checkAccess(s.Access)
+	if err == nil && access != nil && s.Protocol != "" && s.Protocol != ProtocolHTTP {
+		err = fmt.Errorf("access policies only apply to http tunnels")
+	}
+	if err != nil {
+		err = fmt.Errorf("invalid access policy: %v", err)
+		conn.Ch.Send(&ErrorMessage{Type: "error", ID: s.ID, Message: err.Error()})
+		return err
+	}
+	switch s.Protocol {
+	case "", ProtocolHTTP:
+	case ProtocolTCP, ProtocolUDP:
+		if policy.MaxDomainsPerClient > 0 && conn.tunnels() >= policy.MaxDomainsPerClient {
+			err := fmt.Errorf("a client can open at most %d tunnels", policy.MaxDomainsPerClient)
+			conn.Ch.Send(&ErrorMessage{Type: "error", ID: s.ID, Message: err.Error()})
+			return err
+		}
+		register := conn.server.registerTCP
+		if s.Protocol == ProtocolUDP {
+			register = conn.server.registerUDP
+		}
+		port, err := register(conn, s.Port)
+		if err != nil {
+			conn.Ch.Send(&ErrorMessage{Type: "error", ID: s.ID, Message: err.Error()})
+			return err
+		}
+		return conn.Ch.Send(RegisteredMessage{Type: "registered", ID: s.ID, Protocol: s.Protocol, Port: port})
+	default:
+		err := fmt.Errorf("unsupported protocol %q", s.Protocol)
+		conn.Ch.Send(&ErrorMessage{Type: "error", ID: s.ID, Message: err.Error()})
+		return err
+	}
+	route, err := ParseRoute(s.Domain)
+	if err == nil && s.PathPrefix != "" {
+		route.PathPrefix, err = normalizePrefix(s.PathPrefix)
+	}
+	if err != nil {
+		conn.Ch.Send(&ErrorMessage{Type: "error", ID: s.ID, Message: err.Error()})
+		return err
+	}
+	s.Domain = route.Domain
+	route.Domain, err = conn.server.resolveDomain(conn, s)
+	var verificationErr *VerificationRequiredError
+	if errors.As(err, &verificationErr) {
+		conn.Ch.Send(&VerificationRequiredMessage{
+			Type:        "verification-required",
+			ID:          s.ID,
+			Domain:      verificationErr.Domain,
+			RecordName:  verificationErr.RecordName,
+			RecordValue: verificationErr.RecordValue,
+		})
+		return err
+	}
+	if err != nil {
+		conn.Ch.Send(&ErrorMessage{Type: "error", ID: s.ID, Message: err.Error()})
+		return err
+	}
+	if policy.MaxDomainsPerClient > 0 && conn.tunnels() >= policy.MaxDomainsPerClient && !slices.Contains(conn.Domains(), route.String()) {
+		err := fmt.Errorf("a client can open at most %d tunnels", policy.MaxDomainsPerClient)
+		conn.Ch.Send(&ErrorMessage{Type: "error", ID: s.ID, Message: err.Error()})
+		return err
+	}
+	conn.setStripPrefix(route.String(), s.StripPrefix)
+	conn.setAccess(route.String(), access)
+	if err := conn.LinkHost(route.String()); err != nil {
+		conn.Ch.Send(&ErrorMessage{Type: "error", ID: s.ID, Message: err.Error()})
+		return err
+	}
+	settings, err := conn.server.DomainSettings(route.Domain)
+	if err != nil {
+		conn.Logger.Warn("could not read the domain settings", slog.String(LogKeyDomain, route.Domain), "error", err)
+	}
+	if s.Inspect || settings.Inspect {
+		conn.server.opts.inspector.Enable(route.Domain)
+	}
+	registered := RegisteredMessage{
+		Type:       "registered",
+		Domain:     route.Domain,
+		PathPrefix: route.PathPrefix,
+		ID:         s.ID,
+	}
+	if key := conn.server.IdentityKey(); key != nil {
+		registered.IdentityKey = base64.StdEncoding.EncodeToString(key)
+	}
+	return conn.Ch.Send(registered)
+}
+func (s CertificateMessage) Handle(conn *ServerConnState) error {
+	certificates := conn.server.opts.certificates
+	err := func() error {
+		if certificates == nil {
+			return fmt.Errorf("certificate uploads are not enabled")
+		}
+		if !conn.holdsDomain(s.Domain) {
+			return fmt.Errorf("domain %s is not registered by this client", s.Domain)
+		}
+		_, err := certificates.put(s.Domain, conn.ClientID, []byte(s.Cert), []byte(s.Key))
+		return err
+	}()
+	if err != nil {
+		conn.Ch.Send(&ErrorMessage{Type: "error", ID: s.ID, Message: err.Error()})
+		return err
+	}
+	conn.Logger.Info("certificate uploaded", slog.String(LogKeyDomain, s.Domain), slog.String(LogKeyMessageID, s.ID))
+	return conn.Ch.Send(&CertificateAcceptedMessage{
+		Type:   "certificate-accepted",
 		ID:     s.ID,
+		Domain: s.Domain,
 	})
 }
+
 func (s ResponseStartMessage) Handle(conn *ServerConnState) error {
 	val, ok := conn.OngoingRequests.Load(s.ID)
 	if !ok {
@@ -120,7 +396,20 @@ func (s ResponseStartMessage) Handle(conn *ServerConnState) error {
 		req.ResponseObject.Header().Set(headerKey, headerValue)
 	}
 	req.ResponseObject.Header().Set("transfer-encoding", "chunked")
+	if isStreaming(req.ResponseObject.Header()) {
+		// streams outlive the server read and write timeouts, gRPC requests stream as well
+		controller := http.NewResponseController(req.ResponseObject)
+		controller.SetWriteDeadline(time.Time{})
+		controller.SetReadDeadline(time.Time{})
+	}
 	req.ResponseObject.WriteHeader(s.StatusCode)
+	req.logger.Debug("response started", "status", s.StatusCode)
+	if req.trace != nil {
+		req.trace.responseStarted(s.StatusCode)
+	}
+	if req.capture != nil {
+		req.capture.responseStarted(s.StatusCode, s.Headers)
+	}
 
 	return nil
 }
@@ -131,7 +420,16 @@ func (s DataMessage) Handle(conn *ServerConnState) error {
 		return fmt.Errorf("no ongoing request found for id %s", s.ID)
 	}
 	req := val.(*RequestObject)
-	req.ResponseBodyChan <- s.Chunk
+	if req.capture != nil {
+		req.capture.responseChunk(s.Chunk)
+	}
+	req.logger.Debug("response data received", "bytes", len(s.Chunk))
+	if !req.queueResponse(s.Chunk) {
+		// the visitor stopped reading, the blocked write is failed so the request ends
+		conn.OngoingRequests.Delete(s.ID)
+		http.NewResponseController(req.ResponseObject).SetWriteDeadline(time.Now())
+		return fmt.Errorf("visitor is not reading the response, the stream was reset")
+	}
 	return nil
 }
 
@@ -141,7 +439,19 @@ func (s DataEndMessage) Handle(conn *ServerConnState) error {
 		return fmt.Errorf("no ongoing request found for id %s", s.ID)
 	}
 	req := val.(*RequestObject)
-	close(req.ResponseBodyChan)
+	if req.trace != nil {
+		req.trace.responseEnded(s.Error)
+	}
+	if s.Error != nil {
+		req.logger.Warn("tunnel client ended the response with an error", "error", s.Error)
+	} else {
+		req.logger.Debug("response ended")
+	}
+	if req.ended.Load() {
+		return fmt.Errorf("response %s was ended already", s.ID)
+	}
+	req.trailers = s.Trailers
+	req.endResponse()
 	return nil
 }
 
@@ -161,6 +471,26 @@ func (s RegisterMessage) GetID() string {
 	return s.ID
 }
 
+func (s CertificateMessage) GetID() string {
+	return s.ID
+}
+
+func (s TCPDataMessage) GetID() string {
+	return s.ID
+}
+
+func (s TCPCloseMessage) GetID() string {
+	return s.ID
+}
+
+func (s UDPDataMessage) GetID() string {
+	return s.ID
+}
+
+func (s UDPCloseMessage) GetID() string {
+	return s.ID
+}
+
 func (s ResponseStartMessage) GetID() string {
 	return s.ID
 }
@@ -191,6 +521,12 @@ func UnmarshalClientMessage(data []byte) (ClientMessage, error) {
 			return nil, err
 		}
 		return msg, nil
+	case "certificate":
+		var msg CertificateMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
 	case "response-start":
 		var msg ResponseStartMessage
 		if err := json.Unmarshal(data, &msg); err != nil {
@@ -209,6 +545,30 @@ func UnmarshalClientMessage(data []byte) (ClientMessage, error) {
 			return nil, err
 		}
 		return msg, nil
+	case "tcp-data":
+		var msg TCPDataMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, err
+		}
+		return &msg, nil
+	case "tcp-close":
+		var msg TCPCloseMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	case "udp-data":
+		var msg UDPDataMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, err
+		}
+		return &msg, nil
+	case "udp-close":
+		var msg UDPCloseMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
 	case "ws-opened":
 		var msg WSConnectionOpened
 		if err := json.Unmarshal(data, &msg); err != nil {
@@ -247,6 +607,11 @@ type RequestStartMessage struct {
 	URL     string            `json:"url"`
 	Headers map[string]string `json:"headers"`
 	HasBody bool              `json:"hasBody"`
+	// Proto is the protocol version of the visitor request, e.g. HTTP/1.1 or HTTP/2.0
+	Proto string `json:"proto"`
+	// TraceParent and TraceState carry the W3C trace context of the edge request
+	TraceParent string `json:"traceparent,omitempty"`
+	TraceState  string `json:"tracestate,omitempty"`
 }
 
 type RequestDataEndMessage struct {
@@ -254,6 +619,8 @@ type RequestDataEndMessage struct {
 	noopData
 	Type string `json:"type"` // should always be "request-end"
 	ID   string `json:"id"`
+	// Trailers are the request trailers sent by the visitor after the body
+	Trailers map[string]string `json:"trailers,omitempty"`
 }
 
 func (c *RequestDataMessage) Payload() []byte {
@@ -290,14 +657,72 @@ func (p *RequestDataMessage) MarshalJSON() ([]byte, error) {
 type RegisteredMessage struct {
 	serverMessage
 	noopData
-	Type   string `json:"type"` // should always be "registered"
+	Type       string `json:"type"` // should always be "registered"
+	ID         string `json:"id"`
+	Domain     string `json:"domain"`
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	Protocol   string `json:"protocol,omitempty"`
+	// Port is the public port allocated to tcp and udp tunnels
+	Port int `json:"port,omitempty"`
+	// IdentityKey is the base64 ed25519 public key checking the IdentitySignatureHeader of the
+	// requests of visitors signed in through single sign-on
+	IdentityKey string `json:"identityKey,omitempty"`
+}
+
+// VerificationRequiredMessage tells the client which DNS TXT record proves it controls a domain
+type VerificationRequiredMessage struct {
+	serverMessage
+	noopData
+	Type        string `json:"type"` // should always be "verification-required"
+	ID          string `json:"id"`
+	Domain      string `json:"domain"`
+	RecordName  string `json:"recordName"`
+	RecordValue string `json:"recordValue"`
+}
+
+type CertificateAcceptedMessage struct {
+	serverMessage
+	noopData
+	Type   string `json:"type"` // should always be "certificate-accepted"
 	ID     string `json:"id"`
 	Domain string `json:"domain"`
 }
 
+// TCPOpenMessage tells the client a visitor connected to one of its TCP tunnel ports
+type TCPOpenMessage struct {
+	serverMessage
+	noopData
+	Type       string `json:"type"` // should always be "tcp-open"
+	ID         string `json:"id"`
+	Port       int    `json:"port"`
+	RemoteAddr string `json:"remoteAddr"`
+}
+
+// UDPOpenMessage tells the client a new peer sent datagrams to one of its UDP tunnel ports
+type UDPOpenMessage struct {
+	serverMessage
+	noopData
+	Type       string `json:"type"` // should always be "udp-open"
+	ID         string `json:"id"`
+	Port       int    `json:"port"`
+	RemoteAddr string `json:"remoteAddr"`
+}
+
+// ServerDrainingMessage tells the client the server is shutting down, it should connect to another
+// instance while the requests in flight finish
+type ServerDrainingMessage struct {
+	serverMessage
+	noopData
+	Type string `json:"type"` // should always be "server-draining"
+	// Deadline is when the remaining tunnels are closed, empty when the drain has no deadline
+	Deadline string `json:"deadline,omitempty"`
+}
+
 type ErrorMessage struct {
 	serverMessage
+	noopData
 	Type    string `json:"type"` // should always be "error"
+	ID      string `json:"id,omitempty"`
 	Message string `json:"message"`
 }
 
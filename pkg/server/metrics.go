@@ -0,0 +1,176 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "warp"
+
+// metrics is a struct to hold the prometheus collectors of a server
+type metrics struct {
+	registry        *prometheus.Registry
+	requestDuration *prometheus.HistogramVec
+	requestBytes    *prometheus.CounterVec
+	responseBytes   *prometheus.CounterVec
+	framesSent      *prometheus.CounterVec
+	framesReceived  *prometheus.CounterVec
+	serializerErrs  prometheus.Counter
+	chanCloses      *prometheus.CounterVec
+	// forwardedRequests counts the requests forwarded to the node holding their tunnel
+	forwardedRequests *prometheus.CounterVec
+}
+
+// newMetrics creates the server collectors and registers them into the given registry
+func newMetrics(s *Server, registry *prometheus.Registry) *metrics {
+	m := &metrics{
+		registry: registry,
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time spent serving tunneled requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"domain", "status"}),
+		requestBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_bytes_total",
+			Help:      "Request body bytes received from visitors and sent into tunnels.",
+		}, []string{"domain"}),
+		responseBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "response_bytes_total",
+			Help:      "Response body bytes received from tunnels and sent to visitors.",
+		}, []string{"domain"}),
+		framesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "frames_sent_total",
+			Help:      "Frames sent to tunnel clients by message type.",
+		}, []string{"type"}),
+		framesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "frames_received_total",
+			Help:      "Frames received from tunnel clients by message type.",
+		}, []string{"type"}),
+		serializerErrs: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "serializer_errors_total",
+			Help:      "Frames that could not be serialized or deserialized.",
+		}),
+		chanCloses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "channel_closes_total",
+			Help:      "Tunnel channel closes by reason.",
+		}, []string{"reason"}),
+		forwardedRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "forwarded_requests_total",
+			Help:      "Requests forwarded to the node holding their tunnel by node and status.",
+		}, []string{"node", "status"}),
+	}
+	registry.MustRegister(
+		m.requestDuration,
+		m.requestBytes,
+		m.responseBytes,
+		m.framesSent,
+		m.framesReceived,
+		m.serializerErrs,
+		m.chanCloses,
+		m.forwardedRequests,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "tunnels_connected",
+			Help:      "Number of connected tunnel clients.",
+		}, func() float64 {
+			return float64(countMap(&s.serverStates))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "domains_registered",
+			Help:      "Number of domains linked to a tunnel client.",
+		}, func() float64 {
+			return float64(countMap(&s.hostToClientID))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_in_flight",
+			Help:      "Number of requests waiting on a tunnel client.",
+		}, func() float64 {
+			total := 0
+			s.serverStates.Range(func(_, value any) bool {
+				total += countMap(&value.(*ServerConnState).OngoingRequests)
+				return true
+			})
+			return float64(total)
+		}),
+	)
+	return m
+}
+
+// handler returns the http handler that exposes the registry
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// observeRequest records the outcome of a tunneled request
+func (m *metrics) observeRequest(domain string, status int, took time.Duration, in, out int64) {
+	m.requestDuration.WithLabelValues(domain, strconv.Itoa(status)).Observe(took.Seconds())
+	m.requestBytes.WithLabelValues(domain).Add(float64(in))
+	m.responseBytes.WithLabelValues(domain).Add(float64(out))
+}
+
+// chanObserver returns a ChanObserver that feeds the frame metrics
+func (m *metrics) chanObserver() ChanObserver[ServerMessage, ClientMessage] {
+	return chanMetrics{m}
+}
+
+// chanMetrics is a ChanObserver that records frames into the server metrics
+type chanMetrics struct {
+	m *metrics
+}
+
+// Sent is a method to count sent frames
+func (c chanMetrics) Sent(msg ServerMessage, _ int) {
+	c.m.framesSent.WithLabelValues(messageType(msg)).Inc()
+}
+
+// Received is a method to count received frames
+func (c chanMetrics) Received(msg ClientMessage, _ int) {
+	c.m.framesReceived.WithLabelValues(messageType(msg)).Inc()
+}
+
+// SerializerError is a method to count serializer errors
+func (c chanMetrics) SerializerError(error) {
+	c.m.serializerErrs.Inc()
+}
+
+// Closed is a method to count channel closes
+func (c chanMetrics) Closed(reason string) {
+	c.m.chanCloses.WithLabelValues(reason).Inc()
+}
+
+// messageType returns the value of the Type field of a message
+func messageType(msg any) string {
+	v := reflect.Indirect(reflect.ValueOf(msg))
+	if v.Kind() == reflect.Struct {
+		if f := v.FieldByName("Type"); f.IsValid() && f.Kind() == reflect.String && f.String() != "" {
+			return f.String()
+		}
+	}
+	return "unknown"
+}
+
+// countMap returns the number of entries of a sync.Map
+func countMap(m *sync.Map) int {
+	count := 0
+	m.Range(func(_, _ any) bool {
+		count++
+		return true
+	})
+	return count
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Headers of the requests forwarded between the nodes of a cluster
+const (
+	// PeerTokenHeader carries the shared secret of the cluster
+	PeerTokenHeader = "X-Warp-Peer-Token"
+	// PeerRemoteAddrHeader carries the address of the visitor
+	PeerRemoteAddrHeader = "X-Warp-Peer-Remote-Addr"
+	// PeerSchemeHeader carries the scheme of the visitor request, http or https
+	PeerSchemeHeader = "X-Warp-Peer-Scheme"
+)
+
+// PeerOptions is a struct to hold the settings of the link between the nodes of a cluster
+type PeerOptions struct {
+	// AdvertiseURL is the URL the other nodes reach the peer handler of this node at, e.g. http://10.0.0.2:8002
+	AdvertiseURL string
+	// Secret authenticates the requests forwarded between nodes
+	Secret string
+}
+
+// WithPeers is an option to forward the requests of routes linked on other nodes to them and to
+// accept the requests they forward, the nodes must share the route registry
+func WithPeers(peers PeerOptions) ServerOption {
+	return func(o *ServerOpts) {
+		o.peers = &peers
+	}
+}
+
+// forwardedKey is the context key set on the requests received from another node
+type forwardedKey struct{}
+
+// peerSchemeKey is the context key of the visitor scheme of the requests received from another node
+type peerSchemeKey struct{}
+
+// peerTargetKey is the context key of the URL of the node a request is forwarded to
+type peerTargetKey struct{}
+
+// newPeerProxy creates the reverse proxy forwarding requests to other nodes over HTTP/2 without TLS,
+// so request and response bodies stream both ways and trailers are kept
+func (s *Server) newPeerProxy() *httputil.ReverseProxy {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(pr.In.Context().Value(peerTargetKey{}).(*url.URL))
+			// the owner node routes on the visitor host
+			pr.Out.Host = pr.In.Host
+			// the tunnel client gets the headers it would get from this node, the proxy drops these
+			for _, key := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "Forwarded"} {
+				if values, ok := pr.In.Header[key]; ok {
+					pr.Out.Header[key] = values
+				}
+			}
+			pr.Out.Header.Set(PeerTokenHeader, s.opts.peers.Secret)
+			pr.Out.Header.Set(PeerRemoteAddrHeader, pr.In.RemoteAddr)
+			pr.Out.Header.Set(PeerSchemeHeader, requestScheme(pr.In))
+		},
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+		// responses are written as the tunnel client sends them, e.g. Server-Sent Events
+		FlushInterval: -1,
+		ErrorLog:      slog.NewLogLogger(s.opts.logger.Handler(), slog.LevelDebug),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			s.opts.logger.Warn("could not forward request to the node of the tunnel", slog.String(LogKeyDomain, r.Host), "error", err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		},
+	}
+}
+
+// forwardToOwner forwards a request whose route is not linked on this node to the node of its
+// tunnel, returning false when no other node owns the route
+func (s *Server) forwardToOwner(w http.ResponseWriter, r *http.Request, logger *slog.Logger) bool {
+	// requests forwarded by a peer are never forwarded again, a stale registry would loop them
+	if s.peerProxy == nil || r.Context().Value(forwardedKey{}) != nil {
+		return false
+	}
+	owner, ok := s.lookupOwner(r.Context(), r.Host, r.URL.Path)
+	if !ok || owner.Node == s.opts.nodeID || owner.Addr == "" {
+		return false
+	}
+	target, err := url.Parse(owner.Addr)
+	if err != nil {
+		logger.Warn("invalid address of the node of the tunnel", "node", owner.Node, "error", err)
+		return false
+	}
+	logger.Debug("forwarding request to the node of the tunnel", "node", owner.Node)
+	rec := NewResponseRecorder(w)
+	s.peerProxy.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), peerTargetKey{}, target)))
+	s.metrics.forwardedRequests.WithLabelValues(owner.Node, strconv.Itoa(rec.Status())).Inc()
+	return true
+}
+
+// lookupOwner returns the owner in the registry of the route with the longest path prefix
+// matching the request, like lookupRoute does for the routes of this node
+func (s *Server) lookupOwner(ctx context.Context, host, requestPath string) (Owner, bool) {
+	prefix := path.Clean("/" + requestPath)
+	if prefix == "/" {
+		prefix = ""
+	}
+	for {
+		route := Route{Domain: host, PathPrefix: prefix}
+		owner, ok, err := s.opts.routeRegistry.Lookup(ctx, route.String())
+		if err != nil {
+			s.opts.logger.Warn("could not look the route up in the registry", slog.String(LogKeyDomain, route.String()), "error", err)
+			return Owner{}, false
+		}
+		if ok {
+			return owner, true
+		}
+		if prefix == "" {
+			return Owner{}, false
+		}
+		prefix = prefix[:strings.LastIndexByte(prefix, '/')]
+	}
+}
+
+// PeerRoutes is a method to return the handler of the requests forwarded by the other nodes,
+// it must only be reachable from the cluster network
+func (s *Server) PeerRoutes() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(PeerTokenHeader)
+		if s.opts.peers == nil || s.opts.peers.Secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.peers.Secret)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		r.Header.Del(PeerTokenHeader)
+		if remoteAddr := r.Header.Get(PeerRemoteAddrHeader); remoteAddr != "" {
+			r.RemoteAddr = remoteAddr
+			r.Header.Del(PeerRemoteAddrHeader)
+		}
+		ctx := context.WithValue(r.Context(), forwardedKey{}, true)
+		// the peer link is plain HTTP/2 whatever the visitor used
+		if scheme := r.Header.Get(PeerSchemeHeader); scheme == "http" || scheme == "https" {
+			ctx = context.WithValue(ctx, peerSchemeKey{}, scheme)
+		}
+		r.Header.Del(PeerSchemeHeader)
+		s.onRequest(w, r.WithContext(ctx))
+	})
+}
+
+// Validate is a method to check the advertised URL and the secret of the peer options
+func (p PeerOptions) Validate() error {
+	advertised, err := url.Parse(p.AdvertiseURL)
+	if err != nil || advertised.Scheme != "http" || advertised.Host == "" {
+		return fmt.Errorf("invalid advertise url %q, expected http://host:port", p.AdvertiseURL)
+	}
+	if p.Secret == "" {
+		return fmt.Errorf("a secret is required to forward requests between nodes")
+	}
+	return nil
+}
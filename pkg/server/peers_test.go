@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// clusterNode is a node of a test cluster with its visitor and peer listeners
+type clusterNode struct {
+	server  *Server
+	visitor *httptest.Server
+	peer    *httptest.Server
+}
+
+// startClusterNode starts a node sharing registry with the other nodes of a test cluster
+func startClusterNode(t *testing.T, registry Registry, nodeID, secret string) *clusterNode {
+	t.Helper()
+	node := &clusterNode{}
+	// the node needs the URL of its own peer listener before it is created
+	handler := http.NewServeMux()
+	node.peer = httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	t.Cleanup(node.peer.Close)
+	node.server = New(WithRouteRegistry(registry), WithNodeID(nodeID), WithPeers(PeerOptions{
+		AdvertiseURL: node.peer.URL,
+		Secret:       secret,
+	}))
+	handler.Handle("/", node.server.PeerRoutes())
+	node.visitor = httptest.NewServer(node.server.Routes())
+	t.Cleanup(node.visitor.Close)
+	return node
+}
+
+func TestForwardToOwnerNode(t *testing.T) {
+	registry := NewMemoryRegistry()
+	owner := startClusterNode(t, registry, "a", "cluster-secret")
+	entry := startClusterNode(t, registry, "b", "cluster-secret")
+
+	client := dialTestClient(t, owner.visitor)
+	client.register("app.example.com")
+	seen := make(chan testFrame, 1)
+	client.serve(func(req testFrame, body []byte) testResponse {
+		seen <- req
+		return testResponse{
+			status:   http.StatusCreated,
+			headers:  map[string]string{"X-Served-By": "a"},
+			chunks:   [][]byte{[]byte("got "), body},
+			trailers: map[string]string{"X-Checksum": "42"},
+		}
+	})
+
+	req, err := http.NewRequest(http.MethodPost, entry.visitor.URL+"/items?page=2", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "app.example.com"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated || string(body) != "got payload" || resp.Header.Get("X-Served-By") != "a" {
+		t.Errorf("expected the response of the tunnel on the other node, got %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	if resp.Trailer.Get("X-Checksum") != "42" {
+		t.Errorf("expected the trailers to be forwarded, got %v", resp.Trailer)
+	}
+
+	forwarded := <-seen
+	if forwarded.URL != "/items?page=2" || forwarded.Domain != "app.example.com" {
+		t.Errorf("expected the visitor URL and host, got %s %s", forwarded.Domain, forwarded.URL)
+	}
+	if forwarded.Headers[PeerTokenHeader] != "" || forwarded.Headers[PeerRemoteAddrHeader] != "" || forwarded.Headers[PeerSchemeHeader] != "" {
+		t.Errorf("expected the cluster headers to stay between the nodes, got %v", forwarded.Headers)
+	}
+	if forwarded.Headers["X-Forwarded-For"] != "203.0.113.7" {
+		t.Errorf("expected the visitor headers to be kept, got %v", forwarded.Headers)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, entry.visitor.URL+"/", nil)
+	req.Host = "unknown.example.com"
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected routes no node owns to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestPeerRoutesRequireSecret(t *testing.T) {
+	node := startClusterNode(t, NewMemoryRegistry(), "a", "cluster-secret")
+	client := dialTestClient(t, node.visitor)
+	client.register("app.example.com")
+
+	for _, token := range []string{"", "wrong"} {
+		req, _ := http.NewRequest(http.MethodGet, node.peer.URL+"/", nil)
+		req.Host = "app.example.com"
+		req.Header.Set(PeerTokenHeader, token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("token %q: got status %v want %v", token, resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestReplayStaysOnNode(t *testing.T) {
+	registry := NewMemoryRegistry()
+	owner := startClusterNode(t, registry, "a", "cluster-secret")
+	entry := startClusterNode(t, registry, "b", "cluster-secret")
+	entry.server.Inspector().Enable("app.example.com")
+	remote := dialTestClient(t, owner.visitor)
+	remote.register("app.example.com/api")
+	remote.serve(func(req testFrame, body []byte) testResponse {
+		return testResponse{status: http.StatusOK}
+	})
+	local := dialTestClient(t, entry.visitor)
+	local.register("app.example.com/web")
+	local.serve(func(req testFrame, body []byte) testResponse {
+		return testResponse{status: http.StatusOK}
+	})
+
+	resp := tunnelRequest(t, entry.visitor, "app.example.com", http.MethodGet, "/web/page", nil)
+	io.ReadAll(resp.Body)
+	captures := entry.server.Inspector().Captures(CaptureFilter{})
+	if len(captures) != 1 {
+		t.Fatalf("expected 1 capture, got %d", len(captures))
+	}
+	if result, err := entry.server.Replay(context.Background(), captures[0].ID, ReplayEdits{URL: "/web/other"}); err != nil || result.Replay.Status != http.StatusOK {
+		t.Errorf("expected the replay of a local route to be served, got %+v %v", result.Replay, err)
+	}
+	// the replay marker would be lost on the way to the other node
+	if _, err := entry.server.Replay(context.Background(), captures[0].ID, ReplayEdits{URL: "/api/items"}); !errors.Is(err, ErrNoTunnel) {
+		t.Errorf("expected the replay of a route of another node to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy is a struct to hold the rules applied to tunnel clients and visitors
+type Policy struct {
+	// APIKeys are the keys accepted in register messages, any key is accepted when empty
+	// unless RequireAPIKey is set
+	APIKeys []string
+	// RequireAPIKey only accepts APIKeys and the keys issued through the admin API, it is
+	// implied by APIKeys; issuing keys does not turn it on
+	RequireAPIKey bool
+	// AllowedDomains are patterns such as *.example.com of the domains clients can claim, any when empty
+	AllowedDomains []string
+	// DeniedDomains are patterns of the domains no client can claim
+	DeniedDomains []string
+	// MaxDomainsPerClient caps the routes and tcp and udp ports opened by a single client, zero for no limit
+	MaxDomainsPerClient int
+	// RateLimit is the number of requests per second accepted per domain, zero for no limit
+	RateLimit float64
+	// RateBurst is the number of requests accepted at once above the rate
+	RateBurst int
+}
+
+// Validate is a method to check the domain patterns and limits of the policy
+func (p Policy) Validate() error {
+	var errs []error
+	for _, pattern := range append(append([]string{}, p.AllowedDomains...), p.DeniedDomains...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid domain pattern %q", pattern))
+		}
+	}
+	if p.MaxDomainsPerClient < 0 {
+		errs = append(errs, fmt.Errorf("invalid max domains per client %d", p.MaxDomainsPerClient))
+	}
+	if p.RateLimit < 0 || p.RateBurst < 0 {
+		errs = append(errs, fmt.Errorf("invalid rate limit %v with burst %d", p.RateLimit, p.RateBurst))
+	}
+	return errors.Join(errs...)
+}
+
+// WithPolicy is an option to set the rules applied to tunnel clients and visitors
+func WithPolicy(policy Policy) ServerOption {
+	return func(o *ServerOpts) {
+		o.policy = policy
+	}
+}
+
+// SetPolicy is a method to replace the policy while the server runs, the connected clients
+// keep their tunnels and the new rules apply to the next registrations and requests
+func (s *Server) SetPolicy(policy Policy) {
+	s.policy.Store(&policy)
+}
+
+// Policy is a method to return the policy in use
+func (s *Server) Policy() Policy {
+	return *s.policy.Load()
+}
+
+// authorize checks the API key of a register message
+func (p *Policy) authorize(apiKey string) error {
+	if !p.requiresAPIKey() {
+		return nil
+	}
+	for _, key := range p.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid api key")
+}
+
+// requiresAPIKey returns whether register messages need a known API key
+func (p *Policy) requiresAPIKey() bool {
+	return p.RequireAPIKey || len(p.APIKeys) > 0
+}
+
+// allowsDomain checks a domain against the allowed and denied patterns
+func (p *Policy) allowsDomain(domain string) error {
+	domain = strings.ToLower(domain)
+	for _, pattern := range p.DeniedDomains {
+		if ok, _ := path.Match(strings.ToLower(pattern), domain); ok {
+			return fmt.Errorf("domain %s is not allowed", domain)
+		}
+	}
+	if len(p.AllowedDomains) == 0 {
+		return nil
+	}
+	for _, pattern := range p.AllowedDomains {
+		if ok, _ := path.Match(strings.ToLower(pattern), domain); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("domain %s is not allowed", domain)
+}
+
+// rateLimiter is a token bucket per domain
+type rateLimiter struct {
+	buckets sync.Map
+}
+
+// bucket is the token bucket of a domain
+type bucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from the bucket of a domain, the rate is given on every call so that
+// policy changes apply to the existing buckets
+func (l *rateLimiter) allow(domain string, rate float64, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+	capacity := math.Max(float64(burst), 1)
+	now := time.Now()
+	value, _ := l.buckets.LoadOrStore(domain, &bucket{tokens: capacity, last: now})
+	b := value.(*bucket)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPolicyRegistration(t *testing.T) {
+	srv := httptest.NewServer(New(WithPolicy(Policy{
+		APIKeys:             []string{"secret"},
+		AllowedDomains:      []string{"*.example.com"},
+		DeniedDomains:       []string{"admin.example.com"},
+		MaxDomainsPerClient: 1,
+	})).Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+
+	if frame := registerFrame(client, RegisterMessage{APIKey: "wrong", Domain: "app.example.com"}); frame.Type != "error" {
+		t.Errorf("expected an invalid api key to be rejected, got %q", frame.Type)
+	}
+	if frame := registerFrame(client, RegisterMessage{APIKey: "secret", Domain: "app.other.com"}); frame.Type != "error" {
+		t.Errorf("expected a domain outside of the allowed patterns to be rejected, got %q", frame.Type)
+	}
+	if frame := registerFrame(client, RegisterMessage{APIKey: "secret", Domain: "admin.example.com"}); frame.Type != "error" {
+		t.Errorf("expected a denied domain to be rejected, got %q", frame.Type)
+	}
+	if frame := registerFrame(client, RegisterMessage{APIKey: "secret", Domain: "app.example.com"}); frame.Type != "registered" {
+		t.Fatalf("expected an allowed domain to be registered, got %q: %s", frame.Type, frame.Message)
+	}
+	if frame := registerFrame(client, RegisterMessage{APIKey: "secret", Domain: "app.example.com"}); frame.Type != "registered" {
+		t.Errorf("expected registering a linked domain again to pass the limit, got %q: %s", frame.Type, frame.Message)
+	}
+	if frame := registerFrame(client, RegisterMessage{APIKey: "secret", Domain: "api.example.com"}); frame.Type != "error" {
+		t.Errorf("expected the domains per client limit to be enforced, got %q", frame.Type)
+	}
+}
+
+func TestPolicyRateLimit(t *testing.T) {
+	s := New(WithPolicy(Policy{RateLimit: 0.001, RateBurst: 2}))
+	srv := newTunnel(t, s, "limited.example.com", func(req testFrame, body []byte) testResponse {
+		return testResponse{status: http.StatusOK}
+	})
+	for i := 0; i < 2; i++ {
+		if resp := tunnelRequest(t, srv, "limited.example.com", http.MethodGet, "/", nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected the burst to be accepted, got %d", resp.StatusCode)
+		}
+	}
+	resp := tunnelRequest(t, srv, "limited.example.com", http.MethodGet, "/", nil)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("expected the request above the burst to be limited, got %d", resp.StatusCode)
+	}
+}
+
+func TestSetPolicyKeepsTunnels(t *testing.T) {
+	s := New(WithPolicy(Policy{APIKeys: []string{"old"}}))
+	srv := httptest.NewServer(s.Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	if frame := registerFrame(client, RegisterMessage{APIKey: "old", Domain: "rotated.example.com"}); frame.Type != "registered" {
+		t.Fatalf("expected the old key to be accepted, got %q: %s", frame.Type, frame.Message)
+	}
+
+	s.SetPolicy(Policy{APIKeys: []string{"new"}, RateLimit: 0.001, RateBurst: 1})
+	if frame := registerFrame(client, RegisterMessage{APIKey: "old", Domain: "other.example.com"}); frame.Type != "error" {
+		t.Errorf("expected the rotated key to be rejected, got %q", frame.Type)
+	}
+	if frame := registerFrame(client, RegisterMessage{APIKey: "new", Domain: "other.example.com"}); frame.Type != "registered" {
+		t.Errorf("expected the new key to be accepted, got %q: %s", frame.Type, frame.Message)
+	}
+	if _, ok := s.lookupRoute("rotated.example.com", "/"); !ok {
+		t.Error("expected the tunnel registered with the old key to stay linked")
+	}
+	if s.Policy().RateLimit != 0.001 {
+		t.Errorf("expected the new limits to be in use, got %+v", s.Policy())
+	}
+}
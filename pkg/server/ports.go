@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PortRange hands out the public ports of raw tunnels from a configured range
+type PortRange struct {
+	// Host is the address the allocated ports listen on, empty for all interfaces
+	Host  string
+	First int
+	Last  int
+
+	mu   sync.Mutex
+	used map[int]bool
+}
+
+// NewPortRange is a function to return a PortRange from first to last, both included
+func NewPortRange(host string, first, last int) (*PortRange, error) {
+	if first < 1 || last > 65535 || first > last {
+		return nil, fmt.Errorf("invalid port range %d-%d", first, last)
+	}
+	return &PortRange{Host: host, First: first, Last: last, used: map[int]bool{}}, nil
+}
+
+// ParsePortRange is a function to return a PortRange from a spec like 20000-20100 or 2222
+func ParsePortRange(host, spec string) (*PortRange, error) {
+	firstSpec, lastSpec, found := strings.Cut(spec, "-")
+	if !found {
+		lastSpec = firstSpec
+	}
+	first, err := strconv.Atoi(strings.TrimSpace(firstSpec))
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %q", spec)
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(lastSpec))
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %q", spec)
+	}
+	return NewPortRange(host, first, last)
+}
+
+// addr returns the listen address of a port
+func (p *PortRange) addr(port int) string {
+	return p.Host + ":" + strconv.Itoa(port)
+}
+
+// acquire binds the requested port, or the first free port of the range when zero,
+// marking it as used until it is released
+func (p *PortRange) acquire(requested int, bind func(addr string) error) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if requested != 0 {
+		if requested < p.First || requested > p.Last {
+			return 0, fmt.Errorf("port %d is outside of the range %d-%d", requested, p.First, p.Last)
+		}
+		if p.used[requested] {
+			return 0, fmt.Errorf("port %d is in use", requested)
+		}
+		if err := bind(p.addr(requested)); err != nil {
+			return 0, err
+		}
+		p.used[requested] = true
+		return requested, nil
+	}
+	for port := p.First; port <= p.Last; port++ {
+		if p.used[port] {
+			continue
+		}
+		// ports taken by other processes are skipped
+		if bind(p.addr(port)) == nil {
+			p.used[port] = true
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free port in the range %d-%d", p.First, p.Last)
+}
+
+// release makes a port available again
+func (p *PortRange) release(port int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.used, port)
+}
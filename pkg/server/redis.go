@@ -0,0 +1,324 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisTimeout bounds a registry command when the context has no deadline
+const redisTimeout = 5 * time.Second
+
+// redisGlob escapes the characters of a key that SCAN patterns match specially
+var redisGlob = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// redisRetries is how many times a watched transaction runs again after a concurrent change
+const redisRetries = 5
+
+// RedisOptions is a struct to hold the connection settings of a RedisRegistry
+type RedisOptions struct {
+	// Addr is the host:port of the server
+	Addr     string
+	Password string
+	DB       int
+	// KeyPrefix namespaces the registry keys, warp: when empty
+	KeyPrefix string
+}
+
+// RedisRegistry is a Registry kept in a server speaking the Redis protocol, the leases are
+// key expirations and the conditional updates are WATCH transactions
+type RedisRegistry struct {
+	opts RedisOptions
+	// mu serializes the commands on the connection, transactions hold it from WATCH to EXEC
+	mu   sync.Mutex
+	conn *respConn
+}
+
+// NewRedisRegistry is a function to create a registry on a Redis server, the connection is made
+// on the first command and made again after errors
+func NewRedisRegistry(opts RedisOptions) *RedisRegistry {
+	if opts.KeyPrefix == "" {
+		opts.KeyPrefix = "warp:"
+	}
+	return &RedisRegistry{opts: opts}
+}
+
+// Claim is a method to link a route to an owner, taking it over from any previous owner
+func (r *RedisRegistry) Claim(ctx context.Context, route string, owner Owner, ttl time.Duration) error {
+	value, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.do(ctx, "SET", r.key(route), string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+// Renew is a method to extend the lease of a route, claiming it again when it expired
+func (r *RedisRegistry) Renew(ctx context.Context, route string, owner Owner, ttl time.Duration) (bool, error) {
+	value, err := json.Marshal(owner)
+	if err != nil {
+		return false, err
+	}
+	key := r.key(route)
+	return r.watch(ctx, key, func(current []byte) []string {
+		if current != nil && string(current) != string(value) {
+			return nil
+		}
+		return []string{"SET", key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10)}
+	})
+}
+
+// Release is a method to unlink a route still held by the owner
+func (r *RedisRegistry) Release(ctx context.Context, route string, owner Owner) error {
+	value, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	key := r.key(route)
+	_, err = r.watch(ctx, key, func(current []byte) []string {
+		if string(current) != string(value) {
+			return nil
+		}
+		return []string{"DEL", key}
+	})
+	return err
+}
+
+// Lookup is a method to return the owner of a route
+func (r *RedisRegistry) Lookup(ctx context.Context, route string) (Owner, bool, error) {
+	r.mu.Lock()
+	reply, err := r.do(ctx, "GET", r.key(route))
+	r.mu.Unlock()
+	if err != nil || reply == nil {
+		return Owner{}, false, err
+	}
+	var owner Owner
+	if err := json.Unmarshal(reply.([]byte), &owner); err != nil {
+		return Owner{}, false, fmt.Errorf("invalid owner of route %s: %v", route, err)
+	}
+	return owner, true, nil
+}
+
+// Owners is a method to return the owners of the routes of a domain, the routes with a path
+// prefix are found with SCAN
+func (r *RedisRegistry) Owners(ctx context.Context, domain string) ([]Owner, error) {
+	routes := []string{domain}
+	pattern := redisGlob.Replace(r.key(domain)) + "/*"
+	r.mu.Lock()
+	for cursor := "0"; ; {
+		reply, err := r.do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			r.mu.Unlock()
+			return nil, err
+		}
+		page, _ := reply.([]any)
+		if len(page) != 2 {
+			r.mu.Unlock()
+			return nil, fmt.Errorf("invalid reply to SCAN")
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]any)
+		for _, key := range keys {
+			if key, ok := key.([]byte); ok {
+				routes = append(routes, strings.TrimPrefix(string(key), r.key("")))
+			}
+		}
+		if cursor = string(next); cursor == "0" {
+			break
+		}
+	}
+	r.mu.Unlock()
+	owners := []Owner{}
+	for _, route := range routes {
+		owner, ok, err := r.Lookup(ctx, route)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			owners = append(owners, owner)
+		}
+	}
+	return owners, nil
+}
+
+// key returns the key holding the owner of a route
+func (r *RedisRegistry) key(route string) string {
+	return r.opts.KeyPrefix + "route:" + route
+}
+
+// watch runs the command returned by update in a transaction that fails when the key changed
+// since update read it, update returns nil to leave the key alone. It returns whether the
+// command ran.
+func (r *RedisRegistry) watch(ctx context.Context, key string, update func(current []byte) []string) (applied bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer func() {
+		// a failed transaction may leave the connection watching or queueing commands
+		if err != nil && r.conn != nil {
+			r.conn.Close()
+			r.conn = nil
+		}
+	}()
+	for i := 0; i < redisRetries; i++ {
+		if _, err := r.do(ctx, "WATCH", key); err != nil {
+			return false, err
+		}
+		current, err := r.do(ctx, "GET", key)
+		if err != nil {
+			return false, err
+		}
+		currentValue, _ := current.([]byte)
+		command := update(currentValue)
+		if command == nil {
+			_, err := r.do(ctx, "UNWATCH")
+			return false, err
+		}
+		if _, err := r.do(ctx, "MULTI"); err != nil {
+			return false, err
+		}
+		if _, err := r.do(ctx, command...); err != nil {
+			return false, err
+		}
+		replies, err := r.do(ctx, "EXEC")
+		if err != nil {
+			return false, err
+		}
+		// a nil reply means the key changed and the transaction was discarded
+		if replies != nil {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("key %s keeps changing", key)
+}
+
+// do sends a command and reads its reply, dialing first when needed. The connection is
+// dropped after network errors so that the next command dials again. r.mu must be held.
+func (r *RedisRegistry) do(ctx context.Context, args ...string) (any, error) {
+	if r.conn == nil {
+		conn, err := r.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		r.conn = conn
+	}
+	reply, err := r.conn.do(ctx, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		r.conn.Close()
+		r.conn = nil
+	}
+	return reply, err
+}
+
+// dial connects to the server, authenticating and selecting the database
+func (r *RedisRegistry) dial(ctx context.Context) (*respConn, error) {
+	dialer := net.Dialer{Timeout: redisTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", r.opts.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to the registry: %v", err)
+	}
+	conn := &respConn{Conn: netConn, reader: bufio.NewReader(netConn)}
+	if r.opts.Password != "" {
+		if _, err := conn.do(ctx, "AUTH", r.opts.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.opts.DB != 0 {
+		if _, err := conn.do(ctx, "SELECT", strconv.Itoa(r.opts.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "registry: " + string(e)
+}
+
+// respConn is a connection speaking the Redis serialization protocol
+type respConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// do writes a command as an array of bulk strings and reads the reply
+func (c *respConn) do(ctx context.Context, args ...string) (any, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisTimeout)
+	}
+	c.SetDeadline(deadline)
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return readReply(c.reader)
+}
+
+// readReply reads a reply: simple strings and bulk strings as []byte, integers as int64,
+// arrays as []any and the null bulk string or array as nil
+func readReply(reader *bufio.Reader) (any, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid reply %q", line)
+	}
+	kind, content := line[0], string(line[1:len(line)-2])
+	switch kind {
+	case '+':
+		return []byte(content), nil
+	case '-':
+		return nil, redisError(content)
+	case ':':
+		return strconv.ParseInt(content, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(content)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		size, err := strconv.Atoi(content)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		items := make([]any, size)
+		for i := range items {
+			item, err := readReply(reader)
+			var replyErr redisError
+			if err != nil && !errors.As(err, &replyErr) {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("invalid reply %q", line)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// resolveDomain returns the domain a register message claims, allocating a subdomain of
+// the base domain when the client did not pick one
+func (s *Server) resolveDomain(conn *ServerConnState, msg RegisterMessage) (string, error) {
+	account := accountID(msg.APIKey)
+	subdomains := s.opts.subdomains
+	if subdomains != nil {
+		// every client without an API key would share the account of the empty key
+		owner := account
+		if msg.APIKey == "" {
+			owner = ""
+		}
+		if msg.Domain == "" {
+			return subdomains.Allocate(owner, msg.Subdomain, func(domain string) bool {
+				return s.subdomainTaken(conn, domain)
+			})
+		}
+		if label, ok := subdomains.Label(msg.Domain); ok {
+			if !subdomains.Allowed(owner, label) {
+				return "", fmt.Errorf("subdomain %q is reserved", label)
+			}
+			if s.subdomainTaken(conn, msg.Domain) {
+				return "", fmt.Errorf("subdomain %q is in use", label)
+			}
+			// subdomains of the base domain belong to the server, there is nothing to verify
+			return msg.Domain, nil
+		}
+	}
+	if msg.Domain == "" {
+		return "", fmt.Errorf("a domain is required")
+	}
+	if err := s.policy.Load().allowsDomain(msg.Domain); err != nil {
+		return "", err
+	}
+	if s.opts.verifier != nil {
+		if err := s.opts.verifier.Verify(context.Background(), account, msg.Domain); err != nil {
+			return "", err
+		}
+	}
+	return msg.Domain, nil
+}
+
+// subdomainTaken returns whether another client holds a route of a subdomain of the base domain,
+// the subdomains linked on the other nodes of the cluster are taken as well
+func (s *Server) subdomainTaken(conn *ServerConnState, domain string) bool {
+	owners, err := s.opts.routeRegistry.Owners(context.Background(), domain)
+	if err != nil {
+		return true
+	}
+	for _, owner := range owners {
+		if owner.ClientID != conn.ClientID {
+			return true
+		}
+	}
+	taken := false
+	s.hostToClientID.Range(func(key, clientID any) bool {
+		route, err := ParseRoute(key.(string))
+		taken = err == nil && strings.EqualFold(route.Domain, domain) && clientID != conn.ClientID
+		return !taken
+	})
+	return taken
+}
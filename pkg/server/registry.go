@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultLeaseTTL is how long a route stays claimed by a node that stopped renewing it
+const DefaultLeaseTTL = 30 * time.Second
+
+// Owner is a struct to identify the tunnel client serving a route and the node it is connected to
+type Owner struct {
+	Node     string `json:"node"`
+	ClientID string `json:"clientId"`
+	// Addr is the URL the requests of the route are forwarded to, empty when the node does not accept them
+	Addr string `json:"addr,omitempty"`
+}
+
+// Registry is an interface for the ownership of routes shared by the nodes of a cluster, every
+// claim is a lease that expires unless the owner renews it so the routes of a crashed node
+// are released
+type Registry interface {
+	// Claim links a route to an owner for the lease duration, taking it over from any previous owner
+	Claim(ctx context.Context, route string, owner Owner, ttl time.Duration) error
+	// Renew extends the lease of a route, it returns false when another owner took the route over
+	Renew(ctx context.Context, route string, owner Owner, ttl time.Duration) (bool, error)
+	// Release unlinks a route when it is still held by the owner
+	Release(ctx context.Context, route string, owner Owner) error
+	// Lookup returns the owner of a route whose lease did not expire
+	Lookup(ctx context.Context, route string) (Owner, bool, error)
+	// Owners returns the owners of the live routes of a domain, with or without a path prefix
+	Owners(ctx context.Context, domain string) ([]Owner, error)
+}
+
+// NewRegistry is a function to create the registry described by a URL: memory for a single node
+// or redis://[:password@]host:port[/db] for a cluster
+func NewRegistry(rawURL string) (Registry, error) {
+	if rawURL == "" || rawURL == "memory" {
+		return NewMemoryRegistry(), nil
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry url: %v", err)
+	}
+	if parsed.Scheme != "redis" || parsed.Host == "" {
+		return nil, fmt.Errorf("unsupported registry %q, expected memory or redis://host:port", parsed.Redacted())
+	}
+	opts := RedisOptions{Addr: parsed.Host}
+	if !strings.Contains(opts.Addr, ":") {
+		opts.Addr += ":6379"
+	}
+	if parsed.User != nil {
+		opts.Password, _ = parsed.User.Password()
+	}
+	if db := strings.Trim(parsed.Path, "/"); db != "" {
+		if opts.DB, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid registry database %q", db)
+		}
+	}
+	return NewRedisRegistry(opts), nil
+}
+
+// lease is a route claimed in the memory registry
+type lease struct {
+	owner   Owner
+	expires time.Time
+}
+
+// MemoryRegistry is a Registry kept in the process, it only serves a single node
+type MemoryRegistry struct {
+	mu     sync.Mutex
+	leases map[string]lease
+	now    func() time.Time
+}
+
+// NewMemoryRegistry is a function to create an empty in-process registry
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{leases: map[string]lease{}, now: time.Now}
+}
+
+// Claim is a method to link a route to an owner, taking it over from any previous owner
+func (r *MemoryRegistry) Claim(_ context.Context, route string, owner Owner, ttl time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.leases[route] = lease{owner: owner, expires: r.now().Add(ttl)}
+	return nil
+}
+
+// Renew is a method to extend the lease of a route, claiming it again when it expired
+func (r *MemoryRegistry) Renew(_ context.Context, route string, owner Owner, ttl time.Duration) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if current, ok := r.live(route); ok && current.owner != owner {
+		return false, nil
+	}
+	r.leases[route] = lease{owner: owner, expires: r.now().Add(ttl)}
+	return true, nil
+}
+
+// Release is a method to unlink a route still held by the owner
+func (r *MemoryRegistry) Release(_ context.Context, route string, owner Owner) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if current, ok := r.leases[route]; ok && current.owner == owner {
+		delete(r.leases, route)
+	}
+	return nil
+}
+
+// Lookup is a method to return the owner of a route
+func (r *MemoryRegistry) Lookup(_ context.Context, route string) (Owner, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current, ok := r.live(route)
+	return current.owner, ok, nil
+}
+
+// Owners is a method to return the owners of the routes of a domain
+func (r *MemoryRegistry) Owners(_ context.Context, domain string) ([]Owner, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	owners := []Owner{}
+	for key := range r.leases {
+		route, err := ParseRoute(key)
+		if err != nil || !strings.EqualFold(route.Domain, domain) {
+			continue
+		}
+		if current, ok := r.live(key); ok {
+			owners = append(owners, current.owner)
+		}
+	}
+	return owners, nil
+}
+
+// live returns the lease of a route unless it expired, expired leases are dropped
+func (r *MemoryRegistry) live(route string) (lease, bool) {
+	current, ok := r.leases[route]
+	if ok && !r.now().Before(current.expires) {
+		delete(r.leases, route)
+		return lease{}, false
+	}
+	return current, ok
+}
+
+// defaultNodeID returns the host name, or a random id when it is unknown
+func defaultNodeID() string {
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return uuid.NewString()
+}
+
+// owner returns the registry owner of the routes linked to the client
+func (c *ServerConnState) owner() Owner {
+	owner := Owner{Node: c.server.opts.nodeID, ClientID: c.ClientID}
+	if c.server.opts.peers != nil {
+		owner.Addr = c.server.opts.peers.AdvertiseURL
+	}
+	return owner
+}
+
+// renewLeases keeps the routes of the client claimed until ctx is done, the routes another
+// client took over are unlinked
+func (c *ServerConnState) renewLeases(ctx context.Context) {
+	registry, ttl := c.server.opts.routeRegistry, c.server.opts.leaseTTL
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, route := range c.Domains() {
+			owned, err := registry.Renew(ctx, route, c.owner(), ttl)
+			if err != nil {
+				c.Logger.Warn("could not renew the route lease", slog.String(LogKeyDomain, route), "error", err)
+				continue
+			}
+			if owned {
+				continue
+			}
+			c.Logger.Info("route claimed by another client", slog.String(LogKeyDomain, route))
+			c.removeHost(route)
+			c.server.hostToClientID.CompareAndDelete(route, c.ClientID)
+			c.server.routeReleased(route)
+			c.Ch.Send(&ErrorMessage{Type: "error", Message: fmt.Sprintf("route %s was claimed by another client", route)})
+		}
+	}
+}
+
+// releaseRoutes unlinks the routes of a disconnected client, locally and in the registry
+func (c *ServerConnState) releaseRoutes() {
+	for _, route := range c.Domains() {
+		c.removeHost(route)
+		c.server.hostToClientID.CompareAndDelete(route, c.ClientID)
+		c.server.routeReleased(route)
+		if err := c.server.opts.routeRegistry.Release(context.Background(), route, c.owner()); err != nil {
+			c.Logger.Warn("could not release the route", slog.String(LogKeyDomain, route), "error", err)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a stand-in for a Redis server implementing the commands of the registry,
+// its clock only moves when advance is called
+type fakeRedis struct {
+	addr     string
+	password string
+
+	mu       sync.Mutex
+	now      time.Time
+	values   map[string]string
+	expires  map[string]time.Time
+	versions map[string]int
+}
+
+// startFakeRedis listens on a local port until the test ends
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	f := &fakeRedis{
+		addr:     listener.Addr().String(),
+		password: password,
+		now:      time.Now(),
+		values:   map[string]string{},
+		expires:  map[string]time.Time{},
+		versions: map[string]int{},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// advance moves the clock of the keys expiration
+func (f *fakeRedis) advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// serve answers the commands of a connection, keeping its authentication and transaction state
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := f.password == ""
+	var watched map[string]int
+	var queued [][]string
+	for {
+		request, err := readReply(reader)
+		if err != nil {
+			return
+		}
+		items, _ := request.([]any)
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i] = string(item.([]byte))
+		}
+		if len(args) == 0 {
+			return
+		}
+		command := strings.ToUpper(args[0])
+		var reply string
+		switch {
+		case command == "AUTH":
+			authenticated = len(args) == 2 && args[1] == f.password
+			reply = "+OK\r\n"
+			if !authenticated {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required\r\n"
+		case command == "WATCH":
+			f.mu.Lock()
+			if watched == nil {
+				watched = map[string]int{}
+			}
+			for _, key := range args[1:] {
+				f.expire(key)
+				watched[key] = f.versions[key]
+			}
+			f.mu.Unlock()
+			reply = "+OK\r\n"
+		case command == "UNWATCH":
+			watched = nil
+			reply = "+OK\r\n"
+		case command == "MULTI":
+			queued = [][]string{}
+			reply = "+OK\r\n"
+		case command == "EXEC":
+			f.mu.Lock()
+			changed := false
+			for key, version := range watched {
+				f.expire(key)
+				changed = changed || f.versions[key] != version
+			}
+			if changed {
+				reply = "*-1\r\n"
+			} else {
+				reply = "*" + strconv.Itoa(len(queued)) + "\r\n"
+				for _, queuedArgs := range queued {
+					reply += f.run(queuedArgs)
+				}
+			}
+			f.mu.Unlock()
+			watched, queued = nil, nil
+		case queued != nil:
+			queued = append(queued, args)
+			reply = "+QUEUED\r\n"
+		default:
+			f.mu.Lock()
+			reply = f.run(args)
+			f.mu.Unlock()
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// run executes a data command, f.mu must be held
+func (f *fakeRedis) run(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		f.expire(args[1])
+		value, ok := f.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "SET":
+		f.values[args[1]] = args[2]
+		delete(f.expires, args[1])
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			f.expires[args[1]] = f.now.Add(time.Duration(ms) * time.Millisecond)
+		}
+		f.versions[args[1]]++
+		return "+OK\r\n"
+	case "SCAN":
+		// a single page of the keys matching a prefix pattern such as warp:route:app.example.com/*
+		prefix := strings.TrimSuffix(args[3], "*")
+		keys := []string{}
+		for key := range f.values {
+			f.expire(key)
+			if _, ok := f.values[key]; ok && strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		reply := "*2\r\n$1\r\n0\r\n*" + strconv.Itoa(len(keys)) + "\r\n"
+		for _, key := range keys {
+			reply += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+		}
+		return reply
+	case "DEL":
+		f.expire(args[1])
+		if _, ok := f.values[args[1]]; !ok {
+			return ":0\r\n"
+		}
+		delete(f.values, args[1])
+		delete(f.expires, args[1])
+		f.versions[args[1]]++
+		return ":1\r\n"
+	default:
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
+
+// expire drops a key whose expiration passed, f.mu must be held
+func (f *fakeRedis) expire(key string) {
+	if expires, ok := f.expires[key]; ok && !f.now.Before(expires) {
+		delete(f.values, key)
+		delete(f.expires, key)
+		f.versions[key]++
+	}
+}
+
+func TestRegistries(t *testing.T) {
+	for name, newRegistry := range map[string]func(t *testing.T) (Registry, func(time.Duration)){
+		"memory": func(t *testing.T) (Registry, func(time.Duration)) {
+			registry := NewMemoryRegistry()
+			now := time.Now()
+			registry.now = func() time.Time { return now }
+			return registry, func(d time.Duration) { now = now.Add(d) }
+		},
+		"redis": func(t *testing.T) (Registry, func(time.Duration)) {
+			fake := startFakeRedis(t, "secret")
+			registry, err := NewRegistry("redis://:secret@" + fake.addr + "/1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return registry, fake.advance
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			registry, advance := newRegistry(t)
+			ctx := context.Background()
+			nodeA := Owner{Node: "a", ClientID: "client-a"}
+			nodeB := Owner{Node: "b", ClientID: "client-b"}
+
+			if _, ok, err := registry.Lookup(ctx, "app.example.com"); ok || err != nil {
+				t.Fatalf("expected an empty registry, got %v %v", ok, err)
+			}
+			if err := registry.Claim(ctx, "app.example.com", nodeA, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if owner, ok, err := registry.Lookup(ctx, "app.example.com"); !ok || err != nil || owner != nodeA {
+				t.Errorf("expected node a to own the route, got %+v %v %v", owner, ok, err)
+			}
+
+			if err := registry.Claim(ctx, "app.example.com", nodeB, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if owned, err := registry.Renew(ctx, "app.example.com", nodeA, time.Minute); owned || err != nil {
+				t.Errorf("expected the taken over route not to be renewed, got %v %v", owned, err)
+			}
+			if err := registry.Release(ctx, "app.example.com", nodeA); err != nil {
+				t.Fatal(err)
+			}
+			if owner, _, _ := registry.Lookup(ctx, "app.example.com"); owner != nodeB {
+				t.Errorf("expected the release of a former owner to be ignored, got %+v", owner)
+			}
+
+			advance(30 * time.Second)
+			if owned, err := registry.Renew(ctx, "app.example.com", nodeB, time.Minute); !owned || err != nil {
+				t.Errorf("expected the owner to renew its lease, got %v %v", owned, err)
+			}
+			advance(45 * time.Second)
+			if _, ok, _ := registry.Lookup(ctx, "app.example.com"); !ok {
+				t.Error("expected the renewed lease to be alive")
+			}
+			advance(30 * time.Second)
+			if _, ok, _ := registry.Lookup(ctx, "app.example.com"); ok {
+				t.Error("expected the route of a node that stopped renewing to be released")
+			}
+			if owned, err := registry.Renew(ctx, "app.example.com", nodeA, time.Minute); !owned || err != nil {
+				t.Errorf("expected an expired route to be claimed again, got %v %v", owned, err)
+			}
+			if err := registry.Release(ctx, "app.example.com", nodeA); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok, _ := registry.Lookup(ctx, "app.example.com"); ok {
+				t.Error("expected the released route to be unlinked")
+			}
+
+			for _, route := range []string{"app.example.com/api", "app.example.com/api/v2", "app.example.community"} {
+				if err := registry.Claim(ctx, route, nodeB, time.Minute); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if owners, err := registry.Owners(ctx, "app.example.com"); err != nil || len(owners) != 2 || owners[0] != nodeB || owners[1] != nodeB {
+				t.Errorf("expected the owners of the prefix routes of the domain, got %+v %v", owners, err)
+			}
+			advance(2 * time.Minute)
+			if owners, err := registry.Owners(ctx, "app.example.com"); err != nil || len(owners) != 0 {
+				t.Errorf("expected expired routes to have no owner, got %+v %v", owners, err)
+			}
+		})
+	}
+}
+
+func TestRegistryURL(t *testing.T) {
+	for _, invalid := range []string{"etcd://localhost", "redis://", "redis://localhost/db"} {
+		if _, err := NewRegistry(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+	registry, err := NewRegistry("redis://:pass@localhost/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts := registry.(*RedisRegistry).opts; opts.Addr != "localhost:6379" || opts.Password != "pass" || opts.DB != 2 {
+		t.Errorf("unexpected redis options %+v", opts)
+	}
+}
+
+func TestClusterTakeover(t *testing.T) {
+	registry := NewRedisRegistry(RedisOptions{Addr: startFakeRedis(t, "").addr})
+	nodeA := New(WithRouteRegistry(registry), WithNodeID("a"), WithLeaseTTL(150*time.Millisecond))
+	nodeB := New(WithRouteRegistry(registry), WithNodeID("b"), WithLeaseTTL(150*time.Millisecond))
+	srvA, srvB := httptest.NewServer(nodeA.Routes()), httptest.NewServer(nodeB.Routes())
+	t.Cleanup(srvA.Close)
+	t.Cleanup(srvB.Close)
+
+	clientA := dialTestClient(t, srvA)
+	clientA.register("shared.example.com")
+	clientB := dialTestClient(t, srvB)
+	clientB.register("shared.example.com")
+
+	frame := clientA.next()
+	if frame.Type != "error" || !strings.Contains(frame.Message, "shared.example.com") {
+		t.Errorf("expected the first client to be told it lost the route, got %q: %s", frame.Type, frame.Message)
+	}
+	if _, ok := nodeA.lookupRoute("shared.example.com", "/"); ok {
+		t.Error("expected the route to be unlinked from the first node")
+	}
+	if _, ok := nodeB.lookupRoute("shared.example.com", "/"); !ok {
+		t.Error("expected the route to stay linked on the second node")
+	}
+	owner, ok, err := registry.Lookup(context.Background(), "shared.example.com")
+	if !ok || err != nil || owner.Node != "b" {
+		t.Errorf("expected the second node to own the route, got %+v %v %v", owner, ok, err)
+	}
+
+	clientB.ws.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for ok && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		_, ok, _ = registry.Lookup(context.Background(), "shared.example.com")
+	}
+	if ok {
+		t.Error("expected the route to be released when its client disconnected")
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// replayTimeout bounds how long a replayed request may wait for the tunnel client
+	replayTimeout = 60 * time.Second
+	// ReplaySubject is the identity subject of replays of requests captured without a visitor identity
+	ReplaySubject = "warp:replay"
+)
+
+// Replay errors
+var (
+	ErrCaptureNotFound  = errors.New("capture not found")
+	ErrCaptureTruncated = errors.New("captured request body was truncated, provide a body to replay it")
+	ErrNoTunnel         = errors.New("domain has no tunnel client connected to this node")
+)
+
+// ReplayEdits is a struct to hold the changes applied to a captured request before replaying it
+type ReplayEdits struct {
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"`
+	// Headers replaces the given request headers, an empty value removes the header
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body replaces the request body when set
+	Body []byte `json:"body,omitempty"`
+}
+
+// ReplayResult is a struct to hold a captured exchange next to its replay
+type ReplayResult struct {
+	Original Capture `json:"original"`
+	Replay   Capture `json:"replay"`
+}
+
+// Replay sends a captured request, with edits applied, to the current tunnel client of its domain
+func (s *Server) Replay(ctx context.Context, captureID string, edits ReplayEdits) (ReplayResult, error) {
+	original, ok := s.opts.inspector.Capture(captureID)
+	if !ok {
+		return ReplayResult{}, ErrCaptureNotFound
+	}
+	if original.RequestTruncated && edits.Body == nil {
+		return ReplayResult{}, ErrCaptureTruncated
+	}
+	if !s.hasHost(original.Domain) {
+		return ReplayResult{}, ErrNoTunnel
+	}
+
+	replay := Capture{
+		ID:             uuid.NewString(),
+		ReplayOf:       original.ID,
+		Domain:         original.Domain,
+		StartedAt:      time.Now(),
+		Method:         original.Method,
+		URL:            original.URL,
+		RequestHeaders: map[string]string{},
+		RequestBody:    original.RequestBody,
+	}
+	if edits.Method != "" {
+		replay.Method = edits.Method
+	}
+	if edits.URL != "" {
+		replay.URL = edits.URL
+	}
+	if edits.Body != nil {
+		replay.RequestBody = edits.Body
+	}
+	for key, value := range original.RequestHeaders {
+		replay.RequestHeaders[key] = value
+	}
+	for key, value := range edits.Headers {
+		key = http.CanonicalHeaderKey(key)
+		if value == "" {
+			delete(replay.RequestHeaders, key)
+			continue
+		}
+		replay.RequestHeaders[key] = value
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, replayTimeout)
+	defer cancel()
+	ctx, tunnel := WithTunnelInfo(withReplayOf(ctx, original.ID))
+	r, err := http.NewRequestWithContext(ctx, replay.Method, "http://"+original.Domain+replay.URL, bytes.NewReader(replay.RequestBody))
+	if err != nil {
+		return ReplayResult{}, fmt.Errorf("invalid replay request: %v", err)
+	}
+	for key, value := range replay.RequestHeaders {
+		r.Header.Set(key, value)
+	}
+	// the route of the replayed path may be linked on another node
+	if _, ok := s.lookupRoute(original.Domain, r.URL.Path); !ok {
+		return ReplayResult{}, ErrNoTunnel
+	}
+	r.Header.Del("Content-Length")
+	r.ContentLength = int64(len(replay.RequestBody))
+	r.RemoteAddr = "replay"
+
+	w := &replayWriter{header: http.Header{}, limit: s.opts.inspector.bodyLimit}
+	s.onRequest(w, r)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	replay.ClientID = tunnel.ClientID
+	replay.Duration = time.Since(replay.StartedAt)
+	replay.Status = w.status
+	replay.ResponseHeaders = headerToMap(w.header)
+	replay.ResponseBody = w.body
+	replay.ResponseTruncated = w.truncated
+	return ReplayResult{Original: original, Replay: replay}, nil
+}
+
+// replayIdentity returns the identity forwarded with a replay, the visitor of the original request
+// when it was captured and the server otherwise
+func (s *Server) replayIdentity(captureID string) *Identity {
+	if original, ok := s.opts.inspector.Capture(captureID); ok && original.Identity != nil {
+		identity := *original.Identity
+		return &identity
+	}
+	return &Identity{Subject: ReplaySubject}
+}
+
+// onReplay is the admin handler replaying a capture
+func (s *Server) onReplay(w http.ResponseWriter, r *http.Request) {
+	var edits ReplayEdits
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&edits); err != nil {
+			http.Error(w, fmt.Sprintf("invalid replay edits: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	result, err := s.Replay(r.Context(), r.PathValue("id"), edits)
+	switch {
+	case errors.Is(err, ErrCaptureNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrCaptureTruncated), errors.Is(err, ErrNoTunnel):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// replayWriter is a http.ResponseWriter that buffers the response of a replayed request
+type replayWriter struct {
+	mu        sync.Mutex
+	header    http.Header
+	status    int
+	body      []byte
+	truncated bool
+	limit     int
+}
+
+// Header is a method to return the response headers
+func (w *replayWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader is a method to record the status code
+func (w *replayWriter) WriteHeader(statusCode int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+// Write is a method to buffer the response body
+func (w *replayWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body, w.truncated = appendLimited(w.body, p, w.limit, w.truncated)
+	return len(p), nil
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// ResponseRecorder is a http.ResponseWriter that keeps track of the status code and body size,
+// the tunnel client response is written from the tunnel goroutine, hence the atomics
+type ResponseRecorder struct {
+	http.ResponseWriter
+	status  atomic.Int64
+	written atomic.Int64
+}
+
+// NewResponseRecorder wraps the given writer
+func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{ResponseWriter: w}
+}
+
+// WriteHeader is a method to record the status code
+func (r *ResponseRecorder) WriteHeader(statusCode int) {
+	r.status.CompareAndSwap(0, int64(statusCode))
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write is a method to record the body size
+func (r *ResponseRecorder) Write(p []byte) (int, error) {
+	r.status.CompareAndSwap(0, http.StatusOK)
+	n, err := r.ResponseWriter.Write(p)
+	r.written.Add(int64(n))
+	return n, err
+}
+
+// Flush is a method to flush the underlying writer
+func (r *ResponseRecorder) Flush() {
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Hijack is a method to hand the connection over, as done by websocket upgrades
+func (r *ResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not implement http.Hijacker")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		r.status.CompareAndSwap(0, http.StatusSwitchingProtocols)
+	}
+	return conn, rw, err
+}
+
+// Status returns the recorded status code, zero if nothing was written
+func (r *ResponseRecorder) Status() int {
+	return int(r.status.Load())
+}
+
+// Written returns the number of body bytes written
+func (r *ResponseRecorder) Written() int64 {
+	return r.written.Load()
+}
+
+// Unwrap returns the underlying writer so http.ResponseController can reach it
+func (r *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
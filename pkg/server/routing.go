@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// pathPrefix matches the prefixes a client can register, restricted to characters that
+// need no escaping so the prefix matches the escaped and the decoded path alike
+var pathPrefix = regexp.MustCompile(`^(/[A-Za-z0-9._~-]+)+$`)
+
+// Route is a domain and an optional path prefix served by a tunnel client
+type Route struct {
+	Domain string `json:"domain"`
+	// PathPrefix is empty when the client serves the whole domain
+	PathPrefix string `json:"pathPrefix,omitempty"`
+}
+
+// String returns the route key used in the domain to client map, e.g. api.example.com/v2
+func (r Route) String() string {
+	return r.Domain + r.PathPrefix
+}
+
+// ParseRoute splits a route key like api.example.com/v2 into its domain and path prefix
+func ParseRoute(key string) (Route, error) {
+	domain, prefix, found := strings.Cut(key, "/")
+	if !found {
+		return Route{Domain: domain}, nil
+	}
+	normalized, err := normalizePrefix("/" + prefix)
+	if err != nil {
+		return Route{}, err
+	}
+	return Route{Domain: domain, PathPrefix: normalized}, nil
+}
+
+// normalizePrefix returns the canonical form of a path prefix: a leading slash, no
+// trailing slash and the empty string for the root
+func normalizePrefix(prefix string) (string, error) {
+	if prefix == "" || prefix == "/" {
+		return "", nil
+	}
+	cleaned := path.Clean("/" + prefix)
+	if cleaned == "/" {
+		return "", nil
+	}
+	if !pathPrefix.MatchString(cleaned) {
+		return "", fmt.Errorf("invalid path prefix %q", prefix)
+	}
+	return cleaned, nil
+}
+
+// routeMatch is the outcome of looking up the route of a request
+type routeMatch struct {
+	route    Route
+	clientID string
+}
+
+// lookupRoute returns the route with the longest path prefix of the given host that
+// matches the request path, prefixes only match whole path segments
+func (s *Server) lookupRoute(host, requestPath string) (routeMatch, bool) {
+	prefix := path.Clean("/" + requestPath)
+	if prefix == "/" {
+		prefix = ""
+	}
+	for {
+		route := Route{Domain: host, PathPrefix: prefix}
+		if clientID, ok := s.hostToClientID.Load(route.String()); ok {
+			return routeMatch{route: route, clientID: clientID.(string)}, true
+		}
+		if prefix == "" {
+			return routeMatch{}, false
+		}
+		prefix = prefix[:strings.LastIndexByte(prefix, '/')]
+	}
+}
+
+// hasHost returns whether any route, with or without a path prefix, is linked on the host
+func (s *Server) hasHost(host string) bool {
+	found := false
+	s.hostToClientID.Range(func(key, _ any) bool {
+		route, err := ParseRoute(key.(string))
+		found = err == nil && route.Domain == host
+		return !found
+	})
+	return found
+}
+
+// forwardedURL returns the URL sent to the tunnel client, without the route prefix when
+// the client asked for it to be stripped
+func forwardedURL(escapedPath, rawQuery, strip string) string {
+	if strip != "" {
+		escapedPath = strings.TrimPrefix(escapedPath, strip)
+		if !strings.HasPrefix(escapedPath, "/") {
+			escapedPath = "/" + escapedPath
+		}
+	}
+	if rawQuery != "" {
+		return escapedPath + "?" + rawQuery
+	}
+	return escapedPath
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestPathPrefixRouting(t *testing.T) {
+	s := New()
+	srv := httptest.NewServer(s.Routes())
+	t.Cleanup(srv.Close)
+
+	serveAs := func(name string) func(req testFrame, body []byte) testResponse {
+		return func(req testFrame, body []byte) testResponse {
+			return testResponse{
+				status:  http.StatusOK,
+				headers: map[string]string{"X-Served-By": name, "X-Url": req.URL, "X-Prefix": req.Headers["X-Forwarded-Prefix"]},
+			}
+		}
+	}
+	root := dialTestClient(t, srv)
+	root.register("staging.example.com")
+	root.serve(serveAs("root"))
+
+	api := dialTestClient(t, srv)
+	api.register("staging.example.com/api")
+	api.serve(serveAs("api"))
+
+	v2 := dialTestClient(t, srv)
+	v2.send(RegisterMessage{
+		Type:        "register",
+		ID:          uuid.NewString(),
+		Domain:      "staging.example.com",
+		PathPrefix:  "/api/v2/",
+		StripPrefix: true,
+	}, nil)
+	if frame := v2.next(); frame.Type != "registered" {
+		t.Fatalf("expected registered frame, got %q: %s", frame.Type, frame.Message)
+	}
+	v2.serve(serveAs("v2"))
+
+	cases := []struct {
+		path, servedBy, url, prefix string
+	}{
+		{"/", "root", "/", ""},
+		{"/apis", "root", "/apis", ""},
+		{"/api", "api", "/api", ""},
+		{"/api/v1/users?page=2", "api", "/api/v1/users?page=2", ""},
+		{"/api/v2", "v2", "/", "/api/v2"},
+		{"/api/v2/users?page=2", "v2", "/users?page=2", "/api/v2"},
+	}
+	for _, c := range cases {
+		resp := tunnelRequest(t, srv, "staging.example.com", http.MethodGet, c.path, nil)
+		io.Copy(io.Discard, resp.Body)
+		if got := resp.Header.Get("X-Served-By"); got != c.servedBy {
+			t.Errorf("%s: expected to be served by %s, got %q", c.path, c.servedBy, got)
+		}
+		if got := resp.Header.Get("X-Url"); got != c.url {
+			t.Errorf("%s: expected forwarded url %s, got %s", c.path, c.url, got)
+		}
+		if got := resp.Header.Get("X-Prefix"); got != c.prefix {
+			t.Errorf("%s: expected forwarded prefix %q, got %q", c.path, c.prefix, got)
+		}
+	}
+
+	if !s.UnlinkDomain("staging.example.com/api/v2") {
+		t.Fatal("expected the prefix route to be unlinked")
+	}
+	resp := tunnelRequest(t, srv, "staging.example.com", http.MethodGet, "/api/v2/users", nil)
+	if got := resp.Header.Get("X-Served-By"); got != "api" {
+		t.Errorf("expected the shorter prefix to take over, got %q", got)
+	}
+}
+
+func TestNormalizePrefix(t *testing.T) {
+	valid := map[string]string{
+		"":          "",
+		"/":         "",
+		"v2":        "/v2",
+		"/api/v2/":  "/api/v2",
+		"/api//v2":  "/api/v2",
+		"/a/../b":   "/b",
+		"/~user.x-": "/~user.x-",
+	}
+	for prefix, expected := range valid {
+		got, err := normalizePrefix(prefix)
+		if err != nil || got != expected {
+			t.Errorf("normalizePrefix(%q) = %q, %v, expected %q", prefix, got, err, expected)
+		}
+	}
+	for _, prefix := range []string{"/api?x=1", "/a b", "/%2F"} {
+		if _, err := normalizePrefix(prefix); err == nil {
+			t.Errorf("expected %q to be rejected", prefix)
+		}
+	}
+}
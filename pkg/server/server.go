@@ -1,14 +1,25 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var upgrader = websocket.Upgrader{
@@ -21,29 +32,293 @@ var upgrader = websocket.Upgrader{
 
 type ServerConnState struct {
 	ClientID        string
+	RemoteAddr      string
+	ConnectedAt     time.Time
+	Logger          *slog.Logger
 	Ch              DuplexChan[ServerMessage, ClientMessage]
 	OngoingRequests sync.Map
-	LinkHost        func(string)
+	LinkHost        func(string) error
+
+	server *Server
+	mu     sync.Mutex
+	hosts  []string
+	// strip holds the routes whose path prefix is removed before forwarding
+	strip map[string]bool
+	// access holds the access policies the client declared by route
+	access map[string]*accessRules
+	// tcpListeners holds the public ports of the client TCP tunnels
+	tcpListeners map[int]net.Listener
+	// tcpStreams holds the visitor streams of the TCP tunnels by stream id
+	tcpStreams sync.Map
+	// udpTunnels holds the public ports of the client UDP tunnels
+	udpTunnels map[int]*udpTunnel
+	// udpSessions holds the sessions of the UDP tunnels by session id
+	udpSessions sync.Map
+
+	// traffic counters of the requests served by the client
+	requests atomic.Int64
+	errors   atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+// countRequest records a request served by the client
+func (c *ServerConnState) countRequest(status int, in, out int64) {
+	c.requests.Add(1)
+	if status == 0 || status >= http.StatusInternalServerError {
+		c.errors.Add(1)
+	}
+	c.bytesIn.Add(in)
+	c.bytesOut.Add(out)
+}
+
+// Domains returns the routes linked to the client, a domain optionally followed by a path prefix
+func (c *ServerConnState) Domains() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.hosts...)
+}
+
+// tunnels returns the number of routes and tcp and udp ports the client opened
+func (c *ServerConnState) tunnels() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.hosts) + len(c.tcpListeners) + len(c.udpTunnels)
+}
+
+// holdsDomain returns whether one of the routes linked to the client is on domain
+func (c *ServerConnState) holdsDomain(domain string) bool {
+	for _, key := range c.Domains() {
+		if route, err := ParseRoute(key); err == nil && strings.EqualFold(route.Domain, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// addHost records a domain linked to the client
+func (c *ServerConnState) addHost(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, h := range c.hosts {
+		if h == host {
+			return
+		}
+	}
+	c.hosts = append(c.hosts, host)
+}
+
+// removeHost forgets a domain linked to the client, returning whether it was linked
+func (c *ServerConnState) removeHost(host string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, h := range c.hosts {
+		if h == host {
+			c.hosts = append(c.hosts[:i], c.hosts[i+1:]...)
+			delete(c.strip, host)
+			delete(c.access, host)
+			return true
+		}
+	}
+	return false
+}
+
+// setStripPrefix records whether the path prefix of a route is removed before forwarding
+func (c *ServerConnState) setStripPrefix(route string, strip bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.strip == nil {
+		c.strip = map[string]bool{}
+	}
+	c.strip[route] = strip
+}
+
+// stripsPrefix returns whether the path prefix of a route is removed before forwarding
+func (c *ServerConnState) stripsPrefix(route string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.strip[route]
 }
 
 // ServerOpts is a struct to hold server options
 type ServerOpts struct {
+	// registry is the prometheus registry where server metrics are registered
+	registry *prometheus.Registry
+	// tracerProvider is the provider of the spans created for tunneled requests
+	tracerProvider trace.TracerProvider
+	// logger is the logger used by the server and its tunnels
+	logger *slog.Logger
+	// inspector records the traffic of the domains in capture mode
+	inspector *Inspector
+	// acme enables ACME certificates for the registered domains when set
+	acme *ACMEOptions
+	// certificates holds the certificates uploaded for custom domains
+	certificates *CertificateStore
+	// subdomains hands out subdomains of the base domain to clients that do not pick a domain
+	subdomains *SubdomainAllocator
+	// verifier requires a DNS TXT challenge before a custom domain is claimed
+	verifier *DomainVerifier
+	// tcpPorts is the range of the public ports of TCP tunnels, TCP tunnels are disabled when nil
+	tcpPorts *PortRange
+	// udpPorts is the range of the public ports of UDP tunnels, UDP tunnels are disabled when nil
+	udpPorts *PortRange
+	// udpIdleTimeout is how long a UDP session lives without datagrams
+	udpIdleTimeout time.Duration
+	// policy holds the api keys, domain patterns and limits applied to clients and visitors
+	policy Policy
+	// reload reads the configuration again on admin request, the reload endpoint is disabled when nil
+	reload func() (ReloadReport, error)
+	// routeRegistry holds the owner of every route across the nodes of the cluster
+	routeRegistry Registry
+	// nodeID identifies this server in the route registry
+	nodeID string
+	// leaseTTL is how long the routes of a node stay claimed without renewal
+	leaseTTL time.Duration
+	// peers enables forwarding requests between the nodes of the cluster when set
+	peers *PeerOptions
+	// state keeps the issued API keys and the domain settings
+	state StateStore
+	// sso is the OpenID Connect provider of the domains with single sign-on
+	sso *SSOOptions
+}
+
+// ServerOption is a type for server options
+type ServerOption func(*ServerOpts)
+
+// WithRegistry is an option to register the server metrics into the given registry
+func WithRegistry(registry *prometheus.Registry) ServerOption {
+	return func(o *ServerOpts) {
+		o.registry = registry
+	}
+}
+
+// WithTracerProvider is an option to set the provider of the server spans
+func WithTracerProvider(tracerProvider trace.TracerProvider) ServerOption {
+	return func(o *ServerOpts) {
+		o.tracerProvider = tracerProvider
+	}
+}
+
+// WithLogger is an option to set the server logger
+func WithLogger(logger *slog.Logger) ServerOption {
+	return func(o *ServerOpts) {
+		o.logger = logger
+	}
+}
+
+// WithInspector is an option to set the traffic inspector
+func WithInspector(inspector *Inspector) ServerOption {
+	return func(o *ServerOpts) {
+		o.inspector = inspector
+	}
+}
+
+// WithCertificateStore is an option to serve uploaded certificates for custom domains
+func WithCertificateStore(certificates *CertificateStore) ServerOption {
+	return func(o *ServerOpts) {
+		o.certificates = certificates
+	}
+}
+
+// WithSubdomains is an option to assign subdomains of a base domain on registration
+func WithSubdomains(subdomains *SubdomainAllocator) ServerOption {
+	return func(o *ServerOpts) {
+		o.subdomains = subdomains
+	}
+}
+
+// WithDomainVerifier is an option to require proof of control of custom domains
+func WithDomainVerifier(verifier *DomainVerifier) ServerOption {
+	return func(o *ServerOpts) {
+		o.verifier = verifier
+	}
+}
+
+// WithTCPPorts is an option to enable TCP tunnels on ports of the given range
+func WithTCPPorts(ports *PortRange) ServerOption {
+	return func(o *ServerOpts) {
+		o.tcpPorts = ports
+	}
+}
+
+// WithUDPPorts is an option to enable UDP tunnels on ports of the given range
+func WithUDPPorts(ports *PortRange) ServerOption {
+	return func(o *ServerOpts) {
+		o.udpPorts = ports
+	}
+}
+
+// WithUDPIdleTimeout is an option to set how long a UDP session lives without datagrams
+func WithUDPIdleTimeout(timeout time.Duration) ServerOption {
+	return func(o *ServerOpts) {
+		o.udpIdleTimeout = timeout
+	}
+}
+
+// WithRouteRegistry is an option to share the route ownership with other nodes through registry
+func WithRouteRegistry(registry Registry) ServerOption {
+	return func(o *ServerOpts) {
+		o.routeRegistry = registry
+	}
+}
+
+// WithNodeID is an option to set the name of this server in the route registry
+func WithNodeID(nodeID string) ServerOption {
+	return func(o *ServerOpts) {
+		o.nodeID = nodeID
+	}
+}
+
+// WithLeaseTTL is an option to set how long routes stay claimed when their node stops renewing them
+func WithLeaseTTL(ttl time.Duration) ServerOption {
+	return func(o *ServerOpts) {
+		o.leaseTTL = ttl
+	}
 }
 
 // Server is a struct to hold server options
 type Server struct {
+	opts           ServerOpts
+	metrics        *metrics
+	acme           *acmeManager
 	serverStates   sync.Map
 	hostToClientID sync.Map
+	policy         atomic.Pointer[Policy]
+	limiter        rateLimiter
+	// draining is set once the server stopped accepting tunnels
+	draining atomic.Bool
+	// peerProxy forwards requests to the node holding their tunnel, nil without peers
+	peerProxy *httputil.ReverseProxy
+	// domainAccess holds the compiled access policies of the domain settings
+	domainAccess sync.Map
+	// sso signs visitors in with the OpenID Connect provider, nil without single sign-on
+	sso *ssoProvider
 }
 
 // Routes is a method to return a ServeMux
 func (s *Server) Routes() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/_connect", s.onWSConnect)
-	mux.HandleFunc("/*", s.onRequest)
+	mux.HandleFunc("/", s.onRequest)
 	return mux
 }
 
+// Inspector is a method to return the traffic inspector
+func (s *Server) Inspector() *Inspector {
+	return s.opts.inspector
+}
+
+// MetricsHandler is a method to return the prometheus metrics handler
+func (s *Server) MetricsHandler() http.Handler {
+	return s.metrics.handler()
+}
+
+// isStreaming returns whether a response is a long lived stream such as Server-Sent Events or gRPC
+func isStreaming(header http.Header) bool {
+	contentType := header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "text/event-stream") || strings.HasPrefix(contentType, "application/grpc")
+}
+
 // headerToMap transforms http.Header into a map[string]string
 func headerToMap(header http.Header) map[string]string {
 	result := make(map[string]string)
@@ -58,60 +333,163 @@ func (s *Server) onRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Websocket not supported", http.StatusBadRequest)
 		return
 	}
+	if s.serveSSO(w, r) {
+		return
+	}
+	// only the server vouches for visitors
+	r.Header.Del(IdentityHeader)
+	r.Header.Del(IdentitySignatureHeader)
 	host := r.Host
-	clientID, ok := s.hostToClientID.Load(host)
+	logger := requestLogger(r.Context(), s.opts.logger).With(slog.String(LogKeyDomain, host))
+	// replays are sent by an admin, the edge policy and the rate limit apply to visitors only
+	replayOf := replayOfFromContext(r.Context())
+	match, ok := s.lookupRoute(host, r.URL.Path)
 	if !ok {
+		// the replay marker does not cross the peer link, replays only reach the tunnels of this node
+		if replayOf == "" && s.forwardToOwner(w, r, logger) {
+			return
+		}
+		logger.Debug("no tunnel registered for domain")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	serverStateAny, okStates := s.serverStates.Load(clientID)
+	serverStateAny, okStates := s.serverStates.Load(match.clientID)
 	if !okStates {
+		logger.Debug("tunnel client is gone", slog.String(LogKeyClientID, match.clientID))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	serverState := serverStateAny.(*ServerConnState)
+	policy := s.policy.Load()
+	if replayOf == "" && !s.limiter.allow(host, policy.RateLimit, policy.RateBurst) {
+		logger.Debug("request rate limited")
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+	rules := s.accessRulesOf(serverState, match.route)
+	if rules != nil && replayOf == "" && !rules.enforce(w, r, host) {
+		logger.Debug("request refused by the access policy", "remote_addr", r.RemoteAddr)
+		return
+	}
+	var identity *Identity
+	if rules != nil && rules.sso != nil && replayOf != "" {
+		identity = s.replayIdentity(replayOf)
+	} else if rules != nil && rules.sso != nil {
+		var ok bool
+		if identity, ok = s.authenticateVisitor(w, r, strings.ToLower(match.route.Domain), rules.sso); !ok {
+			logger.Debug("visitor is not signed in or not allowed", "remote_addr", r.RemoteAddr)
+			return
+		}
+	}
+	start := time.Now()
+	rec := NewResponseRecorder(w)
+	reqTrace, span := s.startRequestTrace(r, host)
+	span.SetAttributes(attribute.String("tunnel.client_id", serverState.ClientID))
+	var bytesIn int64
+	defer func() {
+		reqTrace.finish(span, rec.Status())
+		s.metrics.observeRequest(host, rec.Status(), time.Since(start), bytesIn, rec.Written())
+		serverState.countRequest(rec.Status(), bytesIn, rec.Written())
+	}()
+	w = rec
 	messageID := uuid.New().String()
+	setTunnelInfo(r.Context(), serverState.ClientID, messageID)
+	logger = logger.With(slog.String(LogKeyClientID, serverState.ClientID), slog.String(LogKeyMessageID, messageID))
+	logger.Debug("forwarding request into tunnel", "method", r.Method, "path", r.URL.Path, "route", match.route.String())
+	headers := headerToMap(r.Header)
+	if identity != nil {
+		identity.Domain = host
+		identity.RequestID = messageID
+		value, signature, err := s.sso.signIdentity(*identity)
+		if err != nil {
+			logger.Error("could not sign the visitor identity", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		headers[IdentityHeader] = value
+		headers[IdentitySignatureHeader] = signature
+	}
+	var strip string
+	if match.route.PathPrefix != "" && serverState.stripsPrefix(match.route.String()) {
+		strip = match.route.PathPrefix
+		headers["X-Forwarded-Prefix"] = strip
+	}
+	reqCapture := s.opts.inspector.start(r, host, serverState.ClientID, identity)
+	if reqCapture != nil {
+		defer reqCapture.finish()
+	}
 	hasBody := r.Body != nil
-	respBodyChan := make(chan []byte)
+	if hasBody {
+		// lets HTTP/1.1 clients keep streaming the request body while the response is written,
+		// HTTP/2 streams are always full duplex
+		http.NewResponseController(w).EnableFullDuplex()
+	}
+	reqObject := &RequestObject{
+		ID:               messageID,
+		RequestObject:    r,
+		ResponseObject:   w,
+		ResponseBodyChan: make(chan []byte, 1024),
+		trace:            reqTrace,
+		capture:          reqCapture,
+		logger:           logger,
+	}
 	if !hasBody {
-		close(respBodyChan)
+		reqObject.endResponse()
 	}
 	responseEnd := sync.WaitGroup{}
 	responseEnd.Add(1)
+	// responseComplete is set when the client ended the response, trailers included
+	responseComplete := false
 	go func() {
 		defer responseEnd.Done()
+		controller := http.NewResponseController(w)
+		tunnelClosed := serverState.Ch.Closed()
 		for {
 			select {
 			case <-r.Context().Done():
 				return
-			case chunk, ok := <-respBodyChan:
+			case <-tunnelClosed:
+				// the tunnel is gone, no more frames arrive for the request but an ended
+				// response still has its queued chunks written
+				if !reqObject.ended.Load() {
+					return
+				}
+				tunnelClosed = nil
+			case chunk, ok := <-reqObject.ResponseBodyChan:
 				if !ok {
+					responseComplete = true
 					return
 				}
 				_, err := w.Write(chunk)
+				reqObject.queued.Add(-int64(len(chunk)))
 				if err != nil {
 					return
 				}
+				// every data frame is a write of the client upstream, holding it in the net/http
+				// buffers would delay progressive responses such as Server-Sent Events
+				controller.Flush()
 			}
 		}
 	}()
-	serverState.OngoingRequests.Store(messageID, &RequestObject{
-		ID:               messageID,
-		RequestObject:    r,
-		ResponseObject:   w,
-		ResponseBodyChan: respBodyChan,
-	})
+	serverState.OngoingRequests.Store(messageID, reqObject)
+	defer serverState.OngoingRequests.Delete(messageID)
 
-	if err := serverState.Ch.Send(&RequestStartMessage{
+	startMsg := &RequestStartMessage{
 		Type:    "request-start",
 		Domain:  host,
 		ID:      messageID,
 		Method:  r.Method,
+		Proto:   r.Proto,
 		HasBody: hasBody,
-		URL:     r.URL.Path + r.URL.RawQuery,
-		Headers: headerToMap(r.Header),
-	}); err != nil {
+		URL:     forwardedURL(r.URL.EscapedPath(), r.URL.RawQuery, strip),
+		Headers: headers,
+	}
+	reqTrace.inject(startMsg)
+	reqTrace.waitingResponse()
+	if err := serverState.Ch.Send(startMsg); err != nil {
+		logger.Error("could not send request to tunnel client", "error", err)
 		fmt.Fprintf(w, "error %v", err)
 		return
 	}
@@ -119,7 +497,23 @@ func (s *Server) onRequest(w http.ResponseWriter, r *http.Request) {
 
 	buf := make([]byte, 1024)
 	for {
-		_, err := r.Body.Read(buf)
+		n, err := r.Body.Read(buf)
+		if n > 0 {
+			bytesIn += int64(n)
+			// the chunk is serialized asynchronously so it must not share the read buffer
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			if reqCapture != nil {
+				reqCapture.requestChunk(chunk)
+			}
+			if err := serverState.Ch.Send(&RequestDataMessage{
+				Chunk: chunk,
+				ID:    messageID,
+				Type:  "request-data",
+			}); err != nil {
+				return
+			}
+		}
 		if err != nil {
 			if err == io.EOF {
 				// End of the body, break the loop
@@ -127,22 +521,29 @@ func (s *Server) onRequest(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
-		if err := serverState.Ch.Send(&RequestDataMessage{
-			Chunk: buf,
-			ID:    messageID,
-			Type:  "request-data",
-		}); err != nil {
-			return
-		}
 	}
-	err := serverState.Ch.Send(&RequestDataEndMessage{
+	endMsg := &RequestDataEndMessage{
 		ID:   messageID,
 		Type: "request-end",
-	})
-	if err != nil {
+	}
+	// trailers are only known once the body was read
+	if len(r.Trailer) > 0 {
+		endMsg.Trailers = headerToMap(r.Trailer)
+	}
+	if err := serverState.Ch.Send(endMsg); err != nil {
 		return
 	}
 	responseEnd.Wait()
+	if responseComplete {
+		for key, value := range reqObject.trailers {
+			w.Header().Set(http.TrailerPrefix+key, value)
+		}
+		return
+	}
+	if rec.Status() == 0 {
+		logger.Debug("tunnel closed before the response started")
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	}
 }
 
 // Shows how to use templates with template functions and data
@@ -151,31 +552,60 @@ func (s *Server) onWSConnect(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Expected WebSocket", http.StatusBadRequest)
 		return
 	}
+	if s.draining.Load() {
+		http.Error(w, "Server is draining", http.StatusServiceUnavailable)
+		return
+	}
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		http.Error(w, "Could not upgrade websocket connection", http.StatusInternalServerError)
 		return
 	}
-	ch := NewDuplexChan(ws, WithSerializer(messageSerializer{}))
+	ch := NewDuplexChan(ws,
+		WithSerializer[ServerMessage, ClientMessage](messageSerializer{}),
+		WithObserver(s.metrics.chanObserver()),
+	)
 	defer ch.Close()
 
 	clientID := uuid.New().String()
-	hosts := []string{}
+	logger := requestLogger(r.Context(), s.opts.logger).With(slog.String(LogKeyClientID, clientID))
+	logger.Info("tunnel client connected", "remote_addr", r.RemoteAddr)
+	defer logger.Info("tunnel client disconnected")
 	recv := ch.Recv()
 	state := ServerConnState{
-		ClientID: clientID,
-		Ch:       ch,
-		LinkHost: func(host string) {
-			hosts = append(hosts, host)
-			s.hostToClientID.Store(host, clientID)
-		},
+		ClientID:    clientID,
+		server:      s,
+		RemoteAddr:  r.RemoteAddr,
+		ConnectedAt: time.Now(),
+		Logger:      logger,
+		Ch:          ch,
+	}
+	state.LinkHost = func(route string) error {
+		if err := s.opts.routeRegistry.Claim(r.Context(), route, state.owner(), s.opts.leaseTTL); err != nil {
+			return fmt.Errorf("could not claim %s: %v", route, err)
+		}
+		state.addHost(route)
+		s.hostToClientID.Store(route, clientID)
+		if parsed, err := ParseRoute(route); err == nil {
+			s.domainLinked(parsed.Domain)
+		}
+		return nil
 	}
 	s.serverStates.Store(clientID, &state)
 	defer s.serverStates.Delete(clientID)
+	defer state.closeTCP()
+	defer state.closeUDP()
+	leases, stopLeases := context.WithCancel(context.Background())
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		state.renewLeases(leases)
+	}()
 	defer func() {
-		for _, host := range hosts {
-			s.hostToClientID.CompareAndDelete(host, clientID)
-		}
+		// a renewal in flight would claim the routes again after their release
+		stopLeases()
+		<-renewed
+		state.releaseRoutes()
 	}()
 	wg := sync.WaitGroup{}
 	defer wg.Wait()
@@ -191,14 +621,79 @@ func (s *Server) onWSConnect(w http.ResponseWriter, r *http.Request) {
 			}
 			err := message.Handle(&state)
 			if err != nil {
-				fmt.Printf("error handling message: %v", err)
+				state.messageLogger(message.GetID()).Error("error handling message",
+					slog.String("type", messageType(message)),
+					"error", err,
+				)
 				state.OngoingRequests.Delete(message.GetID())
 			}
 		}
 	}
 }
 
+// routeReleased is called whenever a route stops being linked to a tunnel client, what the
+// client asked for its domain must not carry over to the next client taking it
+func (s *Server) routeReleased(route string) {
+	parsed, err := ParseRoute(route)
+	if err != nil {
+		return
+	}
+	// capture mode stays on only when admins turned it on in the domain settings
+	if settings, err := s.DomainSettings(parsed.Domain); err != nil || !settings.Inspect {
+		s.opts.inspector.Disable(parsed.Domain)
+	}
+	s.recheckCertificate(parsed.Domain)
+}
+
 // New is a function to return a new Server
-func New() *Server {
-	return &Server{}
+func New(options ...ServerOption) *Server {
+	opts := ServerOpts{}
+	for _, option := range options {
+		option(&opts)
+	}
+	if opts.registry == nil {
+		opts.registry = prometheus.NewRegistry()
+		opts.registry.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+	if opts.logger == nil {
+		opts.logger = slog.Default()
+	}
+	if opts.inspector == nil {
+		opts.inspector = NewInspector(DefaultInspectorCapacity, DefaultInspectorBodyLimit)
+	}
+	if opts.udpIdleTimeout <= 0 {
+		opts.udpIdleTimeout = DefaultUDPIdleTimeout
+	}
+	if opts.tracerProvider == nil {
+		opts.tracerProvider = otel.GetTracerProvider()
+	}
+	if opts.routeRegistry == nil {
+		opts.routeRegistry = NewMemoryRegistry()
+	}
+	if opts.nodeID == "" {
+		opts.nodeID = defaultNodeID()
+	}
+	if opts.leaseTTL <= 0 {
+		opts.leaseTTL = DefaultLeaseTTL
+	}
+	if opts.state == nil {
+		opts.state = NewMemoryStateStore()
+	}
+	s := &Server{opts: opts}
+	s.policy.Store(&opts.policy)
+	s.metrics = newMetrics(s, opts.registry)
+	if opts.sso != nil {
+		s.sso = newSSOProvider(*opts.sso)
+	}
+	if opts.acme != nil {
+		s.acme = newACMEManager(s, *opts.acme)
+	}
+	if opts.peers != nil {
+		s.peerProxy = s.newPeerProxy()
+	}
+	s.loadDomainAccess()
+	return s
 }
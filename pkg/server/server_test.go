@@ -2,9 +2,17 @@
 package server
 
 import (
+	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 )
 
 func TestConnectHandler(t *testing.T) {
@@ -49,3 +57,274 @@ func TestRequestHandler(t *testing.T) {
 	// 		rr.Body.String(), expected)
 	// }
 }
+
+// testFrame is the metadata of a server message as seen by a tunnel client
+type testFrame struct {
+	Type    string            `json:"type"`
+	ID      string            `json:"id"`
+	Domain  string            `json:"domain"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	HasBody bool              `json:"hasBody"`
+	Message string            `json:"message"`
+	// TraceParent is the W3C trace context of request-start frames
+	TraceParent string `json:"traceparent"`
+	// RecordName and RecordValue are the DNS challenge of verification-required frames
+	RecordName  string `json:"recordName"`
+	RecordValue string `json:"recordValue"`
+	// Port is the public port of registered tcp tunnels and of tcp-open frames
+	Port int `json:"port"`
+	// Proto is the visitor protocol version of request-start frames
+	Proto string `json:"proto"`
+	// Trailers are the request trailers, request-end frames carry them but serve hands them
+	// to the handler along with the request-start frame
+	Trailers map[string]string `json:"trailers"`
+	// IdentityKey checks the identity of signed in visitors, registered frames carry it
+	IdentityKey string `json:"identityKey"`
+	// Error is the reason of tcp-close frames
+	Error   string `json:"error"`
+	Payload []byte `json:"-"`
+}
+
+// testResponse is the response a testClient writes back for a request
+type testResponse struct {
+	status   int
+	headers  map[string]string
+	chunks   [][]byte
+	trailers map[string]string
+}
+
+// testClient is a minimal tunnel client used to drive the server in tests
+type testClient struct {
+	t      *testing.T
+	ws     *websocket.Conn
+	mu     sync.Mutex
+	frames chan testFrame
+	// closeErr is the error that ended the connection, set before frames is closed
+	closeErr error
+}
+
+// dialTestClient connects a tunnel client to the given test server
+func dialTestClient(t *testing.T, srv *httptest.Server) *testClient {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/_connect", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{t: t, ws: ws, frames: make(chan testFrame, 64)}
+	t.Cleanup(func() { ws.Close() })
+	go func() {
+		defer close(c.frames)
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				c.closeErr = err
+				return
+			}
+			metadata, payload, err := parseMessage(data)
+			if err != nil {
+				return
+			}
+			var frame testFrame
+			if err := json.Unmarshal(metadata, &frame); err != nil {
+				return
+			}
+			frame.Payload = payload
+			c.frames <- frame
+		}
+	}()
+	return c
+}
+
+// send writes a client message to the server
+func (c *testClient) send(msg any, payload []byte) {
+	c.t.Helper()
+	data, err := createMessage(msg, payload)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// next waits for the next frame sent by the server
+func (c *testClient) next() testFrame {
+	c.t.Helper()
+	select {
+	case frame, ok := <-c.frames:
+		if !ok {
+			c.t.Fatal("tunnel closed")
+		}
+		return frame
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("timed out waiting for frame")
+	}
+	return testFrame{}
+}
+
+// register claims a domain and waits for the server acknowledgement
+func (c *testClient) register(domain string) testFrame {
+	c.t.Helper()
+	c.send(RegisterMessage{Type: "register", ID: uuid.NewString(), APIKey: "test", Domain: domain}, nil)
+	frame := c.next()
+	if frame.Type != "registered" {
+		c.t.Fatalf("expected registered frame, got %q: %s", frame.Type, frame.Message)
+	}
+	return frame
+}
+
+// registerFrame sends a register message and returns the answer of the server
+func registerFrame(client *testClient, msg RegisterMessage) testFrame {
+	msg.Type = "register"
+	msg.ID = uuid.NewString()
+	client.send(msg, nil)
+	return client.next()
+}
+
+// serve answers every tunneled request with the response returned by handler
+func (c *testClient) serve(handler func(req testFrame, body []byte) testResponse) {
+	go func() {
+		bodies := map[string][]byte{}
+		starts := map[string]testFrame{}
+		for frame := range c.frames {
+			switch frame.Type {
+			case "request-start":
+				starts[frame.ID] = frame
+			case "request-data":
+				bodies[frame.ID] = append(bodies[frame.ID], frame.Payload...)
+			case "request-end":
+				req := starts[frame.ID]
+				req.Trailers = frame.Trailers
+				resp := handler(req, bodies[frame.ID])
+				c.send(ResponseStartMessage{Type: "response-start", ID: frame.ID, StatusCode: resp.status, Headers: resp.headers}, nil)
+				for _, chunk := range resp.chunks {
+					c.send(DataMessage{Type: "data", ID: frame.ID}, chunk)
+				}
+				c.send(DataEndMessage{Type: "data-end", ID: frame.ID, Trailers: resp.trailers}, nil)
+				delete(starts, frame.ID)
+				delete(bodies, frame.ID)
+			}
+		}
+	}()
+}
+
+// newTunnel starts a server with a client serving domain through handler
+func newTunnel(t *testing.T, s *Server, domain string, handler func(req testFrame, body []byte) testResponse) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(s.Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	client.register(domain)
+	client.serve(handler)
+	return srv
+}
+
+// tunnelRequest sends a visitor request for domain through the test server
+func tunnelRequest(t *testing.T, srv *httptest.Server, domain, method, path string, body io.Reader) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = domain
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// visitorRequest sends a visitor request for domain in the background
+func visitorRequest(srv *httptest.Server, domain string) <-chan *http.Response {
+	responses := make(chan *http.Response, 1)
+	go func() {
+		defer close(responses)
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/", nil)
+		if err != nil {
+			return
+		}
+		req.Host = domain
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			responses <- resp
+		}
+	}()
+	return responses
+}
+
+// waitRequest returns the request-end frame of the next tunneled request
+func waitRequest(client *testClient) testFrame {
+	var frame testFrame
+	for frame.Type != "request-end" {
+		frame = client.next()
+	}
+	return frame
+}
+
+func TestTunnelRequest(t *testing.T) {
+	s := New()
+	srv := newTunnel(t, s, "example.test", func(req testFrame, body []byte) testResponse {
+		return testResponse{status: http.StatusCreated, chunks: [][]byte{[]byte(req.Method + " "), body}}
+	})
+
+	resp := tunnelRequest(t, srv, "example.test", "POST", "/hello", strings.NewReader("world"))
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusCreated)
+	}
+	if string(got) != "POST world" {
+		t.Errorf("handler returned unexpected body: got %q want %q", got, "POST world")
+	}
+}
+
+func TestTunnelRequestBody(t *testing.T) {
+	s := New()
+	srv := newTunnel(t, s, "example.test", func(req testFrame, body []byte) testResponse {
+		return testResponse{status: http.StatusOK, chunks: [][]byte{body}}
+	})
+
+	// larger than the read buffer so the body is sent in several chunks
+	body := strings.Repeat("0123456789abcdef", 1000)
+	resp := tunnelRequest(t, srv, "example.test", "PUT", "/nested/path", strings.NewReader(body))
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected nested paths to reach the tunnel, got status %v", resp.StatusCode)
+	}
+	if string(got) != body {
+		t.Errorf("the tunnel received a different body: got %d bytes want %d", len(got), len(body))
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	s := New()
+	srv := newTunnel(t, s, "example.test", func(req testFrame, body []byte) testResponse {
+		return testResponse{status: http.StatusOK, chunks: [][]byte{[]byte("hello")}}
+	})
+	resp := tunnelRequest(t, srv, "example.test", "GET", "/", nil)
+	io.ReadAll(resp.Body)
+
+	rr := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	for _, expected := range []string{
+		"warp_tunnels_connected 1",
+		"warp_domains_registered 1",
+		`warp_request_duration_seconds_count{domain="example.test",status="200"} 1`,
+		`warp_response_bytes_total{domain="example.test"} 5`,
+		`warp_frames_sent_total{type="request-start"} 1`,
+		`warp_frames_received_total{type="register"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("metrics output does not contain %q", expected)
+		}
+	}
+}
@@ -0,0 +1,680 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of the requests of visitors signed in through single sign-on
+const (
+	// IdentityHeader carries the base64url encoded JSON Identity of the visitor
+	IdentityHeader = "X-Warp-Identity"
+	// IdentitySignatureHeader carries the base64url encoded ed25519 signature of IdentityHeader,
+	// clients check it with the identity key of their registered message
+	IdentitySignatureHeader = "X-Warp-Identity-Signature"
+)
+
+// Paths of the single sign-on flow, they are reserved on every domain
+const (
+	ssoLoginPath    = "/_warp/sso/login"
+	ssoCallbackPath = "/_warp/sso/callback"
+	ssoSessionPath  = "/_warp/sso/session"
+)
+
+const (
+	// DefaultSSOSessionTTL is how long visitors stay signed in
+	DefaultSSOSessionTTL = 12 * time.Hour
+	ssoSessionCookie     = "warp_sso"
+	ssoNonceCookie       = "warp_sso_nonce"
+	// ssoLoginTTL bounds the time spent at the provider
+	ssoLoginTTL = 10 * time.Minute
+	// ssoTicketTTL bounds the hop from the callback to the domain the visitor signs in to
+	ssoTicketTTL = time.Minute
+	// ssoKeysRefresh is the minimum delay between two fetches of the provider keys
+	ssoKeysRefresh = time.Minute
+	// ssoClockSkew is the leeway given to the expiry of the ID tokens
+	ssoClockSkew = time.Minute
+)
+
+// SSOOptions is a struct to hold the OpenID Connect provider the visitors of the domains with
+// single sign-on log in with
+type SSOOptions struct {
+	// Issuer is the provider URL, its discovery document is at /.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// LoginURL is the base URL of this server the provider sends visitors back to, e.g.
+	// https://login.tunnel.example.com; <LoginURL>/_warp/sso/callback is the redirect URI
+	// registered at the provider
+	LoginURL string
+	// Secret signs the sessions, the nodes of a cluster share it
+	Secret string
+	// SessionTTL is how long visitors stay signed in, DefaultSSOSessionTTL when zero
+	SessionTTL time.Duration
+	// Scopes are requested at the provider, openid, email and profile when empty
+	Scopes []string
+	// HTTPClient talks to the provider, http.DefaultClient when nil
+	HTTPClient *http.Client
+}
+
+// Validate is a method to check the provider settings
+func (o SSOOptions) Validate() error {
+	issuer, err := url.Parse(o.Issuer)
+	if err != nil || (issuer.Scheme != "https" && issuer.Scheme != "http") || issuer.Host == "" {
+		return fmt.Errorf("invalid issuer %q", o.Issuer)
+	}
+	login, err := url.Parse(o.LoginURL)
+	if err != nil || (login.Scheme != "https" && login.Scheme != "http") || login.Host == "" {
+		return fmt.Errorf("invalid login url %q, expected https://host", o.LoginURL)
+	}
+	if o.ClientID == "" {
+		return fmt.Errorf("a client id is required")
+	}
+	if len(o.Secret) < 32 {
+		return fmt.Errorf("the session secret must be at least 32 characters")
+	}
+	return nil
+}
+
+// WithSSO is an option to let domains require visitors to sign in with an OpenID Connect provider
+func WithSSO(sso SSOOptions) ServerOption {
+	return func(o *ServerOpts) {
+		o.sso = &sso
+	}
+}
+
+// SSOPolicy is a struct to describe the visitors let in once signed in with the provider
+type SSOPolicy struct {
+	// Emails are the verified addresses let in, *@example.com lets a whole email domain in
+	Emails []string `json:"emails,omitempty"`
+	// Groups are the values of the groups claim let in
+	Groups []string `json:"groups,omitempty"`
+}
+
+// allows returns whether a signed in visitor is let in
+func (p *SSOPolicy) allows(identity Identity) bool {
+	if identity.Email != "" {
+		email := strings.ToLower(identity.Email)
+		for _, pattern := range p.Emails {
+			pattern = strings.ToLower(pattern)
+			if emailDomain, ok := strings.CutPrefix(pattern, "*@"); ok {
+				if strings.HasSuffix(email, "@"+emailDomain) {
+					return true
+				}
+			} else if email == pattern {
+				return true
+			}
+		}
+	}
+	for _, group := range identity.Groups {
+		if slices.Contains(p.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// Identity is a struct to describe a visitor signed in through single sign-on, it is forwarded to
+// the tunnel client in IdentityHeader
+type Identity struct {
+	Subject string   `json:"sub"`
+	Email   string   `json:"email,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	// Domain and RequestID bind a forwarded identity to one request, so it cannot be replayed
+	Domain    string `json:"domain,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// ssoProvider runs the sign in flow with the OpenID Connect provider
+type ssoProvider struct {
+	opts   SSOOptions
+	client *http.Client
+	login  *url.URL
+	// identityKey signs the identities forwarded to the tunnel clients
+	identityKey ed25519.PrivateKey
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+// oidcDiscovery holds the fields of the provider discovery document used by the server
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// newSSOProvider creates the provider of validated options
+func newSSOProvider(opts SSOOptions) *ssoProvider {
+	if opts.SessionTTL <= 0 {
+		opts.SessionTTL = DefaultSSOSessionTTL
+	}
+	if len(opts.Scopes) == 0 {
+		opts.Scopes = []string{"openid", "email", "profile"}
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	login, _ := url.Parse(opts.LoginURL)
+	// the key is derived from the secret so every node signs with the same one
+	seed := sha256.Sum256([]byte("warp identity\n" + opts.Secret))
+	return &ssoProvider{
+		opts:        opts,
+		client:      client,
+		login:       login,
+		identityKey: ed25519.NewKeyFromSeed(seed[:]),
+	}
+}
+
+// IdentityKey is a method to return the public key the identities forwarded to the tunnel clients
+// are signed with, nil without single sign-on
+func (s *Server) IdentityKey() ed25519.PublicKey {
+	if s.sso == nil {
+		return nil
+	}
+	return s.sso.identityKey.Public().(ed25519.PublicKey)
+}
+
+// loginState is the state sent to the provider, it remembers where the visitor was going
+type loginState struct {
+	Domain string `json:"domain"`
+	Scheme string `json:"scheme"`
+	Return string `json:"return"`
+	Nonce  string `json:"nonce"`
+}
+
+// sessionTicket hands the identity from the callback over to the domain the visitor signs in to
+type sessionTicket struct {
+	Identity Identity `json:"identity"`
+	Domain   string   `json:"domain"`
+	Return   string   `json:"return"`
+}
+
+// ssoSession is the session cookie of a domain
+type ssoSession struct {
+	Identity Identity `json:"identity"`
+	Domain   string   `json:"domain"`
+}
+
+// signedToken is the payload of the tokens signed by the server
+type signedToken struct {
+	Expires int64           `json:"exp"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// sign returns a token holding value until ttl, purpose keeps the tokens of a step from being
+// used at another one
+func (p *ssoProvider) sign(purpose string, ttl time.Duration, value any) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(signedToken{Expires: time.Now().Add(ttl).Unix(), Data: data})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(p.mac(purpose, encoded)), nil
+}
+
+// open checks a token signed for purpose and decodes its value
+func (p *ssoProvider) open(purpose, token string, value any) error {
+	encoded, signature, ok := strings.Cut(token, ".")
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if !ok || err != nil || !hmac.Equal(mac, p.mac(purpose, encoded)) {
+		return fmt.Errorf("invalid %s token", purpose)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	var signed signedToken
+	if err := json.Unmarshal(payload, &signed); err != nil {
+		return err
+	}
+	if time.Now().Unix() > signed.Expires {
+		return fmt.Errorf("expired %s token", purpose)
+	}
+	return json.Unmarshal(signed.Data, value)
+}
+
+// mac returns the signature of a token payload
+func (p *ssoProvider) mac(purpose, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(p.opts.Secret))
+	mac.Write([]byte(purpose + "\n" + payload))
+	return mac.Sum(nil)
+}
+
+// authenticateVisitor returns the identity of a visitor of a domain with single sign-on, sending
+// browsers to the provider when they are not signed in
+func (s *Server) authenticateVisitor(w http.ResponseWriter, r *http.Request, domain string, policy *SSOPolicy) (*Identity, bool) {
+	if s.sso == nil {
+		// the policy was kept in the domain settings after the provider was removed
+		http.Error(w, "single sign-on is not configured", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	p := s.sso
+	if cookie, err := r.Cookie(ssoSessionCookie); err == nil {
+		var session ssoSession
+		if err := p.open("session", cookie.Value, &session); err == nil && session.Domain == domain {
+			if !policy.allows(session.Identity) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return nil, false
+			}
+			// the session belongs to the server, the tunnel gets the signed identity instead
+			dropCookie(r, ssoSessionCookie)
+			return &session.Identity, true
+		}
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	state, err := p.sign("state", ssoLoginTTL, loginState{
+		Domain: domain,
+		Scheme: requestScheme(r),
+		Return: r.URL.RequestURI(),
+		Nonce:  randomToken(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	login := *p.login
+	login.Path = ssoLoginPath
+	login.RawQuery = url.Values{"state": {state}}.Encode()
+	http.Redirect(w, r, login.String(), http.StatusFound)
+	return nil, false
+}
+
+// serveSSO answers the requests of the sign in flow, returning false for the other requests
+func (s *Server) serveSSO(w http.ResponseWriter, r *http.Request) bool {
+	if s.sso == nil || !strings.HasPrefix(r.URL.Path, "/_warp/sso/") {
+		return false
+	}
+	onLoginHost := strings.EqualFold(r.Host, s.sso.login.Host)
+	switch {
+	case r.URL.Path == ssoLoginPath && onLoginHost:
+		s.sso.serveLogin(w, r)
+	case r.URL.Path == ssoCallbackPath && onLoginHost:
+		s.sso.serveCallback(w, r)
+	case r.URL.Path == ssoSessionPath:
+		s.sso.serveSession(w, r)
+	default:
+		return false
+	}
+	return true
+}
+
+// serveLogin binds the sign in to the browser with a nonce cookie and sends it to the provider
+func (p *ssoProvider) serveLogin(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("state")
+	var state loginState
+	if err := p.open("state", token, &state); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	discovery, err := p.discover(r.Context())
+	if err != nil {
+		http.Error(w, "could not reach the identity provider", http.StatusBadGateway)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoNonceCookie,
+		Value:    state.Nonce,
+		Path:     "/_warp/sso/",
+		MaxAge:   int(ssoLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   p.login.Scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	authorize, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		http.Error(w, "invalid authorization endpoint", http.StatusBadGateway)
+		return
+	}
+	query := authorize.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.opts.ClientID)
+	query.Set("redirect_uri", p.redirectURI())
+	query.Set("scope", strings.Join(p.opts.Scopes, " "))
+	query.Set("state", token)
+	query.Set("nonce", state.Nonce)
+	authorize.RawQuery = query.Encode()
+	http.Redirect(w, r, authorize.String(), http.StatusFound)
+}
+
+// serveCallback exchanges the code of the provider for the identity of the visitor and sends it
+// back to the domain it signs in to
+func (p *ssoProvider) serveCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		http.Error(w, "sign in failed: "+providerErr, http.StatusUnauthorized)
+		return
+	}
+	var state loginState
+	if err := p.open("state", query.Get("state"), &state); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the sign in must have started in this browser, otherwise anyone could sign visitors in as themselves
+	nonce, err := r.Cookie(ssoNonceCookie)
+	if err != nil || !hmac.Equal([]byte(nonce.Value), []byte(state.Nonce)) {
+		http.Error(w, "sign in was not started by this browser", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: ssoNonceCookie, Path: "/_warp/sso/", MaxAge: -1})
+	identity, err := p.exchange(r.Context(), query.Get("code"), state.Nonce)
+	if err != nil {
+		http.Error(w, "sign in failed: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	ticket, err := p.sign("ticket", ssoTicketTTL, sessionTicket{Identity: identity, Domain: state.Domain, Return: state.Return})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	session := url.URL{Scheme: state.Scheme, Host: state.Domain, Path: ssoSessionPath, RawQuery: url.Values{"ticket": {ticket}}.Encode()}
+	http.Redirect(w, r, session.String(), http.StatusFound)
+}
+
+// serveSession sets the session cookie of the domain the visitor signed in to
+func (p *ssoProvider) serveSession(w http.ResponseWriter, r *http.Request) {
+	var ticket sessionTicket
+	if err := p.open("ticket", r.URL.Query().Get("ticket"), &ticket); err != nil || ticket.Domain != strings.ToLower(r.Host) {
+		http.Error(w, "invalid sign in ticket", http.StatusBadRequest)
+		return
+	}
+	session, err := p.sign("session", p.opts.SessionTTL, ssoSession{Identity: ticket.Identity, Domain: ticket.Domain})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoSessionCookie,
+		Value:    session,
+		Path:     "/",
+		MaxAge:   int(p.opts.SessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	// only paths of the domain, //host would leave it
+	target := ticket.Return
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		target = "/"
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// redirectURI returns the callback registered at the provider
+func (p *ssoProvider) redirectURI() string {
+	callback := *p.login
+	callback.Path = ssoCallbackPath
+	callback.RawQuery = ""
+	return callback.String()
+}
+
+// discover returns the discovery document of the provider, it is fetched once
+func (p *ssoProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var discovery oidcDiscovery
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.opts.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(p.opts.Issuer, "/") {
+		return nil, fmt.Errorf("the provider issuer %q does not match %q", discovery.Issuer, p.opts.Issuer)
+	}
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// exchange trades an authorization code for the identity of its ID token
+func (p *ssoProvider) exchange(ctx context.Context, code, nonce string) (Identity, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.redirectURI()},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.opts.ClientID), url.QueryEscape(p.opts.ClientSecret))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Identity{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Identity{}, fmt.Errorf("token endpoint answered %s", resp.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return Identity{}, err
+	}
+	claims, err := p.verifyIDToken(ctx, tokens.IDToken, discovery.Issuer)
+	if err != nil {
+		return Identity{}, err
+	}
+	if claims.Nonce != nonce {
+		return Identity{}, fmt.Errorf("the id token nonce does not match")
+	}
+	identity := Identity{Subject: claims.Subject, Name: claims.Name, Groups: claims.Groups}
+	// unverified addresses could be anyone's, providers that do not tell are not trusted either
+	if claims.EmailVerified != nil && *claims.EmailVerified {
+		identity.Email = claims.Email
+	}
+	return identity, nil
+}
+
+// idTokenClaims holds the claims of an ID token used by the server
+type idTokenClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Expiry        int64    `json:"exp"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified *bool    `json:"email_verified"`
+	Name          string   `json:"name"`
+	Groups        []string `json:"groups"`
+}
+
+// audience is the aud claim, a string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// verifyIDToken checks the RS256 signature, the issuer, the audience and the expiry of an ID token
+func (p *ssoProvider) verifyIDToken(ctx context.Context, token, issuer string) (idTokenClaims, error) {
+	var claims idTokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("malformed id token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return claims, err
+	}
+	if header.Alg != "RS256" {
+		return claims, fmt.Errorf("unsupported id token algorithm %q", header.Alg)
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return claims, fmt.Errorf("invalid id token signature")
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return claims, err
+	}
+	switch {
+	case claims.Issuer != issuer:
+		return claims, fmt.Errorf("unexpected id token issuer %q", claims.Issuer)
+	case !slices.Contains(claims.Audience, p.opts.ClientID):
+		return claims, fmt.Errorf("the id token is not meant for this client")
+	case time.Now().Add(-ssoClockSkew).Unix() > claims.Expiry:
+		return claims, fmt.Errorf("expired id token")
+	case claims.Subject == "":
+		return claims, fmt.Errorf("the id token has no subject")
+	}
+	return claims, nil
+}
+
+// key returns the provider signing key of a key id, the keys are fetched again when the provider
+// rotates them
+func (p *ssoProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < ssoKeysRefresh {
+		return nil, fmt.Errorf("unknown id token key %q", kid)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	p.keysFetched = time.Now()
+	p.keys = map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		n, nErr := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, eErr := base64.RawURLEncoding.DecodeString(jwk.E)
+		if jwk.Kty != "RSA" || nErr != nil || eErr != nil || len(e) > 4 {
+			continue
+		}
+		p.keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown id token key %q", kid)
+}
+
+// getJSON decodes the JSON document at target
+func (p *ssoProvider) getJSON(ctx context.Context, target string, value any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", target, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(value)
+}
+
+// signIdentity returns the headers forwarding the identity of a visitor to the tunnel client
+func (p *ssoProvider) signIdentity(identity Identity) (string, string, error) {
+	data, err := json.Marshal(identity)
+	if err != nil {
+		return "", "", err
+	}
+	value := base64.RawURLEncoding.EncodeToString(data)
+	return value, base64.RawURLEncoding.EncodeToString(ed25519.Sign(p.identityKey, []byte(value))), nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a JWT
+func decodeSegment(segment string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("malformed id token")
+	}
+	return json.Unmarshal(data, value)
+}
+
+// dropCookie removes a cookie from the Cookie headers of a request
+func dropCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+// requestScheme returns the scheme the visitor used, requests forwarded by another node carry
+// the scheme of the visitor request received there
+func requestScheme(r *http.Request) string {
+	if scheme, ok := r.Context().Value(peerSchemeKey{}).(string); ok {
+		return scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// randomToken returns a random URL safe token
+func randomToken() string {
+	token := make([]byte, 18)
+	rand.Read(token)
+	return base64.RawURLEncoding.EncodeToString(token)
+}
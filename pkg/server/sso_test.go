@@ -0,0 +1,370 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIdP is an OpenID Connect provider signing in the configured user without asking
+type mockIdP struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	claims map[string]any
+	// codes maps the issued codes to the nonce of their authorization request
+	codes map[string]string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{t: t, key: key, codes: map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		code := randomToken()
+		idp.mu.Lock()
+		idp.codes[code] = query.Get("nonce")
+		idp.mu.Unlock()
+		callback, _ := url.Parse(query.Get("redirect_uri"))
+		callback.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+		http.Redirect(w, r, callback.String(), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, secret, _ := r.BasicAuth()
+		idp.mu.Lock()
+		nonce, ok := idp.codes[r.FormValue("code")]
+		delete(idp.codes, r.FormValue("code"))
+		claims := map[string]any{}
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+		idp.mu.Unlock()
+		if !ok || clientID != "warp" || secret != "client-secret" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		claims["iss"] = idp.server.URL
+		claims["aud"] = "warp"
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		claims["nonce"] = nonce
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(claims)})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// signIn sets the claims of the user the provider signs in
+func (idp *mockIdP) signIn(claims map[string]any) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.claims = claims
+}
+
+// sign returns an RS256 JWT of claims
+func (idp *mockIdP) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// browser returns a client keeping cookies that reaches every host but the provider on srv
+func browser(t *testing.T, srv, idp *httptest.Server) *http.Client {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	idpAddr := strings.TrimPrefix(idp.URL, "http://")
+	srvAddr := strings.TrimPrefix(srv.URL, "http://")
+	dialer := &net.Dialer{}
+	return &http.Client{
+		Jar: jar,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if addr != idpAddr {
+					addr = srvAddr
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+func TestSSO(t *testing.T) {
+	idp := newMockIdP(t)
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	s := New(WithSSO(SSOOptions{
+		Issuer:       idp.server.URL,
+		ClientID:     "warp",
+		ClientSecret: "client-secret",
+		LoginURL:     srv.URL,
+		Secret:       strings.Repeat("s", 32),
+	}))
+	mux.Handle("/", s.Routes())
+
+	client := dialTestClient(t, srv)
+	registered := registerFrame(client, RegisterMessage{Domain: "app.example.com", Access: &AccessPolicy{
+		SSO: &SSOPolicy{Emails: []string{"*@example.com"}, Groups: []string{"previews"}},
+	}})
+	if registered.Type != "registered" {
+		t.Fatalf("expected the registration to succeed, got %+v", registered)
+	}
+	seen := make(chan testFrame, 4)
+	client.serve(func(req testFrame, body []byte) testResponse {
+		seen <- req
+		return testResponse{status: http.StatusOK}
+	})
+
+	visit := func(c *http.Client, method string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://app.example.com/preview?id=7", nil)
+		req.Header.Set(IdentityHeader, "forged")
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	idp.signIn(map[string]any{"sub": "42", "email": "ada@example.com", "email_verified": true, "name": "Ada"})
+	ada := browser(t, srv, idp.server)
+	if resp := visit(ada, http.MethodPost); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected requests other than GET to be refused before signing in, got %v", resp.StatusCode)
+	}
+	if resp := visit(ada, http.MethodGet); resp.StatusCode != http.StatusOK || resp.Request.URL.RequestURI() != "/preview?id=7" {
+		t.Fatalf("expected to land on the page after signing in, got %v %s", resp.StatusCode, resp.Request.URL)
+	}
+	req := <-seen
+	var identity Identity
+	data, _ := base64.RawURLEncoding.DecodeString(req.Headers[IdentityHeader])
+	if err := json.Unmarshal(data, &identity); err != nil {
+		t.Fatalf("expected the identity of the visitor, got %v", req.Headers)
+	}
+	if identity.Email != "ada@example.com" || identity.Subject != "42" || identity.RequestID != req.ID || identity.Domain != "app.example.com" {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+	key, _ := base64.StdEncoding.DecodeString(registered.IdentityKey)
+	signature, _ := base64.RawURLEncoding.DecodeString(req.Headers[IdentitySignatureHeader])
+	if !ed25519.Verify(key, []byte(req.Headers[IdentityHeader]), signature) {
+		t.Error("expected the identity to be signed with the key of the registered message")
+	}
+	if strings.Contains(req.Headers["Cookie"], ssoSessionCookie) {
+		t.Errorf("expected the session cookie to stay at the edge, got %q", req.Headers["Cookie"])
+	}
+
+	// the session is kept, the provider is not visited again
+	idp.signIn(nil)
+	if resp := visit(ada, http.MethodGet); resp.StatusCode != http.StatusOK || resp.Request.URL.Host != "app.example.com" {
+		t.Errorf("expected the session to be reused, got %v %s", resp.StatusCode, resp.Request.URL)
+	}
+	<-seen
+
+	idp.signIn(map[string]any{"sub": "43", "email": "eve@evil.test", "groups": []string{"previews"}})
+	if resp := visit(browser(t, srv, idp.server), http.MethodGet); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the allowed group to be let in, got %v", resp.StatusCode)
+	}
+	<-seen
+	idp.signIn(map[string]any{"sub": "44", "email": "mallory@example.com", "email_verified": false})
+	if resp := visit(browser(t, srv, idp.server), http.MethodGet); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected an unverified email to be refused, got %v", resp.StatusCode)
+	}
+	idp.signIn(map[string]any{"sub": "45", "email": "trudy@example.com"})
+	if resp := visit(browser(t, srv, idp.server), http.MethodGet); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected an email the provider did not verify to be refused, got %v", resp.StatusCode)
+	}
+}
+
+func TestSSOSchemeOverPeerLink(t *testing.T) {
+	idp := newMockIdP(t)
+	s := New(
+		WithSSO(SSOOptions{
+			Issuer:   idp.server.URL,
+			ClientID: "warp",
+			LoginURL: "https://login.example.com",
+			Secret:   strings.Repeat("s", 32),
+		}),
+		WithPeers(PeerOptions{AdvertiseURL: "http://10.0.0.2:8002", Secret: "cluster-secret"}),
+	)
+	srv := httptest.NewServer(s.Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	registered := registerFrame(client, RegisterMessage{Domain: "app.example.com", Access: &AccessPolicy{
+		SSO: &SSOPolicy{Emails: []string{"*@example.com"}},
+	}})
+	if registered.Type != "registered" {
+		t.Fatalf("expected the registration to succeed, got %+v", registered)
+	}
+
+	// the node that received the visitor request over TLS forwards it in plain HTTP/2
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/preview", nil)
+	req.Header.Set(PeerTokenHeader, "cluster-secret")
+	req.Header.Set(PeerSchemeHeader, "https")
+	rr := httptest.NewRecorder()
+	s.PeerRoutes().ServeHTTP(rr, req)
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if rr.Code != http.StatusFound || err != nil {
+		t.Fatalf("expected a redirect to sign in, got %v %v", rr.Code, err)
+	}
+	var state loginState
+	if err := s.sso.open("state", location.Query().Get("state"), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Scheme != "https" {
+		t.Errorf("expected the visitor scheme to come back from the provider, got %q", state.Scheme)
+	}
+}
+
+func TestSSOReplay(t *testing.T) {
+	idp := newMockIdP(t)
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	s := New(WithSSO(SSOOptions{
+		Issuer:       idp.server.URL,
+		ClientID:     "warp",
+		ClientSecret: "client-secret",
+		LoginURL:     srv.URL,
+		Secret:       strings.Repeat("s", 32),
+	}))
+	s.Inspector().Enable("app.example.com")
+	mux.Handle("/", s.Routes())
+
+	client := dialTestClient(t, srv)
+	registered := registerFrame(client, RegisterMessage{Domain: "app.example.com", Access: &AccessPolicy{
+		SSO: &SSOPolicy{Emails: []string{"*@example.com"}},
+	}})
+	if registered.Type != "registered" {
+		t.Fatalf("expected the registration to succeed, got %+v", registered)
+	}
+	seen := make(chan testFrame, 4)
+	client.serve(func(req testFrame, body []byte) testResponse {
+		seen <- req
+		return testResponse{status: http.StatusOK}
+	})
+	key, _ := base64.StdEncoding.DecodeString(registered.IdentityKey)
+	identityOf := func(req testFrame) Identity {
+		t.Helper()
+		signature, _ := base64.RawURLEncoding.DecodeString(req.Headers[IdentitySignatureHeader])
+		if !ed25519.Verify(key, []byte(req.Headers[IdentityHeader]), signature) {
+			t.Fatalf("expected a signed identity, got %v", req.Headers)
+		}
+		var identity Identity
+		data, _ := base64.RawURLEncoding.DecodeString(req.Headers[IdentityHeader])
+		if err := json.Unmarshal(data, &identity); err != nil {
+			t.Fatal(err)
+		}
+		return identity
+	}
+
+	idp.signIn(map[string]any{"sub": "42", "email": "ada@example.com", "email_verified": true})
+	resp, err := browser(t, srv, idp.server).Get("http://app.example.com/preview")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected to sign in, got %v", resp.StatusCode)
+	}
+	<-seen
+	captures := s.Inspector().Captures(CaptureFilter{})
+	if len(captures) != 1 || captures[0].Identity == nil || captures[0].Identity.Subject != "42" {
+		t.Fatalf("expected the capture to record the visitor identity, got %+v", captures)
+	}
+
+	result, err := s.Replay(context.Background(), captures[0].ID, ReplayEdits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Replay.Status != http.StatusOK {
+		t.Fatalf("expected the replay to reach the client instead of the provider, got %v", result.Replay.Status)
+	}
+	req := <-seen
+	if identity := identityOf(req); identity.Subject != "42" || identity.RequestID != req.ID || identity.Domain != "app.example.com" {
+		t.Errorf("expected the replay to carry the original visitor bound to its own request, got %+v", identity)
+	}
+
+	// captures taken before the domain was behind single sign on have no visitor to forward
+	s.Inspector().mu.Lock()
+	for _, c := range s.Inspector().captures {
+		if c != nil {
+			c.Identity = nil
+		}
+	}
+	s.Inspector().mu.Unlock()
+	if _, err := s.Replay(context.Background(), captures[0].ID, ReplayEdits{}); err != nil {
+		t.Fatal(err)
+	}
+	if identity := identityOf(<-seen); identity.Subject != ReplaySubject {
+		t.Errorf("expected the replay to be signed as the server, got %+v", identity)
+	}
+}
+
+func TestSSOCallbackRequiresBrowserNonce(t *testing.T) {
+	idp := newMockIdP(t)
+	s := New(WithSSO(SSOOptions{
+		Issuer:   idp.server.URL,
+		ClientID: "warp",
+		LoginURL: "https://login.example.com",
+		Secret:   strings.Repeat("s", 32),
+	}))
+	state, err := s.sso.sign("state", time.Minute, loginState{Domain: "app.example.com", Scheme: "https", Return: "/", Nonce: "n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	s.Routes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://login.example.com"+ssoCallbackPath+"?code=c&state="+url.QueryEscape(state), nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a callback without the nonce cookie to be refused, got %v", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	s.Routes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://app.example.com"+ssoSessionPath+"?ticket="+url.QueryEscape(state), nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a state token to be refused as a ticket, got %v", rr.Code)
+	}
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets of the StateStore
+const (
+	// BucketReservations maps an account to its reserved subdomain label
+	BucketReservations = "reservations"
+	// BucketVerifiedDomains maps an account and a domain, joined by a slash, to when it was verified
+	BucketVerifiedDomains = "verified-domains"
+	// BucketAPIKeys maps an account to the APIKey issued for it
+	BucketAPIKeys = "api-keys"
+	// BucketDomainSettings maps a domain to its DomainSettings
+	BucketDomainSettings = "domain-settings"
+)
+
+// StateBuckets are the buckets of the StateStore
+var StateBuckets = []string{BucketReservations, BucketVerifiedDomains, BucketAPIKeys, BucketDomainSettings}
+
+// StateStore is an interface for the registration state kept across restarts, the values are
+// JSON documents grouped in buckets
+type StateStore interface {
+	// Get returns the value of a key
+	Get(bucket, key string) ([]byte, bool, error)
+	// Put sets the value of a key
+	Put(bucket, key string, value []byte) error
+	// Delete removes a key, missing keys are not an error
+	Delete(bucket, key string) error
+	// List returns every key and value of a bucket
+	List(bucket string) (map[string][]byte, error)
+}
+
+// WithStateStore is an option to keep the API keys and the domain settings in store
+func WithStateStore(store StateStore) ServerOption {
+	return func(o *ServerOpts) {
+		o.state = store
+	}
+}
+
+// MemoryStateStore is a StateStore kept in the process, its state is lost on restart
+type MemoryStateStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+// NewMemoryStateStore is a function to create an empty in-process state store
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{buckets: map[string]map[string][]byte{}}
+}
+
+// Get is a method to return the value of a key
+func (m *MemoryStateStore) Get(bucket, key string) ([]byte, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	value, ok := m.buckets[bucket][key]
+	return value, ok, nil
+}
+
+// Put is a method to set the value of a key
+func (m *MemoryStateStore) Put(bucket, key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.buckets[bucket] == nil {
+		m.buckets[bucket] = map[string][]byte{}
+	}
+	m.buckets[bucket][key] = append([]byte{}, value...)
+	return nil
+}
+
+// Delete is a method to remove a key
+func (m *MemoryStateStore) Delete(bucket, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.buckets[bucket], key)
+	return nil
+}
+
+// List is a method to return every key and value of a bucket
+func (m *MemoryStateStore) List(bucket string) (map[string][]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entries := map[string][]byte{}
+	for key, value := range m.buckets[bucket] {
+		entries[key] = value
+	}
+	return entries, nil
+}
+
+// putJSON stores a value as a JSON document
+func putJSON(store StateStore, bucket, key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return store.Put(bucket, key, data)
+}
+
+// getJSON reads a JSON document into value, returning whether the key exists
+func getJSON(store StateStore, bucket, key string, value any) (bool, error) {
+	data, ok, err := store.Get(bucket, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return false, fmt.Errorf("invalid %s entry %s: %v", bucket, key, err)
+	}
+	return true, nil
+}
+
+// APIKey is a struct to describe an API key issued through the admin API, the key itself is
+// only shown once and the store keeps its account id
+type APIKey struct {
+	Account   string    `json:"account"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// IssueAPIKey is a method to create a new API key tunnel clients can register with, other keys
+// are still accepted until the policy requires an API key
+func (s *Server) IssueAPIKey(name string) (string, APIKey, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIKey{}, err
+	}
+	key := "wk_" + base64.RawURLEncoding.EncodeToString(secret)
+	issued := APIKey{Account: accountID(key), Name: name, CreatedAt: time.Now().UTC()}
+	if err := putJSON(s.opts.state, BucketAPIKeys, issued.Account, issued); err != nil {
+		return "", APIKey{}, err
+	}
+	if policy := s.policy.Load(); !policy.requiresAPIKey() {
+		s.opts.logger.Warn("api key issued while any key is accepted, require an api key to only accept the issued ones", "name", name)
+	}
+	return key, issued, nil
+}
+
+// APIKeys is a method to return the API keys issued through the admin API sorted by creation
+func (s *Server) APIKeys() ([]APIKey, error) {
+	entries, err := s.opts.state.List(BucketAPIKeys)
+	if err != nil {
+		return nil, err
+	}
+	keys := []APIKey{}
+	for account, data := range entries {
+		var key APIKey
+		if err := json.Unmarshal(data, &key); err != nil {
+			return nil, fmt.Errorf("invalid %s entry %s: %v", BucketAPIKeys, account, err)
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+// RevokeAPIKey is a method to stop accepting an issued API key, returning whether it existed
+func (s *Server) RevokeAPIKey(account string) (bool, error) {
+	_, ok, err := s.opts.state.Get(BucketAPIKeys, account)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, s.opts.state.Delete(BucketAPIKeys, account)
+}
+
+// authorize checks the API key of a register message against the policy keys and the issued
+// keys, any key is accepted when the policy does not require one
+func (s *Server) authorize(apiKey string) error {
+	policy := s.policy.Load()
+	if policy.authorize(apiKey) == nil {
+		return nil
+	}
+	_, ok, err := s.opts.state.Get(BucketAPIKeys, accountID(apiKey))
+	if err != nil {
+		return fmt.Errorf("could not check the api key: %v", err)
+	}
+	if !ok {
+		return fmt.Errorf("invalid api key")
+	}
+	return nil
+}
+
+// DomainSettings is a struct to hold the settings admins set for a domain, they apply to every
+// client linking the domain
+type DomainSettings struct {
+	// Inspect turns on the traffic inspector capture mode for the domain
+	Inspect bool `json:"inspect,omitempty"`
+	// Access restricts the visitors of the domain, it replaces the policy declared by the client
+	Access *AccessPolicy `json:"access,omitempty"`
+}
+
+// Validate is a method to check the domain settings
+func (d DomainSettings) Validate() error {
+	if d.Access != nil {
+		if err := d.Access.Validate(); err != nil {
+			return fmt.Errorf("access: %v", err)
+		}
+	}
+	return nil
+}
+
+// DomainSettings is a method to return the settings of a domain, the zero value when none are set
+func (s *Server) DomainSettings(domain string) (DomainSettings, error) {
+	var settings DomainSettings
+	_, err := getJSON(s.opts.state, BucketDomainSettings, strings.ToLower(domain), &settings)
+	return settings, err
+}
+
+// SetDomainSettings is a method to store the settings of a domain, they apply right away
+func (s *Server) SetDomainSettings(domain string, settings DomainSettings) error {
+	domain = strings.ToLower(domain)
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	if err := putJSON(s.opts.state, BucketDomainSettings, domain, settings); err != nil {
+		return err
+	}
+	s.setDomainAccess(domain, settings.Access)
+	if settings.Inspect {
+		s.opts.inspector.Enable(domain)
+	} else {
+		s.opts.inspector.Disable(domain)
+	}
+	return nil
+}
+
+// DeleteDomainSettings is a method to drop the settings of a domain, returning whether it had any
+func (s *Server) DeleteDomainSettings(domain string) (bool, error) {
+	domain = strings.ToLower(domain)
+	var settings DomainSettings
+	ok, err := getJSON(s.opts.state, BucketDomainSettings, domain, &settings)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := s.opts.state.Delete(BucketDomainSettings, domain); err != nil {
+		return false, err
+	}
+	s.setDomainAccess(domain, nil)
+	// the captures the settings turned on stop with them
+	if settings.Inspect {
+		s.opts.inspector.Disable(domain)
+	}
+	return true, nil
+}
+
+// AllDomainSettings is a method to return the settings of every domain
+func (s *Server) AllDomainSettings() (map[string]DomainSettings, error) {
+	entries, err := s.opts.state.List(BucketDomainSettings)
+	if err != nil {
+		return nil, err
+	}
+	all := map[string]DomainSettings{}
+	for domain, data := range entries {
+		var settings DomainSettings
+		if err := json.Unmarshal(data, &settings); err != nil {
+			return nil, fmt.Errorf("invalid %s entry %s: %v", BucketDomainSettings, domain, err)
+		}
+		all[domain] = settings
+	}
+	return all, nil
+}
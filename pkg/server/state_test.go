@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func adminJSONRequest(t *testing.T, handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestIssuedAPIKeys(t *testing.T) {
+	s := New(WithPolicy(Policy{RequireAPIKey: true}))
+	admin := s.AdminRoutes("secret")
+	srv := httptest.NewServer(s.Routes())
+	t.Cleanup(srv.Close)
+
+	rr := adminJSONRequest(t, admin, "POST", "/apikeys", `{"name":"ci"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got status %v want %v", rr.Code, http.StatusCreated)
+	}
+	var issued struct {
+		APIKey
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &issued); err != nil {
+		t.Fatal(err)
+	}
+	if issued.Account != accountID(issued.Key) || issued.Name != "ci" {
+		t.Errorf("unexpected issued key %+v", issued)
+	}
+	if rr := adminJSONRequest(t, admin, "GET", "/apikeys", ""); strings.Contains(rr.Body.String(), issued.Key) {
+		t.Error("expected the key itself to be shown only once")
+	}
+
+	client := dialTestClient(t, srv)
+	if frame := registerFrame(client, RegisterMessage{APIKey: issued.Key, Domain: "app.example.com"}); frame.Type != "registered" {
+		t.Errorf("expected the issued key to be accepted, got %q", frame.Type)
+	}
+	if frame := registerFrame(client, RegisterMessage{APIKey: "anything", Domain: "other.example.com"}); frame.Type != "error" {
+		t.Errorf("expected an unknown key to be rejected, got %q", frame.Type)
+	}
+
+	if rr := adminJSONRequest(t, admin, "DELETE", "/apikeys/"+issued.Account, ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("revoke: got status %v want %v", rr.Code, http.StatusNoContent)
+	}
+	if rr := adminJSONRequest(t, admin, "DELETE", "/apikeys/"+issued.Account, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("revoke twice: got status %v want %v", rr.Code, http.StatusNotFound)
+	}
+	s.SetPolicy(Policy{APIKeys: []string{"static"}})
+	if frame := registerFrame(client, RegisterMessage{APIKey: issued.Key, Domain: "third.example.com"}); frame.Type != "error" {
+		t.Errorf("expected the revoked key to be rejected, got %q", frame.Type)
+	}
+}
+
+func TestIssuedAPIKeysOpenPolicy(t *testing.T) {
+	s := New()
+	srv := httptest.NewServer(s.Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	key, _, err := s.IssueAPIKey("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// issuing a key does not lock out the clients already registering without one
+	if frame := registerFrame(client, RegisterMessage{APIKey: "anything", Domain: "app.example.com"}); frame.Type != "registered" {
+		t.Errorf("expected any key to be accepted by an open policy, got %q: %s", frame.Type, frame.Message)
+	}
+	s.SetPolicy(Policy{RequireAPIKey: true})
+	if frame := registerFrame(client, RegisterMessage{APIKey: "anything", Domain: "other.example.com"}); frame.Type != "error" {
+		t.Errorf("expected an unknown key to be rejected once a key is required, got %q", frame.Type)
+	}
+	if frame := registerFrame(client, RegisterMessage{APIKey: key, Domain: "other.example.com"}); frame.Type != "registered" {
+		t.Errorf("expected the issued key to be accepted, got %q: %s", frame.Type, frame.Message)
+	}
+}
+
+func TestDomainSettings(t *testing.T) {
+	s := New()
+	admin := s.AdminRoutes("secret")
+
+	if rr := adminJSONRequest(t, admin, "PUT", "/settings/App.example.com", `{"inspect":true}`); rr.Code != http.StatusOK {
+		t.Fatalf("got status %v want %v", rr.Code, http.StatusOK)
+	}
+	if !s.Inspector().Enabled("app.example.com") {
+		t.Error("expected the settings to turn the inspector on")
+	}
+	if rr := adminJSONRequest(t, admin, "PUT", "/settings/app.example.com", `{"inspects":true}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown setting: got status %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	var all map[string]DomainSettings
+	json.Unmarshal(adminJSONRequest(t, admin, "GET", "/settings", "").Body.Bytes(), &all)
+	if !all["app.example.com"].Inspect || len(all) != 1 {
+		t.Errorf("unexpected settings %+v", all)
+	}
+
+	if rr := adminJSONRequest(t, admin, "DELETE", "/settings/app.example.com", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("got status %v want %v", rr.Code, http.StatusNoContent)
+	}
+	if s.Inspector().Enabled("app.example.com") {
+		t.Error("expected the inspector to stop with the settings")
+	}
+	if rr := adminJSONRequest(t, admin, "GET", "/settings/app.example.com", ""); rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != "{}" {
+		t.Errorf("expected the default settings, got %v %s", rr.Code, rr.Body)
+	}
+}
+
+func TestReservationsSurviveRestart(t *testing.T) {
+	state := NewMemoryStateStore()
+	never := func(string) bool { return false }
+
+	before := NewSubdomainAllocator("tunnel.test", true)
+	if err := before.Persist(state); err != nil {
+		t.Fatal(err)
+	}
+	domain, err := before.Allocate("alice", "", never)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := before.Reserve("bob", "demo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := before.Release("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	after := NewSubdomainAllocator("tunnel.test", true)
+	if err := after.Persist(state); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := after.Allocate("alice", "", never); again != domain {
+		t.Errorf("got %q want the reservation %q", again, domain)
+	}
+	if _, ok := after.Reservation("bob"); ok {
+		t.Error("expected the released reservation to stay released")
+	}
+}
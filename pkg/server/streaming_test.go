@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// streamingResponse answers the next request received by client with the given chunks,
+// pausing between them, and returns once data-end was sent
+func streamingResponse(client *testClient, contentType string, pause time.Duration, chunks ...string) {
+	var start testFrame
+	for start.Type != "request-end" {
+		start = client.next()
+	}
+	client.send(ResponseStartMessage{
+		Type:       "response-start",
+		ID:         start.ID,
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": contentType},
+	}, nil)
+	for _, chunk := range chunks {
+		client.send(DataMessage{Type: "data", ID: start.ID}, []byte(chunk))
+		time.Sleep(pause)
+	}
+	client.send(DataEndMessage{Type: "data-end", ID: start.ID}, nil)
+}
+
+func TestServerSentEventsAreFlushed(t *testing.T) {
+	srv := httptest.NewServer(New().Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	client.register("sse.example.com")
+
+	streamed := make(chan struct{})
+	go func() {
+		defer close(streamed)
+		streamingResponse(client, "text/event-stream", 500*time.Millisecond, "data: first\n\n", "data: second\n\n")
+	}()
+	defer func() { <-streamed }()
+
+	start := time.Now()
+	resp := tunnelRequest(t, srv, "sse.example.com", http.MethodGet, "/events", nil)
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "data: first\n" {
+		t.Errorf("expected the first event, got %q", line)
+	}
+	if took := time.Since(start); took > 300*time.Millisecond {
+		t.Errorf("the first event was held back for %s", took)
+	}
+}
+
+func TestStreamingResponsesOutliveWriteTimeout(t *testing.T) {
+	srv := httptest.NewUnstartedServer(New().Routes())
+	srv.Config.WriteTimeout = 200 * time.Millisecond
+	srv.Start()
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	client.register("sse.example.com")
+
+	go streamingResponse(client, "text/event-stream", 300*time.Millisecond, "data: first\n\n", "data: second\n\n")
+	resp := tunnelRequest(t, srv, "sse.example.com", http.MethodGet, "/events", nil)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "data: first\n\ndata: second\n\n" {
+		t.Errorf("expected the whole stream past the write timeout, got %q", body)
+	}
+}
+
+func TestStreamingVisitorNotReading(t *testing.T) {
+	s := New()
+	srv := httptest.NewServer(s.Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	client.register("events.example.com")
+
+	// the visitor sends its request and never reads the response
+	visitor, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	io.WriteString(visitor, "GET /events HTTP/1.1\r\nHost: events.example.com\r\n\r\n")
+	start := waitRequest(client)
+	client.send(ResponseStartMessage{
+		Type:       "response-start",
+		ID:         start.ID,
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": "text/event-stream"},
+	}, nil)
+	// more than the queue and the socket buffers hold
+	frame, err := createMessage(DataMessage{Type: "data", ID: start.ID}, make([]byte, 256*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		for i := 0; i < 128; i++ {
+			if client.ws.WriteMessage(websocket.BinaryMessage, frame) != nil {
+				return
+			}
+		}
+	}()
+
+	responses := visitorRequest(srv, "events.example.com")
+	other := waitRequest(client)
+	client.send(ResponseStartMessage{Type: "response-start", ID: other.ID, StatusCode: http.StatusOK}, nil)
+	client.send(DataMessage{Type: "data", ID: other.ID}, []byte("ok"))
+	client.send(DataEndMessage{Type: "data-end", ID: other.ID}, nil)
+	// a duplicate data-end is refused instead of closing the response again
+	client.send(DataEndMessage{Type: "data-end", ID: other.ID}, nil)
+	select {
+	case resp := <-responses:
+		if resp == nil {
+			t.Fatal("expected the other request to be answered")
+		}
+		defer resp.Body.Close()
+		if body, _ := io.ReadAll(resp.Body); string(body) != "ok" {
+			t.Errorf("unexpected response %q", body)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected a visitor that stopped reading not to hold the tunnel")
+	}
+}
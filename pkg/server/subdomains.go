@@ -0,0 +1,205 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// maxSubdomainAttempts bounds the generation of a free random subdomain
+const maxSubdomainAttempts = 32
+
+var (
+	dnsLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+	subdomainAdjectives = []string{
+		"brave", "calm", "clever", "eager", "fancy", "gentle", "happy", "jolly", "kind", "lively",
+		"lucky", "mighty", "nimble", "proud", "quick", "quiet", "rapid", "shiny", "silly", "swift",
+		"tidy", "witty", "zesty", "bold", "bright", "cosmic", "crisp", "daring", "fuzzy", "sunny",
+	}
+	subdomainAnimals = []string{
+		"otter", "badger", "falcon", "panda", "koala", "lynx", "heron", "bison", "gecko", "walrus",
+		"beaver", "marmot", "osprey", "puffin", "tapir", "yak", "zebra", "ibis", "moose", "newt",
+		"orca", "quokka", "raven", "sloth", "toucan", "vole", "wombat", "alpaca", "dingo", "ferret",
+	}
+)
+
+// accountID derives the account identifier of an API key, so raw keys are never kept around
+func accountID(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// SubdomainAllocator is a struct to hand out subdomains of a base domain, optionally
+// keeping a stable reservation per account
+type SubdomainAllocator struct {
+	base    string
+	reserve bool
+
+	mu sync.Mutex
+	// owners maps a reserved label to its account
+	owners map[string]string
+	// labels maps an account to its reserved label
+	labels map[string]string
+	// store keeps the reservations across restarts when set
+	store StateStore
+}
+
+// NewSubdomainAllocator creates an allocator for base, reserving the first subdomain of each account when reserve is set
+func NewSubdomainAllocator(base string, reserve bool) *SubdomainAllocator {
+	return &SubdomainAllocator{
+		base:    strings.ToLower(strings.Trim(base, ".")),
+		reserve: reserve,
+		owners:  map[string]string{},
+		labels:  map[string]string{},
+	}
+}
+
+// Base returns the base domain
+func (a *SubdomainAllocator) Base() string {
+	return a.base
+}
+
+// Label returns the label of domain when it is a direct subdomain of the base domain
+func (a *SubdomainAllocator) Label(domain string) (string, bool) {
+	label, ok := strings.CutSuffix(strings.ToLower(domain), "."+a.base)
+	if !ok || strings.Contains(label, ".") {
+		return "", false
+	}
+	return label, true
+}
+
+// Persist loads the reservations kept in store and records the next changes into it
+func (a *SubdomainAllocator) Persist(store StateStore) error {
+	entries, err := store.List(BucketReservations)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for account, data := range entries {
+		var label string
+		if err := json.Unmarshal(data, &label); err != nil {
+			return fmt.Errorf("invalid %s entry %s: %v", BucketReservations, account, err)
+		}
+		a.owners[label] = account
+		a.labels[account] = label
+	}
+	a.store = store
+	return nil
+}
+
+// Reservation returns the label reserved by an account
+func (a *SubdomainAllocator) Reservation(account string) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	label, ok := a.labels[account]
+	return label, ok
+}
+
+// Reserve records label as the stable subdomain of account
+func (a *SubdomainAllocator) Reserve(account, label string) error {
+	if !dnsLabel.MatchString(label) {
+		return fmt.Errorf("invalid subdomain %q", label)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if owner, ok := a.owners[label]; ok && owner != account {
+		return fmt.Errorf("subdomain %q is reserved", label)
+	}
+	if a.store != nil {
+		if err := putJSON(a.store, BucketReservations, account, label); err != nil {
+			return fmt.Errorf("could not store the reservation: %v", err)
+		}
+	}
+	if previous, ok := a.labels[account]; ok {
+		delete(a.owners, previous)
+	}
+	a.owners[label] = account
+	a.labels[account] = label
+	return nil
+}
+
+// Release drops the reservation of an account
+func (a *SubdomainAllocator) Release(account string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	label, ok := a.labels[account]
+	if !ok {
+		return nil
+	}
+	if a.store != nil {
+		if err := a.store.Delete(BucketReservations, account); err != nil {
+			return fmt.Errorf("could not drop the reservation: %v", err)
+		}
+	}
+	delete(a.owners, label)
+	delete(a.labels, account)
+	return nil
+}
+
+// Allowed returns whether account may use label
+func (a *SubdomainAllocator) Allowed(account, label string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	owner, ok := a.owners[label]
+	return !ok || owner == account
+}
+
+// Allocate returns the domain an account gets for the requested label, an empty label
+// picks the account reservation or a new random one; taken reports domains already in use.
+// An empty account is a client without an API key, it shares nothing and reserves nothing.
+func (a *SubdomainAllocator) Allocate(account, requested string, taken func(domain string) bool) (string, error) {
+	requested = strings.ToLower(requested)
+	if requested != "" {
+		if !dnsLabel.MatchString(requested) {
+			return "", fmt.Errorf("invalid subdomain %q", requested)
+		}
+		if !a.Allowed(account, requested) {
+			return "", fmt.Errorf("subdomain %q is reserved", requested)
+		}
+		if taken(a.domain(requested)) {
+			return "", fmt.Errorf("subdomain %q is in use", requested)
+		}
+		return a.domain(requested), nil
+	}
+	if label, ok := a.Reservation(account); ok && account != "" {
+		// another tunnel of the account may be serving its reservation
+		if taken(a.domain(label)) {
+			return "", fmt.Errorf("subdomain %q is in use", label)
+		}
+		return a.domain(label), nil
+	}
+	for attempt := 0; attempt < maxSubdomainAttempts; attempt++ {
+		label := randomLabel()
+		if !a.Allowed(account, label) || taken(a.domain(label)) {
+			continue
+		}
+		if a.reserve && account != "" {
+			if err := a.Reserve(account, label); err != nil {
+				continue
+			}
+		}
+		return a.domain(label), nil
+	}
+	return "", fmt.Errorf("could not find a free subdomain of %s", a.base)
+}
+
+// domain returns the full domain of a label
+func (a *SubdomainAllocator) domain(label string) string {
+	return label + "." + a.base
+}
+
+// randomLabel returns a readable random label such as brave-otter-42
+func randomLabel() string {
+	return fmt.Sprintf("%s-%s-%d",
+		subdomainAdjectives[rand.IntN(len(subdomainAdjectives))],
+		subdomainAnimals[rand.IntN(len(subdomainAnimals))],
+		rand.IntN(100),
+	)
+}
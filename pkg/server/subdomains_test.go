@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestRegisterAssignsSubdomain(t *testing.T) {
+	s := New(WithSubdomains(NewSubdomainAllocator("tunnel.test", true)))
+	srv := httptest.NewServer(s.Routes())
+	defer srv.Close()
+
+	alice := dialTestClient(t, srv)
+	alice.send(RegisterMessage{Type: "register", ID: "1", APIKey: "alice"}, nil)
+	frame := alice.next()
+	if !regexp.MustCompile(`^[a-z]+-[a-z]+-\d+\.tunnel\.test$`).MatchString(frame.Domain) {
+		t.Fatalf("unexpected assigned domain %q", frame.Domain)
+	}
+	assigned := frame.Domain
+
+	alice.send(RegisterMessage{Type: "register", ID: "2", APIKey: "alice"}, nil)
+	if frame := alice.next(); frame.Domain != assigned {
+		t.Errorf("expected the reserved subdomain %q again, got %q", assigned, frame.Domain)
+	}
+
+	bob := dialTestClient(t, srv)
+	bob.send(RegisterMessage{Type: "register", ID: "3", APIKey: "bob", Domain: assigned}, nil)
+	if frame := bob.next(); frame.Type != "error" || frame.ID != "3" {
+		t.Errorf("expected bob to be refused alice's reservation, got %+v", frame)
+	}
+	bob.send(RegisterMessage{Type: "register", ID: "4", APIKey: "bob", Subdomain: "demo"}, nil)
+	if frame := bob.next(); frame.Domain != "demo.tunnel.test" {
+		t.Errorf("expected the requested label, got %+v", frame)
+	}
+	alice.send(RegisterMessage{Type: "register", ID: "5", APIKey: "alice", Subdomain: "demo"}, nil)
+	if frame := alice.next(); frame.Type != "error" {
+		t.Errorf("expected a subdomain in use to be refused, got %+v", frame)
+	}
+}
+
+func TestRegisterRefusesSubdomainInUse(t *testing.T) {
+	s := New(WithSubdomains(NewSubdomainAllocator("tunnel.test", false)))
+	srv := httptest.NewServer(s.Routes())
+	defer srv.Close()
+
+	alice := dialTestClient(t, srv)
+	alice.send(RegisterMessage{Type: "register", ID: "1", APIKey: "alice"}, nil)
+	assigned := alice.next().Domain
+	aliceID := s.DomainClients()[assigned]
+
+	bob := dialTestClient(t, srv)
+	for _, domain := range []string{assigned, assigned + "/api"} {
+		if frame := registerFrame(bob, RegisterMessage{APIKey: "bob", Domain: domain}); frame.Type != "error" {
+			t.Errorf("%s: expected a generated subdomain in use to be refused, got %+v", domain, frame)
+		}
+	}
+	if owner := s.DomainClients()[assigned]; owner != aliceID {
+		t.Errorf("expected %s to stay with its client, got %q", assigned, owner)
+	}
+	// the client holding the subdomain can register it again
+	alice.send(RegisterMessage{Type: "register", ID: "3", APIKey: "alice", Domain: assigned}, nil)
+	if frame := alice.next(); frame.Type != "registered" {
+		t.Errorf("expected the holder to register its subdomain, got %+v", frame)
+	}
+}
+
+func TestRegisterRefusesSubdomainInUseOnAnotherNode(t *testing.T) {
+	registry := NewMemoryRegistry()
+	s := New(WithSubdomains(NewSubdomainAllocator("tunnel.test", false)), WithRouteRegistry(registry))
+	srv := httptest.NewServer(s.Routes())
+	defer srv.Close()
+	err := registry.Claim(context.Background(), "demo.tunnel.test/api", Owner{Node: "other", ClientID: "remote"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := dialTestClient(t, srv)
+	if frame := registerFrame(client, RegisterMessage{Domain: "demo.tunnel.test"}); frame.Type != "error" {
+		t.Errorf("expected a subdomain with a prefix route on another node to be refused, got %+v", frame)
+	}
+}
+
+func TestRegisterReservationInUse(t *testing.T) {
+	s := New(WithSubdomains(NewSubdomainAllocator("tunnel.test", true)))
+	srv := httptest.NewServer(s.Routes())
+	defer srv.Close()
+
+	first := dialTestClient(t, srv)
+	anonymous := registerFrame(first, RegisterMessage{}).Domain
+	firstID := s.DomainClients()[anonymous]
+	second := dialTestClient(t, srv)
+	if frame := registerFrame(second, RegisterMessage{}); frame.Type != "registered" || frame.Domain == anonymous {
+		t.Errorf("expected clients without an API key to get their own subdomain, got %+v", frame)
+	}
+
+	reserved := registerFrame(first, RegisterMessage{APIKey: "alice"}).Domain
+	if frame := registerFrame(second, RegisterMessage{APIKey: "alice"}); frame.Type != "error" {
+		t.Errorf("expected a reservation served by another tunnel to be refused, got %+v", frame)
+	}
+	if owner := s.DomainClients()[reserved]; owner != firstID {
+		t.Errorf("expected %s to stay with its client, got %q", reserved, owner)
+	}
+	if owner := s.DomainClients()[anonymous]; owner != firstID {
+		t.Errorf("expected %s to stay with its client, got %q", anonymous, owner)
+	}
+}
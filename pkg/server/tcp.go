@@ -0,0 +1,212 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// tcpReadBufferSize is the largest chunk of a TCP stream sent in a single frame
+	tcpReadBufferSize = 32 * 1024
+	// tcpWriteQueueSize bounds the client bytes waiting for a visitor to read them
+	tcpWriteQueueSize = 4 * 1024 * 1024
+	// tcpWriteTimeout bounds a single write to a visitor
+	tcpWriteTimeout = 30 * time.Second
+)
+
+// tcpStream is a visitor connection of a TCP tunnel, the bytes of the client are written from a
+// goroutine of its own so a visitor that stops reading does not hold the other frames of the tunnel
+type tcpStream struct {
+	visitor net.Conn
+	writes  chan []byte
+	queued  atomic.Int64
+	// closed is closed along with the visitor connection
+	closed chan struct{}
+}
+
+// newTCPStream creates the stream of a visitor connection
+func newTCPStream(visitor net.Conn) *tcpStream {
+	return &tcpStream{visitor: visitor, writes: make(chan []byte, 1024), closed: make(chan struct{})}
+}
+
+// write queues bytes for the visitor, returning false when the queue is full
+func (t *tcpStream) write(data []byte) bool {
+	if t.queued.Add(int64(len(data))) > tcpWriteQueueSize {
+		return false
+	}
+	select {
+	case t.writes <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// registerTCP opens a public TCP port forwarded to the client, returning the allocated port
+func (s *Server) registerTCP(conn *ServerConnState, requested int) (int, error) {
+	ports := s.opts.tcpPorts
+	if ports == nil {
+		return 0, fmt.Errorf("tcp tunnels are not enabled")
+	}
+	var listener net.Listener
+	port, err := ports.acquire(requested, func(addr string) error {
+		var err error
+		listener, err = net.Listen("tcp", addr)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	conn.addTCPListener(port, listener)
+	conn.Logger.Info("tcp tunnel opened", slog.Int("port", port))
+	go s.acceptTCP(conn, port, listener)
+	return port, nil
+}
+
+// acceptTCP turns every connection accepted on a tunnel port into a stream of the client
+func (s *Server) acceptTCP(conn *ServerConnState, port int, listener net.Listener) {
+	defer s.opts.tcpPorts.release(port)
+	for {
+		visitor, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				conn.Logger.Error("could not accept tcp connection", slog.Int("port", port), "error", err)
+				listener.Close()
+			}
+			return
+		}
+		go s.serveTCPStream(conn, port, visitor)
+	}
+}
+
+// serveTCPStream relays the bytes sent by a visitor to the client until either side closes
+func (s *Server) serveTCPStream(conn *ServerConnState, port int, visitor net.Conn) {
+	id := uuid.NewString()
+	logger := conn.Logger.With(slog.String(LogKeyMessageID, id), slog.Int("port", port))
+	stream := newTCPStream(visitor)
+	conn.tcpStreams.Store(id, stream)
+	err := conn.Ch.Send(&TCPOpenMessage{
+		Type:       "tcp-open",
+		ID:         id,
+		Port:       port,
+		RemoteAddr: visitor.RemoteAddr().String(),
+	})
+	if err != nil {
+		conn.tcpStreams.Delete(id)
+		visitor.Close()
+		return
+	}
+	logger.Debug("tcp stream opened", "remote_addr", visitor.RemoteAddr().String())
+	go s.writeTCPStream(conn, id, stream)
+	buf := make([]byte, tcpReadBufferSize)
+	for {
+		n, err := visitor.Read(buf)
+		if n > 0 {
+			conn.bytesIn.Add(int64(n))
+			// the chunk is serialized asynchronously so it must not share the read buffer
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			if conn.Ch.Send(&TCPDataMessage{Type: "tcp-data", ID: id, Data: chunk}) != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	// the client may have closed the stream already
+	if conn.closeTCPStream(id) {
+		conn.Ch.Send(&TCPCloseMessage{Type: "tcp-close", ID: id})
+	}
+	logger.Debug("tcp stream closed")
+}
+
+// writeTCPStream writes the bytes of the client to the visitor until the stream is closed, or
+// ended by the client once its bytes are written
+func (s *Server) writeTCPStream(conn *ServerConnState, id string, stream *tcpStream) {
+	for {
+		select {
+		case <-stream.closed:
+			return
+		case data, ok := <-stream.writes:
+			if !ok {
+				stream.visitor.Close()
+				return
+			}
+			stream.visitor.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+			n, err := stream.visitor.Write(data)
+			stream.queued.Add(-int64(len(data)))
+			conn.bytesOut.Add(int64(n))
+			if err != nil {
+				if conn.closeTCPStream(id) {
+					conn.Ch.Send(&TCPCloseMessage{Type: "tcp-close", ID: id, Error: err.Error()})
+				}
+				// the client may have ended the stream already
+				stream.visitor.Close()
+				return
+			}
+		}
+	}
+}
+
+// addTCPListener records a tunnel port of the client
+func (c *ServerConnState) addTCPListener(port int, listener net.Listener) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tcpListeners == nil {
+		c.tcpListeners = map[int]net.Listener{}
+	}
+	c.tcpListeners[port] = listener
+}
+
+// TCPPorts returns the public ports of the client TCP tunnels
+func (c *ServerConnState) TCPPorts() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ports := make([]int, 0, len(c.tcpListeners))
+	for port := range c.tcpListeners {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// closeTCPStream closes a visitor connection, returning whether it was still open
+func (c *ServerConnState) closeTCPStream(id string) bool {
+	stream, ok := c.tcpStreams.LoadAndDelete(id)
+	if ok {
+		close(stream.(*tcpStream).closed)
+		stream.(*tcpStream).visitor.Close()
+	}
+	return ok
+}
+
+// endTCPStream closes a visitor connection once the bytes the client sent before are written,
+// it is called from the tunnel loop only, which is the one queueing writes
+func (c *ServerConnState) endTCPStream(id string) {
+	stream, ok := c.tcpStreams.LoadAndDelete(id)
+	if ok {
+		close(stream.(*tcpStream).writes)
+	}
+}
+
+// closeTCP closes the tunnel ports of the client and every stream going through them
+func (c *ServerConnState) closeTCP() {
+	c.mu.Lock()
+	for port, listener := range c.tcpListeners {
+		listener.Close()
+		delete(c.tcpListeners, port)
+	}
+	c.mu.Unlock()
+	c.tcpStreams.Range(func(id, _ any) bool {
+		c.closeTCPStream(id.(string))
+		return true
+	})
+}
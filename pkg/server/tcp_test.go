@@ -0,0 +1,204 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// freePort returns a local port that is not in use
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestTCPTunnel(t *testing.T) {
+	port := freePort(t)
+	ports, err := NewPortRange("127.0.0.1", port, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(New(WithTCPPorts(ports)).Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+
+	client.send(RegisterMessage{Type: "register", ID: uuid.NewString(), Protocol: ProtocolTCP}, nil)
+	registered := client.next()
+	if registered.Type != "registered" || registered.Port != port {
+		t.Fatalf("expected tcp port %d to be registered, got %q %d: %s", port, registered.Type, registered.Port, registered.Message)
+	}
+	// the only port of the range is taken
+	client.send(RegisterMessage{Type: "register", ID: uuid.NewString(), Protocol: ProtocolTCP}, nil)
+	if frame := client.next(); frame.Type != "error" {
+		t.Fatalf("expected an exhausted range to be reported, got %q", frame.Type)
+	}
+
+	visitor, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	opened := client.next()
+	if opened.Type != "tcp-open" || opened.Port != port {
+		t.Fatalf("expected a tcp-open frame for port %d, got %q %d", port, opened.Type, opened.Port)
+	}
+
+	if _, err := visitor.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	data := client.next()
+	if data.Type != "tcp-data" || data.ID != opened.ID || string(data.Payload) != "ping" {
+		t.Fatalf("expected the visitor bytes to be relayed, got %q %q", data.Type, data.Payload)
+	}
+
+	client.send(&TCPDataMessage{Type: "tcp-data", ID: opened.ID}, []byte("pong"))
+	client.send(TCPCloseMessage{Type: "tcp-close", ID: opened.ID}, nil)
+	visitor.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := io.ReadAll(visitor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "pong" {
+		t.Errorf("expected the client bytes to reach the visitor, got %q", reply)
+	}
+}
+
+func TestTCPTunnelVisitorClose(t *testing.T) {
+	port := freePort(t)
+	ports, err := NewPortRange("127.0.0.1", port, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(WithTCPPorts(ports))
+	srv := httptest.NewServer(s.Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	client.send(RegisterMessage{Type: "register", ID: uuid.NewString(), Protocol: ProtocolTCP, Port: port}, nil)
+	if frame := client.next(); frame.Type != "registered" {
+		t.Fatalf("expected registered frame, got %q: %s", frame.Type, frame.Message)
+	}
+	if clients := s.Clients(); len(clients) != 1 || len(clients[0].TCPPorts) != 1 || clients[0].TCPPorts[0] != port {
+		t.Fatalf("expected the tcp port to be listed by the admin API, got %+v", clients)
+	}
+
+	visitor, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened := client.next()
+	visitor.Close()
+	closed := client.next()
+	if closed.Type != "tcp-close" || closed.ID != opened.ID {
+		t.Fatalf("expected the visitor close to be relayed, got %q", closed.Type)
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	ports, err := ParsePortRange("", "20000-20100")
+	if err != nil || ports.First != 20000 || ports.Last != 20100 {
+		t.Fatalf("unexpected range %+v: %v", ports, err)
+	}
+	if ports, err = ParsePortRange("", "2222"); err != nil || ports.First != 2222 || ports.Last != 2222 {
+		t.Fatalf("unexpected single port range %+v: %v", ports, err)
+	}
+	for _, spec := range []string{"", "a-b", "20-10", "0-10", "1-70000"} {
+		if _, err := ParsePortRange("", spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestTCPTunnelVisitorNotReading(t *testing.T) {
+	port := freePort(t)
+	ports, err := NewPortRange("127.0.0.1", port, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(New(WithTCPPorts(ports)).Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	if frame := registerFrame(client, RegisterMessage{Protocol: ProtocolTCP}); frame.Type != "registered" {
+		t.Fatalf("expected registered frame, got %q: %s", frame.Type, frame.Message)
+	}
+	visitor, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	opened := client.next()
+
+	// more than the queue and the socket buffers hold, the visitor never reads
+	chunk := make([]byte, 256*1024)
+	frame, err := createMessage(&TCPDataMessage{Type: "tcp-data", ID: opened.ID}, chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register, err := createMessage(RegisterMessage{Type: "register", ID: "http", Domain: "app.example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		for i := 0; i < 96; i++ {
+			if client.ws.WriteMessage(websocket.BinaryMessage, frame) != nil {
+				return
+			}
+		}
+		client.ws.WriteMessage(websocket.BinaryMessage, register)
+	}()
+
+	closed, registered := false, false
+	for !closed || !registered {
+		switch frame := client.next(); {
+		case frame.Type == "tcp-close" && frame.ID == opened.ID:
+			if frame.Error == "" {
+				t.Error("expected the close of a stuck stream to tell why")
+			}
+			closed = true
+		case frame.ID == "http":
+			if frame.Type != "registered" {
+				t.Fatalf("expected the registration to succeed, got %+v", frame)
+			}
+			registered = true
+		}
+	}
+}
+
+func TestTCPTunnelLimit(t *testing.T) {
+	port := freePort(t)
+	ports, err := NewPortRange("127.0.0.1", port, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(New(WithTCPPorts(ports), WithPolicy(Policy{MaxDomainsPerClient: 1})).Routes())
+	t.Cleanup(srv.Close)
+
+	client := dialTestClient(t, srv)
+	if frame := registerFrame(client, RegisterMessage{Domain: "app.example.com"}); frame.Type != "registered" {
+		t.Fatalf("expected registered frame, got %q: %s", frame.Type, frame.Message)
+	}
+	if frame := registerFrame(client, RegisterMessage{Protocol: ProtocolTCP}); frame.Type != "error" || !strings.Contains(frame.Message, "tunnels") {
+		t.Errorf("expected a port to count against the tunnels limit, got %q: %s", frame.Type, frame.Message)
+	}
+
+	other := dialTestClient(t, srv)
+	if frame := registerFrame(other, RegisterMessage{Protocol: ProtocolTCP}); frame.Type != "registered" {
+		t.Fatalf("expected registered frame, got %q: %s", frame.Type, frame.Message)
+	}
+	if frame := registerFrame(other, RegisterMessage{Domain: "api.example.com"}); frame.Type != "error" || !strings.Contains(frame.Message, "tunnels") {
+		t.Errorf("expected a domain to count against the tunnels limit, got %q: %s", frame.Type, frame.Message)
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/mcandeia/warp-go-server/pkg/server"
+
+// propagator is the W3C trace context propagator used between visitors, the server and tunnel clients
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// NewOTLPTracerProvider creates a tracer provider that exports spans over OTLP/HTTP to endpointURL
+func NewOTLPTracerProvider(ctx context.Context, endpointURL string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpointURL))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName("warp-go-server"),
+	))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	), nil
+}
+
+// requestTrace holds the spans of a tunneled request
+type requestTrace struct {
+	mu     sync.Mutex
+	tracer trace.Tracer
+	ctx    context.Context
+	wait   trace.Span
+	body   trace.Span
+}
+
+// startRequestTrace starts the edge span of a request, joining the visitor trace when present
+func (s *Server) startRequestTrace(r *http.Request, host string) (*requestTrace, trace.Span) {
+	tracer := s.opts.tracerProvider.Tracer(tracerName)
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "tunnel.request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+			semconv.ServerAddress(host),
+			semconv.UserAgentOriginal(r.UserAgent()),
+		),
+	)
+	return &requestTrace{tracer: tracer, ctx: ctx}, span
+}
+
+// inject writes the trace context of the request into the message sent to the tunnel client
+func (t *requestTrace) inject(msg *RequestStartMessage) {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(t.ctx, carrier)
+	msg.TraceParent = carrier.Get("traceparent")
+	msg.TraceState = carrier.Get("tracestate")
+	for _, key := range carrier.Keys() {
+		msg.Headers[http.CanonicalHeaderKey(key)] = carrier.Get(key)
+	}
+}
+
+// waitingResponse starts the span measuring the time until the tunnel client starts responding
+func (t *requestTrace) waitingResponse() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, t.wait = t.tracer.Start(t.ctx, "tunnel.wait_response_start", trace.WithSpanKind(trace.SpanKindClient))
+}
+
+// responseStarted ends the waiting span and starts the body streaming span
+func (t *requestTrace) responseStarted(statusCode int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.wait != nil {
+		t.wait.SetAttributes(semconv.HTTPResponseStatusCode(statusCode))
+		t.wait.End()
+		t.wait = nil
+	}
+	_, t.body = t.tracer.Start(t.ctx, "tunnel.response_body")
+}
+
+// responseEnded ends the body streaming span, recording the client error if any
+func (t *requestTrace) responseEnded(clientErr any) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.body != nil && clientErr != nil {
+		t.body.SetStatus(codes.Error, "tunnel client reported an error")
+		t.body.SetAttributes(attribute.String("tunnel.error", fmt.Sprint(clientErr)))
+	}
+	t.end()
+}
+
+// end ends any span still open
+func (t *requestTrace) end() {
+	if t.wait != nil {
+		t.wait.End()
+		t.wait = nil
+	}
+	if t.body != nil {
+		t.body.End()
+		t.body = nil
+	}
+}
+
+// finish ends the open child spans and the edge span
+func (t *requestTrace) finish(span trace.Span, statusCode int) {
+	t.mu.Lock()
+	t.end()
+	t.mu.Unlock()
+	if statusCode != 0 {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(statusCode))
+	}
+	if statusCode == 0 || statusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(statusCode))
+	}
+	span.End()
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collectorStandIn is an OTLP/HTTP endpoint recording the names of the exported spans
+type collectorStandIn struct {
+	mu    sync.Mutex
+	spans map[string]bool
+}
+
+func (c *collectorStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil || r.URL.Path != "/v1/traces" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var req coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, resourceSpans := range req.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			for _, span := range scopeSpans.Spans {
+				c.spans[span.Name] = true
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestTracingExportsTunnelSpans(t *testing.T) {
+	collector := &collectorStandIn{spans: map[string]bool{}}
+	collectorSrv := httptest.NewServer(collector)
+	defer collectorSrv.Close()
+
+	tracerProvider, err := NewOTLPTracerProvider(context.Background(), collectorSrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	traceParents := make(chan string, 1)
+	s := New(WithTracerProvider(tracerProvider))
+	srv := newTunnel(t, s, "example.test", func(req testFrame, body []byte) testResponse {
+		traceParents <- req.TraceParent
+		return testResponse{status: http.StatusOK, chunks: [][]byte{[]byte("ok")}}
+	})
+
+	const visitorTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest("GET", srv.URL+"/", nil)
+	req.Host = "example.test"
+	req.Header.Set("traceparent", "00-"+visitorTraceID+"-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if traceParent := <-traceParents; !strings.HasPrefix(traceParent, "00-"+visitorTraceID+"-") {
+		t.Errorf("request-start carried unexpected traceparent %q", traceParent)
+	}
+	if err := tracerProvider.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	for _, name := range []string{"tunnel.request", "tunnel.wait_response_start", "tunnel.response_body"} {
+		if _, ok := collector.spans[name]; !ok {
+			t.Errorf("collector did not receive span %q, got %v", name, collector.spans)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultUDPIdleTimeout is how long a UDP session lives without datagrams in either direction
+const DefaultUDPIdleTimeout = time.Minute
+
+// udpReadBufferSize fits the largest UDP datagram
+const udpReadBufferSize = 64 * 1024
+
+// udpTunnel is a public UDP port forwarded to a client
+type udpTunnel struct {
+	port   int
+	pc     net.PacketConn
+	closed chan struct{}
+
+	mu sync.Mutex
+	// sessions holds the sessions of the tunnel by peer address
+	sessions map[string]*udpSession
+}
+
+// udpSession is the traffic between a visitor address and the client
+type udpSession struct {
+	id       string
+	tunnel   *udpTunnel
+	peer     net.Addr
+	lastSeen atomic.Int64
+}
+
+// touch marks the session as active
+func (s *udpSession) touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+// idleSince returns whether the session has been idle since the given time
+func (s *udpSession) idleSince(t time.Time) bool {
+	return s.lastSeen.Load() < t.UnixNano()
+}
+
+// registerUDP opens a public UDP port forwarded to the client, returning the allocated port
+func (s *Server) registerUDP(conn *ServerConnState, requested int) (int, error) {
+	ports := s.opts.udpPorts
+	if ports == nil {
+		return 0, fmt.Errorf("udp tunnels are not enabled")
+	}
+	var pc net.PacketConn
+	port, err := ports.acquire(requested, func(addr string) error {
+		var err error
+		pc, err = net.ListenPacket("udp", addr)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	tunnel := &udpTunnel{port: port, pc: pc, closed: make(chan struct{}), sessions: map[string]*udpSession{}}
+	conn.addUDPTunnel(tunnel)
+	conn.Logger.Info("udp tunnel opened", slog.Int("port", port))
+	go s.expireUDPSessions(conn, tunnel)
+	go s.readUDP(conn, tunnel)
+	return port, nil
+}
+
+// readUDP relays the datagrams received on a tunnel port to the client, opening a
+// session the first time a peer address is seen
+func (s *Server) readUDP(conn *ServerConnState, tunnel *udpTunnel) {
+	defer s.opts.udpPorts.release(tunnel.port)
+	buf := make([]byte, udpReadBufferSize)
+	for {
+		n, peer, err := tunnel.pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				conn.Logger.Error("could not read udp datagram", slog.Int("port", tunnel.port), "error", err)
+				conn.closeUDPTunnel(tunnel.port)
+			}
+			return
+		}
+		session, opened := tunnel.session(peer)
+		session.touch()
+		if opened {
+			conn.udpSessions.Store(session.id, session)
+			err := conn.Ch.Send(&UDPOpenMessage{
+				Type:       "udp-open",
+				ID:         session.id,
+				Port:       tunnel.port,
+				RemoteAddr: peer.String(),
+			})
+			if err != nil {
+				return
+			}
+		}
+		conn.bytesIn.Add(int64(n))
+		// the datagram is serialized asynchronously so it must not share the read buffer
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+		if conn.Ch.Send(&UDPDataMessage{Type: "udp-data", ID: session.id, Data: datagram}) != nil {
+			return
+		}
+	}
+}
+
+// session returns the session of a peer address, creating it when the peer is new
+func (t *udpTunnel) session(peer net.Addr) (*udpSession, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if session, ok := t.sessions[peer.String()]; ok {
+		return session, false
+	}
+	session := &udpSession{id: uuid.NewString(), tunnel: t, peer: peer}
+	t.sessions[peer.String()] = session
+	return session, true
+}
+
+// forget removes a session from the tunnel, returning whether it was still open
+func (t *udpTunnel) forget(session *udpSession) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sessions[session.peer.String()] != session {
+		return false
+	}
+	delete(t.sessions, session.peer.String())
+	return true
+}
+
+// expireUDPSessions closes the sessions of a tunnel that stayed idle for longer than the idle timeout
+func (s *Server) expireUDPSessions(conn *ServerConnState, tunnel *udpTunnel) {
+	idle := s.opts.udpIdleTimeout
+	ticker := time.NewTicker(idle / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tunnel.closed:
+			return
+		case now := <-ticker.C:
+			tunnel.mu.Lock()
+			expired := []*udpSession{}
+			for _, session := range tunnel.sessions {
+				if session.idleSince(now.Add(-idle)) {
+					expired = append(expired, session)
+				}
+			}
+			tunnel.mu.Unlock()
+			for _, session := range expired {
+				if conn.closeUDPSession(session.id) {
+					conn.Ch.Send(&UDPCloseMessage{Type: "udp-close", ID: session.id})
+				}
+			}
+		}
+	}
+}
+
+// addUDPTunnel records a UDP tunnel port of the client
+func (c *ServerConnState) addUDPTunnel(tunnel *udpTunnel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.udpTunnels == nil {
+		c.udpTunnels = map[int]*udpTunnel{}
+	}
+	c.udpTunnels[tunnel.port] = tunnel
+}
+
+// UDPPorts returns the public ports of the client UDP tunnels
+func (c *ServerConnState) UDPPorts() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ports := make([]int, 0, len(c.udpTunnels))
+	for port := range c.udpTunnels {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// closeUDPSession forgets a session, returning whether it was still open
+func (c *ServerConnState) closeUDPSession(id string) bool {
+	session, ok := c.udpSessions.LoadAndDelete(id)
+	if !ok {
+		return false
+	}
+	return session.(*udpSession).tunnel.forget(session.(*udpSession))
+}
+
+// closeUDPTunnel closes a UDP tunnel port of the client and forgets its sessions
+func (c *ServerConnState) closeUDPTunnel(port int) {
+	c.mu.Lock()
+	tunnel, ok := c.udpTunnels[port]
+	delete(c.udpTunnels, port)
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	close(tunnel.closed)
+	tunnel.pc.Close()
+	tunnel.mu.Lock()
+	for _, session := range tunnel.sessions {
+		c.udpSessions.Delete(session.id)
+	}
+	tunnel.sessions = map[string]*udpSession{}
+	tunnel.mu.Unlock()
+}
+
+// closeUDP closes the UDP tunnel ports of the client
+func (c *ServerConnState) closeUDP() {
+	for _, port := range c.UDPPorts() {
+		c.closeUDPTunnel(port)
+	}
+}
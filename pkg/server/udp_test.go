@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// newUDPTunnel registers a UDP tunnel on a free local port, returning the client and the port
+func newUDPTunnel(t *testing.T, options ...ServerOption) (*testClient, int) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	pc.Close()
+	ports, err := NewPortRange("127.0.0.1", port, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(New(append(options, WithUDPPorts(ports))...).Routes())
+	t.Cleanup(srv.Close)
+	client := dialTestClient(t, srv)
+	client.send(RegisterMessage{Type: "register", ID: uuid.NewString(), Protocol: ProtocolUDP}, nil)
+	if frame := client.next(); frame.Type != "registered" || frame.Port != port {
+		t.Fatalf("expected udp port %d to be registered, got %q %d: %s", port, frame.Type, frame.Port, frame.Message)
+	}
+	return client, port
+}
+
+// dialUDPPeer returns a UDP socket sending to the tunnel port
+func dialUDPPeer(t *testing.T, port int) net.Conn {
+	t.Helper()
+	peer, err := net.Dial("udp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	return peer
+}
+
+func TestUDPTunnel(t *testing.T) {
+	client, port := newUDPTunnel(t)
+	first, second := dialUDPPeer(t, port), dialUDPPeer(t, port)
+
+	sessions := map[string]net.Conn{}
+	for _, peer := range []net.Conn{first, second} {
+		if _, err := peer.Write([]byte("query from " + peer.LocalAddr().String())); err != nil {
+			t.Fatal(err)
+		}
+		opened := client.next()
+		if opened.Type != "udp-open" || opened.Port != port {
+			t.Fatalf("expected a udp-open frame for port %d, got %q", port, opened.Type)
+		}
+		data := client.next()
+		if data.Type != "udp-data" || data.ID != opened.ID || string(data.Payload) != "query from "+peer.LocalAddr().String() {
+			t.Fatalf("expected the datagram to be relayed, got %q %q", data.Type, data.Payload)
+		}
+		sessions[opened.ID] = peer
+	}
+	// a second datagram from a known peer reuses its session
+	first.Write([]byte("again"))
+	if data := client.next(); data.Type != "udp-data" || sessions[data.ID] != first {
+		t.Fatalf("expected the session of the first peer to be reused, got %q", data.Type)
+	}
+
+	for id, peer := range sessions {
+		client.send(&UDPDataMessage{Type: "udp-data", ID: id}, []byte("answer for "+peer.LocalAddr().String()))
+	}
+	for _, peer := range []net.Conn{first, second} {
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1024)
+		n, err := peer.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "answer for "+peer.LocalAddr().String() {
+			t.Errorf("expected the reply to reach its own peer, got %q", buf[:n])
+		}
+	}
+}
+
+func TestUDPSessionExpiry(t *testing.T) {
+	client, port := newUDPTunnel(t, WithUDPIdleTimeout(100*time.Millisecond))
+	peer := dialUDPPeer(t, port)
+	peer.Write([]byte("ping"))
+	opened := client.next()
+	client.next()
+	closed := client.next()
+	if closed.Type != "udp-close" || closed.ID != opened.ID {
+		t.Fatalf("expected the idle session to be closed, got %q", closed.Type)
+	}
+
+	peer.Write([]byte("ping"))
+	if reopened := client.next(); reopened.Type != "udp-open" || reopened.ID == opened.ID {
+		t.Fatalf("expected a new session after expiry, got %q", reopened.Type)
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Domain verification record layout
+const (
+	VerificationRecordPrefix = "_warp-challenge."
+	VerificationValuePrefix  = "warp-verification="
+)
+
+// verificationTimeout bounds the DNS lookup of a verification record
+const verificationTimeout = 5 * time.Second
+
+// TXTResolver looks up DNS TXT records
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// NewDNSResolver returns a TXTResolver querying the DNS server at addr, the system resolver when addr is empty
+func NewDNSResolver(addr string) TXTResolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// VerificationRequiredError is returned when a domain needs a DNS TXT record before it can be claimed
+type VerificationRequiredError struct {
+	Domain      string
+	RecordName  string
+	RecordValue string
+}
+
+func (e *VerificationRequiredError) Error() string {
+	return fmt.Sprintf("domain %s is not verified: add a TXT record %s with value %q", e.Domain, e.RecordName, e.RecordValue)
+}
+
+// DomainVerifier is a struct to check that an account controls a domain through a DNS TXT challenge
+type DomainVerifier struct {
+	secret   []byte
+	resolver TXTResolver
+
+	mu sync.RWMutex
+	// verified maps an account to its verified domains and when they were verified
+	verified map[string]map[string]time.Time
+	// store keeps the verified domains across restarts when set
+	store StateStore
+}
+
+// NewDomainVerifier creates a verifier deriving challenge tokens from secret
+func NewDomainVerifier(secret []byte, resolver TXTResolver) *DomainVerifier {
+	return &DomainVerifier{
+		secret:   secret,
+		resolver: resolver,
+		verified: map[string]map[string]time.Time{},
+	}
+}
+
+// Persist loads the verified domains kept in store and records the next changes into it
+func (v *DomainVerifier) Persist(store StateStore) error {
+	entries, err := store.List(BucketVerifiedDomains)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for key, data := range entries {
+		account, domain, ok := strings.Cut(key, "/")
+		var at time.Time
+		if err := json.Unmarshal(data, &at); err != nil || !ok {
+			return fmt.Errorf("invalid %s entry %s", BucketVerifiedDomains, key)
+		}
+		if v.verified[account] == nil {
+			v.verified[account] = map[string]time.Time{}
+		}
+		v.verified[account][domain] = at
+	}
+	v.store = store
+	return nil
+}
+
+// Challenge returns the TXT record an account must publish to prove it controls domain
+func (v *DomainVerifier) Challenge(account, domain string) (string, string) {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(account + "\n" + strings.ToLower(domain)))
+	token := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))[:32]
+	return VerificationRecordPrefix + strings.ToLower(domain), VerificationValuePrefix + token
+}
+
+// Verified returns whether an account verified domain or one of its parent domains
+func (v *DomainVerifier) Verified(account, domain string) bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	domains := v.verified[account]
+	for name := strings.ToLower(domain); name != ""; {
+		if _, ok := domains[name]; ok {
+			return true
+		}
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok || !strings.Contains(parent, ".") {
+			return false
+		}
+		name = parent
+	}
+	return false
+}
+
+// Verify checks the challenge record of domain unless the account already verified it
+func (v *DomainVerifier) Verify(ctx context.Context, account, domain string) error {
+	if v.Verified(account, domain) {
+		return nil
+	}
+	name, value := v.Challenge(account, domain)
+	ctx, cancel := context.WithTimeout(ctx, verificationTimeout)
+	defer cancel()
+	records, _ := v.resolver.LookupTXT(ctx, name)
+	for _, record := range records {
+		if hmac.Equal([]byte(strings.TrimSpace(record)), []byte(value)) {
+			return v.MarkVerified(account, domain, time.Now())
+		}
+	}
+	return &VerificationRequiredError{Domain: domain, RecordName: name, RecordValue: value}
+}
+
+// MarkVerified records domain as verified by an account
+func (v *DomainVerifier) MarkVerified(account, domain string, at time.Time) error {
+	domain = strings.ToLower(domain)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.store != nil {
+		if err := putJSON(v.store, BucketVerifiedDomains, account+"/"+domain, at); err != nil {
+			return fmt.Errorf("could not store the verified domain: %v", err)
+		}
+	}
+	if v.verified[account] == nil {
+		v.verified[account] = map[string]time.Time{}
+	}
+	v.verified[account][domain] = at
+	return nil
+}
+
+// Forget drops a verified domain of an account
+func (v *DomainVerifier) Forget(account, domain string) error {
+	domain = strings.ToLower(domain)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.store != nil {
+		if err := v.store.Delete(BucketVerifiedDomains, account+"/"+domain); err != nil {
+			return fmt.Errorf("could not drop the verified domain: %v", err)
+		}
+	}
+	delete(v.verified[account], domain)
+	return nil
+}
+
+// VerifiedDomains returns the verified domains of every account
+func (v *DomainVerifier) VerifiedDomains() map[string][]string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	result := map[string][]string{}
+	for account, domains := range v.verified {
+		for domain := range domains {
+			result[account] = append(result[account], domain)
+		}
+		sort.Strings(result[account])
+	}
+	return result
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsStandIn is a UDP DNS server answering TXT queries from an in-memory zone
+type dnsStandIn struct {
+	conn *net.UDPConn
+	mu   sync.Mutex
+	txt  map[string][]string
+}
+
+func newDNSStandIn(t *testing.T) *dnsStandIn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &dnsStandIn{conn: conn, txt: map[string][]string{}}
+	t.Cleanup(func() { conn.Close() })
+	go d.serve()
+	return d
+}
+
+func (d *dnsStandIn) addr() string {
+	return d.conn.LocalAddr().String()
+}
+
+func (d *dnsStandIn) set(name string, values ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.txt[strings.ToLower(strings.TrimSuffix(name, "."))] = values
+}
+
+func (d *dnsStandIn) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, peer, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 {
+			continue
+		}
+		question := query.Questions[0]
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true},
+			Questions: query.Questions,
+		}
+		d.mu.Lock()
+		values, ok := d.txt[strings.ToLower(strings.TrimSuffix(question.Name.String(), "."))]
+		d.mu.Unlock()
+		if !ok {
+			resp.RCode = dnsmessage.RCodeNameError
+		} else if question.Type == dnsmessage.TypeTXT {
+			for _, value := range values {
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.TXTResource{TXT: []string{value}},
+				})
+			}
+		}
+		packed, err := resp.Pack()
+		if err != nil {
+			continue
+		}
+		d.conn.WriteToUDP(packed, peer)
+	}
+}
+
+func TestRegisterRequiresDomainVerification(t *testing.T) {
+	dns := newDNSStandIn(t)
+	verifier := NewDomainVerifier([]byte("secret"), NewDNSResolver(dns.addr()))
+	s := New(WithDomainVerifier(verifier))
+	srv := httptest.NewServer(s.Routes())
+	defer srv.Close()
+
+	client := dialTestClient(t, srv)
+	client.send(RegisterMessage{Type: "register", ID: "1", APIKey: "alice", Domain: "app.example.com"}, nil)
+	challenge := client.next()
+	if challenge.Type != "verification-required" || challenge.RecordName != "_warp-challenge.app.example.com" {
+		t.Fatalf("expected a verification challenge, got %+v", challenge)
+	}
+	if _, ok := s.DomainClients()["app.example.com"]; ok {
+		t.Fatal("unverified domain must not be linked")
+	}
+
+	dns.set(challenge.RecordName, "unrelated", challenge.RecordValue)
+	client.send(RegisterMessage{Type: "register", ID: "2", APIKey: "alice", Domain: "app.example.com"}, nil)
+	if frame := client.next(); frame.Type != "registered" {
+		t.Fatalf("expected the verified domain to be registered, got %+v", frame)
+	}
+	if !verifier.Verified(accountID("alice"), "app.example.com") {
+		t.Error("expected the verification to be cached for the account")
+	}
+
+	// the challenge is bound to the account so another key cannot reuse the record
+	other := dialTestClient(t, srv)
+	other.send(RegisterMessage{Type: "register", ID: "3", APIKey: "mallory", Domain: "app.example.com"}, nil)
+	if frame := other.next(); frame.Type != "verification-required" || frame.RecordValue == challenge.RecordValue {
+		t.Errorf("expected a different challenge for another account, got %+v", frame)
+	}
+}
@@ -1,8 +1,10 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -14,6 +16,8 @@ type duplexChan[TSend, TReceive Chunked] struct {
 	done   chan bool
 	send   chan<- TSend
 	recv   <-chan TReceive
+	// closing hands a close frame to the writer so that it follows the messages already sent
+	closing chan []byte
 }
 
 // Recv is a method to receive a message
@@ -36,9 +40,39 @@ func (c *duplexChan[TSend, TReceive]) Send(msg TSend) error {
 
 // Close is a method to check if the channel is closed
 func (c *duplexChan[TSend, TReceive]) Close() bool {
+	return c.closeWithReason(CloseReasonLocal)
+}
+
+// CloseWithCode is a method to send a close frame with the given code and text after the
+// pending messages, then close the channel. The channel is closed without the frame when
+// the context is done first.
+func (c *duplexChan[TSend, TReceive]) CloseWithCode(ctx context.Context, code int, text string) bool {
+	if c.closed.Load() {
+		return false
+	}
+	select {
+	case <-c.done:
+		return false
+	case <-ctx.Done():
+		return c.closeWithReason(CloseReasonLocal)
+	case c.closing <- websocket.FormatCloseMessage(code, text):
+	}
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		c.closeWithReason(CloseReasonLocal)
+	}
+	return true
+}
+
+// closeWithReason closes the channel and reports why it was closed to the observer
+func (c *duplexChan[TSend, TReceive]) closeWithReason(reason string) bool {
 	swapped := c.closed.CompareAndSwap(false, true)
 	if swapped {
 		close(c.done)
+		if c.opts.observer != nil {
+			c.opts.observer.Closed(reason)
+		}
 	}
 	return swapped
 }
@@ -56,6 +90,8 @@ type DuplexChan[TSend, TReceive Chunked] interface {
 	Recv() <-chan TReceive
 	// Close is a method to close the channel
 	Close() bool
+	// CloseWithCode is a method to tell the peer why the channel is closed before closing it
+	CloseWithCode(ctx context.Context, code int, text string) bool
 	// Closed is a method to check if the channel is closed
 	Closed() <-chan bool
 }
@@ -68,10 +104,41 @@ type ChanSerializer[TSend, TReceive Chunked] interface {
 	Deserialize([]byte) (TReceive, error)
 }
 
+const (
+	// closeFrameTimeout bounds the time spent writing a close frame to a slow peer
+	closeFrameTimeout = 5 * time.Second
+	// writeTimeout bounds the time spent writing a message to a peer that stopped reading
+	writeTimeout = 30 * time.Second
+)
+
+// Close reasons reported to a ChanObserver
+const (
+	CloseReasonLocal            = "local"
+	CloseReasonPeer             = "peer"
+	CloseReasonReadError        = "read-error"
+	CloseReasonWriteError       = "write-error"
+	CloseReasonSerializeError   = "serialize-error"
+	CloseReasonDeserializeError = "deserialize-error"
+)
+
+// ChanObserver is an interface for observing the traffic of a channel
+type ChanObserver[TSend, TReceive Chunked] interface {
+	// Sent is called after a message of the given size was written
+	Sent(msg TSend, size int)
+	// Received is called after a message of the given size was read
+	Received(msg TReceive, size int)
+	// SerializerError is called when a message could not be (de)serialized
+	SerializerError(err error)
+	// Closed is called once when the channel is closed
+	Closed(reason string)
+}
+
 // Options is a struct to hold options for a channel
 type Options[TSend, TReceive Chunked] struct {
 	// serializer is a serializer for the channel
 	serializer ChanSerializer[TSend, TReceive]
+	// observer is notified about the channel traffic
+	observer ChanObserver[TSend, TReceive]
 }
 
 // Option is a type for options
@@ -84,6 +151,13 @@ func WithSerializer[TSend, TReceive Chunked](serializer ChanSerializer[TSend, TR
 	}
 }
 
+// WithObserver is an option to set a channel observer
+func WithObserver[TSend, TReceive Chunked](observer ChanObserver[TSend, TReceive]) Option[TSend, TReceive] {
+	return func(o *Options[TSend, TReceive]) {
+		o.observer = observer
+	}
+}
+
 // NewDuplexChan creates a new channel for sending and receiving messages
 func NewDuplexChan[TSend, TReceive Chunked](ws *websocket.Conn, options ...Option[TSend, TReceive]) DuplexChan[TSend, TReceive] {
 	opts := Options[TSend, TReceive]{
@@ -96,17 +170,18 @@ func NewDuplexChan[TSend, TReceive Chunked](ws *websocket.Conn, options ...Optio
 	send := make(chan TSend)
 	recv := make(chan TReceive)
 	dpChan := &duplexChan[TSend, TReceive]{
-		opts:   opts,
-		ws:     ws,
-		closed: &atomic.Bool{},
-		done:   done,
-		recv:   recv,
-		send:   send,
+		opts:    opts,
+		ws:      ws,
+		closed:  &atomic.Bool{},
+		done:    done,
+		recv:    recv,
+		send:    send,
+		closing: make(chan []byte),
 	}
+	// send and recv are never closed, a goroutine may still be handing them a message,
+	// both sides stop on done instead
 	go func() {
 		<-done
-		close(send)
-		close(recv)
 		ws.Close()
 	}()
 	go func() {
@@ -114,17 +189,28 @@ func NewDuplexChan[TSend, TReceive Chunked](ws *websocket.Conn, options ...Optio
 			select {
 			case <-done:
 				return
+			case frame := <-dpChan.closing:
+				ws.WriteControl(websocket.CloseMessage, frame, time.Now().Add(closeFrameTimeout))
+				dpChan.closeWithReason(CloseReasonLocal)
+				return
 			case message := <-send:
 				msg, serErr := opts.serializer.Serialize(message)
 				if serErr != nil {
-					dpChan.Close()
+					if opts.observer != nil {
+						opts.observer.SerializerError(serErr)
+					}
+					dpChan.closeWithReason(CloseReasonSerializeError)
 					return
 				}
+				ws.SetWriteDeadline(time.Now().Add(writeTimeout))
 				err := ws.WriteMessage(websocket.BinaryMessage, msg)
 				if err != nil {
-					dpChan.Close()
+					dpChan.closeWithReason(CloseReasonWriteError)
 					return
 				}
+				if opts.observer != nil {
+					opts.observer.Sent(message, len(msg))
+				}
 			}
 		}
 	}()
@@ -133,19 +219,33 @@ func NewDuplexChan[TSend, TReceive Chunked](ws *websocket.Conn, options ...Optio
 		for {
 			messageType, message, err := ws.ReadMessage()
 			if err != nil {
-				dpChan.Close()
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					dpChan.closeWithReason(CloseReasonPeer)
+				} else {
+					dpChan.closeWithReason(CloseReasonReadError)
+				}
 				return
 			}
 			if messageType == websocket.CloseMessage {
-				dpChan.Close()
+				dpChan.closeWithReason(CloseReasonPeer)
 				return
 			}
 			recvMsg, err := opts.serializer.Deserialize(message)
 			if err != nil {
-				dpChan.Close()
+				if opts.observer != nil {
+					opts.observer.SerializerError(err)
+				}
+				dpChan.closeWithReason(CloseReasonDeserializeError)
+				return
+			}
+			if opts.observer != nil {
+				opts.observer.Received(recvMsg, len(message))
+			}
+			select {
+			case recv <- recvMsg:
+			case <-done:
 				return
 			}
-			recv <- recvMsg
 		}
 	}()
 	return dpChan
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDuplexChanCloseWhileReceiving(t *testing.T) {
+	chans := make(chan DuplexChan[ServerMessage, ClientMessage], 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		chans <- NewDuplexChan(ws, WithSerializer[ServerMessage, ClientMessage](messageSerializer{}))
+	}))
+	t.Cleanup(srv.Close)
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ch := <-chans
+
+	// nobody receives, the reader is left waiting to hand the message over
+	msg, err := createMessage(RegisterMessage{Type: "register", ID: "1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !ch.Close() {
+		t.Fatal("expected the channel to close")
+	}
+	// a send on a closed recv channel would crash the test binary
+	time.Sleep(50 * time.Millisecond)
+	if err := ch.Send(&RequestDataEndMessage{Type: "request-end", ID: "1"}); err == nil {
+		t.Error("expected sending on a closed channel to fail")
+	}
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/mcandeia/warp-go-server/pkg/server"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// metaBucket holds the schema version of the store
+	metaBucket = []byte("meta")
+	versionKey = []byte("version")
+)
+
+// migrations upgrade the store one schema version at a time, migrations[i] upgrades version i
+// to version i+1. Released migrations are never changed, new schema versions append one.
+var migrations = []func(tx *bolt.Tx) error{
+	// 1: the buckets of the server state
+	func(tx *bolt.Tx) error {
+		for _, name := range server.StateBuckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// SchemaVersion is the schema version of the stores written by this server
+var SchemaVersion = len(migrations)
+
+// migrate upgrades the store to the current schema version
+func migrate(tx *bolt.Tx) error {
+	if _, err := tx.CreateBucketIfNotExists(metaBucket); err != nil {
+		return err
+	}
+	version := schemaVersion(tx)
+	if version > len(migrations) {
+		return fmt.Errorf("schema version %d is newer than this server supports (%d)", version, len(migrations))
+	}
+	return migrateFrom(tx, version)
+}
+
+// migrateFrom runs the migrations after version and records the current version
+func migrateFrom(tx *bolt.Tx, version int) error {
+	for ; version < len(migrations); version++ {
+		if err := migrations[version](tx); err != nil {
+			return fmt.Errorf("migration to version %d: %v", version+1, err)
+		}
+	}
+	return tx.Bucket(metaBucket).Put(versionKey, []byte(strconv.Itoa(version)))
+}
+
+// schemaVersion returns the version recorded in the store, 0 for new stores
+func schemaVersion(tx *bolt.Tx) int {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		return 0
+	}
+	version, _ := strconv.Atoi(string(meta.Get(versionKey)))
+	return version
+}
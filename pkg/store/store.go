@@ -0,0 +1,192 @@
+// Package store keeps the registration state of the server in an embedded bbolt file: subdomain
+// reservations, issued API keys, verified custom domains and domain settings
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mcandeia/warp-go-server/pkg/server"
+	bolt "go.etcd.io/bbolt"
+)
+
+// openTimeout bounds the wait for the file lock, another process may hold the store
+const openTimeout = time.Second
+
+// Store is a server.StateStore kept in a bbolt file
+type Store struct {
+	db *bolt.DB
+}
+
+// Open is a function to open the store at path, creating it when missing and migrating it to
+// the current schema version
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: openTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("store %s is in use by another process", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(migrate); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not migrate store %s: %v", path, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close is a method to release the store file
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Version is a method to return the schema version of the store
+func (s *Store) Version() (int, error) {
+	var version int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		version = schemaVersion(tx)
+		return nil
+	})
+	return version, err
+}
+
+// Get is a method to return the value of a key
+func (s *Store) Get(bucket, key string) ([]byte, bool, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := dataBucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		// values are only valid during the transaction
+		if v := b.Get([]byte(key)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, value != nil, err
+}
+
+// Put is a method to set the value of a key
+func (s *Store) Put(bucket, key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := dataBucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+// Delete is a method to remove a key
+func (s *Store) Delete(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := dataBucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// List is a method to return every key and value of a bucket
+func (s *Store) List(bucket string) (map[string][]byte, error) {
+	entries := map[string][]byte{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := dataBucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			entries[string(k)] = append([]byte{}, v...)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// dataBucket returns a bucket of the server state
+func dataBucket(tx *bolt.Tx, name string) (*bolt.Bucket, error) {
+	b := tx.Bucket([]byte(name))
+	if b == nil {
+		return nil, fmt.Errorf("unknown bucket %q", name)
+	}
+	return b, nil
+}
+
+// Export is the document written by Store.Export, every value is the JSON document kept in the store
+type Export struct {
+	Version    int                                   `json:"version"`
+	ExportedAt time.Time                             `json:"exportedAt"`
+	Buckets    map[string]map[string]json.RawMessage `json:"buckets"`
+}
+
+// Export is a method to write the whole state as a JSON document
+func (s *Store) Export(w io.Writer) error {
+	export := Export{ExportedAt: time.Now().UTC(), Buckets: map[string]map[string]json.RawMessage{}}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		export.Version = schemaVersion(tx)
+		for _, name := range server.StateBuckets {
+			entries := map[string]json.RawMessage{}
+			err := tx.Bucket([]byte(name)).ForEach(func(k, v []byte) error {
+				entries[string(k)] = append(json.RawMessage{}, v...)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			export.Buckets[name] = entries
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(export)
+}
+
+// Import is a method to load a document written by Export, the keys it holds replace the
+// existing ones and the other keys are kept. Exports of older schema versions are migrated.
+func (s *Store) Import(r io.Reader) error {
+	var export Export
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return fmt.Errorf("invalid export: %v", err)
+	}
+	if export.Version < 1 || export.Version > len(migrations) {
+		return fmt.Errorf("export of schema version %d, this server supports versions 1 to %d", export.Version, len(migrations))
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		// the migrations after the export version run on the imported entries
+		if err := importBuckets(tx, export); err != nil {
+			return err
+		}
+		return migrateFrom(tx, export.Version)
+	})
+}
+
+// importBuckets writes the entries of an export
+func importBuckets(tx *bolt.Tx, export Export) error {
+	for name, entries := range export.Buckets {
+		b, err := tx.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		for key, value := range entries {
+			// the export is indented, the store keeps compact documents
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, value); err != nil {
+				return fmt.Errorf("invalid %s entry %s: %v", name, key, err)
+			}
+			if err := b.Put([]byte(key), compact.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mcandeia/warp-go-server/pkg/server"
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestStore(t *testing.T, path string) *Store {
+	t.Helper()
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestStoreKeepsStateAcrossOpens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "warp.db")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(server.BucketReservations, "account", []byte(`"brave-otter-1"`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(server.BucketReservations, "other", []byte(`"calm-panda-2"`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(server.BucketReservations, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("unknown", "key", []byte(`{}`)); err == nil {
+		t.Error("expected writes to unknown buckets to fail")
+	}
+	store.Close()
+
+	store = openTestStore(t, path)
+	value, ok, err := store.Get(server.BucketReservations, "account")
+	if err != nil || !ok || string(value) != `"brave-otter-1"` {
+		t.Errorf("got %s %v %v want the stored reservation", value, ok, err)
+	}
+	entries, err := store.List(server.BucketReservations)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("got %v %v want the deleted key to stay deleted", entries, err)
+	}
+	if version, _ := store.Version(); version != SchemaVersion {
+		t.Errorf("got version %d want %d", version, SchemaVersion)
+	}
+}
+
+func TestStoreRefusesNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "warp.db")
+	store := openTestStore(t, path)
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(versionKey, []byte("99"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	if _, err := Open(path); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("got %v want an error about the newer schema", err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	source := openTestStore(t, filepath.Join(t.TempDir(), "source.db"))
+	source.Put(server.BucketAPIKeys, "account", []byte(`{"account":"account","name":"ci"}`))
+	source.Put(server.BucketDomainSettings, "app.example.com", []byte(`{"inspect":true}`))
+
+	var export bytes.Buffer
+	if err := source.Export(&export); err != nil {
+		t.Fatal(err)
+	}
+	var document Export
+	if err := json.Unmarshal(export.Bytes(), &document); err != nil {
+		t.Fatal(err)
+	}
+	if document.Version != SchemaVersion || len(document.Buckets) != len(server.StateBuckets) {
+		t.Errorf("got version %d and %d buckets", document.Version, len(document.Buckets))
+	}
+
+	target := openTestStore(t, filepath.Join(t.TempDir(), "target.db"))
+	target.Put(server.BucketDomainSettings, "app.example.com", []byte(`{}`))
+	target.Put(server.BucketDomainSettings, "kept.example.com", []byte(`{}`))
+	if err := target.Import(bytes.NewReader(export.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	settings, _ := target.List(server.BucketDomainSettings)
+	if string(settings["app.example.com"]) != `{"inspect":true}` || settings["kept.example.com"] == nil {
+		t.Errorf("expected the import to replace its keys and keep the others, got %s", settings)
+	}
+	if _, ok, _ := target.Get(server.BucketAPIKeys, "account"); !ok {
+		t.Error("expected the api key to be imported")
+	}
+
+	for name, document := range map[string]string{
+		"newer version": `{"version":99,"buckets":{}}`,
+		"no version":    `{"buckets":{}}`,
+		"not json":      `version 1`,
+	} {
+		if err := target.Import(strings.NewReader(document)); err == nil {
+			t.Errorf("%s: expected the import to fail", name)
+		}
+	}
+}
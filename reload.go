@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/mcandeia/warp-go-server/pkg/config"
+	"github.com/mcandeia/warp-go-server/pkg/server"
+)
+
+// newReloader returns a function reading the configuration again and applying the keys that
+// can change while the server runs: API keys, limits, domain policies and log level
+func newReloader(logger *slog.Logger, source *config.Source, current *config.Config, level *slog.LevelVar, setPolicy func(server.Policy)) func() (server.ReloadReport, error) {
+	var mu sync.Mutex
+	return func() (server.ReloadReport, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		next, err := source.Load()
+		if err == nil {
+			err = next.Validate()
+		}
+		if err != nil {
+			logger.Error("Configuration reload failed, keeping the running configuration", "error", err)
+			return server.ReloadReport{}, fmt.Errorf("invalid configuration: %v", err)
+		}
+		report := server.ReloadReport{Applied: []string{}, RequiresRestart: []string{}}
+		for _, change := range config.Diff(current, next) {
+			if change.Reloadable {
+				report.Applied = append(report.Applied, change.String())
+				logger.Info("Configuration changed", "change", change.String())
+			} else {
+				report.RequiresRestart = append(report.RequiresRestart, change.String())
+				logger.Warn("Configuration change requires a restart", "change", change.String())
+			}
+		}
+		current.ApplyReloadable(next)
+		level.UnmarshalText([]byte(current.Logging.Level))
+		setPolicy(current.Policy())
+		logger.Info("Configuration reloaded", "applied", len(report.Applied), "requires_restart", len(report.RequiresRestart))
+		return report, nil
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mcandeia/warp-go-server/pkg/server"
+)
+
+// headerFlags is a repeatable "Key: value" flag
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headerFlags) Set(value string) error {
+	key, val, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("expected \"Key: value\", got %q", value)
+	}
+	h[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	return nil
+}
+
+// runReplay implements the replay command, asking a running server to replay a captured request
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	adminURL := fs.String("admin-url", "http://localhost:9091", "admin API base URL")
+	token := fs.String("admin-token", os.Getenv("WARP_ADMIN_TOKEN"), "admin API token (default $WARP_ADMIN_TOKEN)")
+	method := fs.String("method", "", "override the request method")
+	url := fs.String("url", "", "override the request URL (path and query)")
+	bodyFile := fs.String("body-file", "", "replace the request body with the file contents, - for stdin")
+	headers := headerFlags{}
+	fs.Var(headers, "header", "override a request header as \"Key: value\", an empty value removes it (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: warp-go-server replay [flags] <capture-id>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	edits := server.ReplayEdits{Method: *method, URL: *url, Headers: headers}
+	if *bodyFile != "" {
+		var err error
+		if *bodyFile == "-" {
+			edits.Body, err = io.ReadAll(os.Stdin)
+		} else {
+			edits.Body, err = os.ReadFile(*bodyFile)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	payload, _ := json.Marshal(edits)
+	req, err := http.NewRequest("POST", strings.TrimSuffix(*adminURL, "/")+"/inspector/captures/"+fs.Arg(0)+"/replay", bytes.NewReader(payload))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "replay failed: %s: %s", resp.Status, msg)
+		return 1
+	}
+	var result server.ReplayResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printResponse(os.Stdout, "original", result.Original)
+	printResponse(os.Stdout, "replay", result.Replay)
+	return 0
+}
+
+// printResponse writes the response part of a capture
+func printResponse(w io.Writer, title string, c server.Capture) {
+	fmt.Fprintf(w, "=== %s: %s %s -> %d (%s)\n", title, c.Method, c.URL, c.Status, c.Duration)
+	keys := make([]string, 0, len(c.ResponseHeaders))
+	for key := range c.ResponseHeaders {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s: %s\n", key, c.ResponseHeaders[key])
+	}
+	fmt.Fprintf(w, "\n%s\n", c.ResponseBody)
+	if c.ResponseTruncated {
+		fmt.Fprintln(w, "... (truncated)")
+	}
+}